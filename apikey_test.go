@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"platzi.com/go/rest-ws/auth"
+	"platzi.com/go/rest-ws/handlers"
+	"platzi.com/go/rest-ws/models"
+)
+
+// createAPIKey crea una API key con los scopes para el usuario del token y devuelve la llave y su id
+func (api *testAPI) createAPIKey(token string, scopes ...string) (string, string) {
+	api.t.Helper()
+	status, body := api.request(http.MethodPost, "/api/v1/apikeys", token, map[string]interface{}{"name": "cli", "scopes": scopes})
+	if status != http.StatusCreated {
+		api.t.Fatalf("create api key: %d %s", status, body)
+	}
+	var created struct{ Id, Key string }
+	json.Unmarshal([]byte(body), &created)
+	return created.Key, created.Id
+}
+
+// una API key solo sirve en las rutas declaradas con AllowAPIKey y si tiene el scope de la ruta
+func TestAPIKeyScopes(t *testing.T) {
+	api := newTestAPI(t, nil)
+	api.signup("user@example.com")
+	token := api.login("user@example.com")
+	read, _ := api.createAPIKey(token, models.SCOPE_POSTS_READ)
+	write, _ := api.createAPIKey(token, models.SCOPE_POSTS_WRITE)
+
+	status, body := api.request(http.MethodPost, "/api/v1/posts", write, map[string]string{"post_content": "from the cli"})
+	if status != http.StatusOK {
+		t.Fatalf("insert post with a posts:write key: %d %s", status, body)
+	}
+	var post struct{ Id string }
+	json.Unmarshal([]byte(body), &post)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		body   interface{}
+		status int
+	}{
+		{"posts:read key on POST /posts", http.MethodPost, "/api/v1/posts", read, map[string]string{"post_content": "hello"}, http.StatusForbidden},
+		{"posts:read key on PUT /posts/{id}", http.MethodPut, "/api/v1/posts/" + post.Id, read, map[string]string{"post_content": "edited"}, http.StatusForbidden},
+		{"posts:write key on PUT /posts/{id}", http.MethodPut, "/api/v1/posts/" + post.Id, write, map[string]string{"post_content": "edited"}, http.StatusOK},
+		{"key on /me", http.MethodGet, "/api/v1/me", write, nil, http.StatusForbidden},
+		{"key on /sessions", http.MethodGet, "/api/v1/sessions", write, nil, http.StatusForbidden},
+		{"key creating another key", http.MethodPost, "/api/v1/apikeys", write, map[string]interface{}{"name": "other", "scopes": []string{models.SCOPE_POSTS_WRITE}}, http.StatusForbidden},
+		{"key disabling totp", http.MethodDelete, "/api/v1/mfa/totp", write, map[string]string{"code": "123456"}, http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		if status, body := api.request(tc.method, tc.path, tc.key, tc.body); status != tc.status {
+			t.Errorf("%s: expected %d, got %d %s", tc.name, tc.status, status, body)
+		}
+	}
+}
+
+func TestRevokedOrExpiredAPIKey(t *testing.T) {
+	api := newTestAPI(t, nil)
+	user := api.signup("user@example.com")
+	token := api.login("user@example.com")
+
+	revoked, id := api.createAPIKey(token, models.SCOPE_POSTS_WRITE)
+	if status, body := api.request(http.MethodDelete, "/api/v1/apikeys/"+id, token, nil); status != http.StatusOK {
+		t.Fatalf("revoke api key: %d %s", status, body)
+	}
+	// al crearla la fecha tiene que ser futura, la llave vencida se guarda directo en el repositorio
+	if status, _ := api.request(http.MethodPost, "/api/v1/apikeys", token, map[string]interface{}{"name": "cli", "scopes": []string{models.SCOPE_POSTS_WRITE}, "expiresAt": time.Now().Add(-time.Minute)}); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an expiresAt in the past, got %d", status)
+	}
+	expired, hash, err := auth.NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(-time.Minute)
+	err = api.repo.InsertAPIKey(context.Background(), &models.APIKey{
+		Id:        ksuid.New().String(),
+		UserId:    user.Id,
+		Name:      "expired",
+		Prefix:    expired[:handlers.API_KEY_DISPLAY_PREFIX],
+		KeyHash:   hash,
+		Scopes:    []string{models.SCOPE_POSTS_WRITE},
+		ExpiresAt: &expiresAt,
+		CreatedAt: time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]string{"revoked key": revoked, "expired key": expired} {
+		if status, _ := api.request(http.MethodPost, "/api/v1/posts", key, map[string]string{"post_content": "hello"}); status != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, status)
+		}
+	}
+}
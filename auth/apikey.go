@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"platzi.com/go/rest-ws/repository"
+)
+
+// las API keys empiezan con este prefijo, así se distinguen de los jwt
+const API_KEY_PREFIX = "rws_"
+
+var ErrMissingScope = errors.New("api key does not have the required scope")
+
+// NewAPIKey genera una API key y su hash, la llave solo se le muestra una vez al usuario
+func NewAPIKey() (key string, hash string, err error) {
+	return newOpaqueToken(API_KEY_PREFIX)
+}
+
+// apiKeyAuthenticator acepta las API keys y deja pasar los demás tokens al authenticator de siempre
+type apiKeyAuthenticator struct {
+	Authenticator
+}
+
+// WithAPIKeys envuelve el authenticator para que también acepte API keys como alternativa a los jwt
+func WithAPIKeys(authenticator Authenticator) Authenticator {
+	return &apiKeyAuthenticator{Authenticator: authenticator}
+}
+
+func (a *apiKeyAuthenticator) AuthenticateToken(ctx context.Context, tokenString string) (*Principal, error) {
+	if !strings.HasPrefix(tokenString, API_KEY_PREFIX) {
+		return a.Authenticator.AuthenticateToken(ctx, tokenString)
+	}
+	key, err := repository.GetAPIKeyByHash(ctx, HashToken(tokenString))
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt)) {
+		return nil, ErrInvalidToken
+	}
+	// la API key no lleva los roles del usuario, solo sirve para las rutas que aceptan sus scopes
+	principal := &Principal{
+		UserId:   key.UserId,
+		TokenId:  key.Id,
+		APIKeyId: key.Id,
+		Scopes:   key.Scopes,
+	}
+	if key.ExpiresAt != nil {
+		principal.ExpiresAt = *key.ExpiresAt
+	}
+	return principal, nil
+}
+
+// scopedAuthenticator exige un scope a las API keys, los tokens de sesión pasan siempre
+type scopedAuthenticator struct {
+	Authenticator
+	scope string
+}
+
+// RequireScope envuelve el authenticator para que rechace las API keys sin el scope, lo usa el websocket que no pasa por el middleware
+func RequireScope(authenticator Authenticator, scope string) Authenticator {
+	return &scopedAuthenticator{Authenticator: authenticator, scope: scope}
+}
+
+func (a *scopedAuthenticator) AuthenticateToken(ctx context.Context, tokenString string) (*Principal, error) {
+	principal, err := a.Authenticator.AuthenticateToken(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if !principal.HasScope(a.scope) {
+		return nil, ErrMissingScope
+	}
+	return principal, nil
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/segmentio/ksuid"
+	"platzi.com/go/rest-ws/models"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Authenticator convierte el token que envía el cliente en un Principal
+type Authenticator interface {
+	AuthenticateToken(ctx context.Context, tokenString string) (*Principal, error)
+}
+
+// propósitos de los tokens de un solo uso, un token con propósito nunca sirve como access token:
+// verificar el email y terminar el login con el segundo factor (mfa_pending)
+const (
+	PURPOSE_VERIFY_EMAIL = "verify_email"
+	PURPOSE_MFA_PENDING  = "mfa_pending"
+)
+
+// Issuer crea los access tokens de la sesión que después valida el Authenticator, devuelve el token y cuándo vence,
+// también crea y valida los tokens firmados de un solo uso, como los que se envían por correo
+type Issuer interface {
+	IssueAccessToken(user *models.User, sessionId string) (tokenString string, expiresAt time.Time, err error)
+	IssuePurposeToken(userId string, purpose string, ttl time.Duration) (string, error)
+	ParsePurposeToken(tokenString string, purpose string) (*models.AppClaims, error)
+}
+
+// JWTAuthenticator firma y valida los tokens con las llaves del key ring, los access tokens duran accessTTL
+type JWTAuthenticator struct {
+	keys      *KeyRing
+	accessTTL time.Duration
+}
+
+func NewJWTAuthenticator(keys *KeyRing, accessTTL time.Duration) *JWTAuthenticator {
+	return &JWTAuthenticator{keys: keys, accessTTL: accessTTL}
+}
+
+func (a *JWTAuthenticator) IssueAccessToken(user *models.User, sessionId string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(a.accessTTL)
+	// Crear claim en el que se va a pasar el userId, y de StandardClaims pasar el id único del token (jti), cuándo se creó y cuándo vence:
+	claims := models.AppClaims{
+		UserId:        user.Id,
+		Roles:         user.Roles,
+		SessionId:     sessionId,
+		IssuedAtMicro: now.UnixMicro(),
+		StandardClaims: jwt.StandardClaims{
+			Id:        ksuid.New().String(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+	}
+	// se firma con la llave activa del key ring, su kid va en el header del token
+	tokenString, err := a.keys.Sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tokenString, expiresAt, nil
+}
+
+func (a *JWTAuthenticator) AuthenticateToken(ctx context.Context, tokenString string) (*Principal, error) {
+	// En ParseWithClaims pasar el token, los claims (tipo de dato para descompilar el token), y la función que devuelve la llave según el kid y alg del token:
+	token, err := jwt.ParseWithClaims(tokenString, &models.AppClaims{}, a.keys.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*models.AppClaims)
+	// los tokens con propósito (verificar email, etc) no sirven para autenticarse
+	if !ok || !token.Valid || claims.Purpose != "" {
+		return nil, ErrInvalidToken
+	}
+	return principalFromClaims(claims), nil
+}
+
+// IssuePurposeToken firma un token para el propósito indicado, el que lo usa debe guardar su jti para que no se pueda volver a usar
+func (a *JWTAuthenticator) IssuePurposeToken(userId string, purpose string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return a.keys.Sign(models.AppClaims{
+		UserId:  userId,
+		Purpose: purpose,
+		StandardClaims: jwt.StandardClaims{
+			Id:        ksuid.New().String(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+	})
+}
+
+// ParsePurposeToken valida la firma y el vencimiento del token y que sea del propósito indicado
+func (a *JWTAuthenticator) ParsePurposeToken(tokenString string, purpose string) (*models.AppClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &models.AppClaims{}, a.keys.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*models.AppClaims)
+	if !ok || !token.Valid || claims.Purpose != purpose || claims.Id == "" {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// principalFromClaims arma el principal con los datos del token
+func principalFromClaims(claims *models.AppClaims) *Principal {
+	principal := &Principal{
+		UserId:    claims.UserId,
+		Roles:     claims.Roles,
+		TokenId:   claims.Id,
+		SessionId: claims.SessionId,
+	}
+	if claims.IssuedAtMicro != 0 {
+		principal.IssuedAt = time.UnixMicro(claims.IssuedAtMicro)
+	} else if claims.IssuedAt != 0 {
+		principal.IssuedAt = time.Unix(claims.IssuedAt, 0)
+	}
+	if claims.ExpiresAt != 0 {
+		principal.ExpiresAt = time.Unix(claims.ExpiresAt, 0)
+	}
+	return principal
+}
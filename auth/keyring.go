@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// tamaño mínimo de las llaves RSA
+const MIN_RSA_KEY_BITS = 2048
+
+var ErrUnexpectedSigningMethod = errors.New("unexpected signing method")
+
+// SigningKey es una llave del key ring, Id es el kid que va en el header de los tokens que firma
+type SigningKey struct {
+	Id     string
+	Method jwt.SigningMethod
+	signer interface{} // llave privada, o el secret con HS256
+	public interface{} // llave pública, o el secret con HS256
+	// las llaves retiradas solo validan tokens hasta esta fecha, cero para la llave activa
+	NotAfter time.Time
+}
+
+// KeyRing firma los tokens con la llave activa y los valida con la llave que indica su kid
+type KeyRing struct {
+	active *SigningKey
+	keys   map[string]*SigningKey
+}
+
+// NewHMACKeyRing crea un key ring con una sola llave HS256, es el modo anterior con JWT_SECRET, los tokens no llevan kid y no hay llaves públicas
+func NewHMACKeyRing(secret string) *KeyRing {
+	key := &SigningKey{Method: jwt.SigningMethodHS256, signer: []byte(secret), public: []byte(secret)}
+	return &KeyRing{active: key, keys: map[string]*SigningKey{"": key}}
+}
+
+// LoadKeyRing carga las llaves privadas (RSA para RS256 o Ed25519 para EdDSA) de los archivos <kid>.pem del directorio,
+// activeId es el kid con el que se firma, si viene vacío se usa el último kid en orden alfabético (ej: 2022-10.pem después de 2022-09.pem),
+// las demás llaves validan tokens hasta la fecha que indica notAfter para su kid, o hasta que se borra su archivo si no tienen fecha
+func LoadKeyRing(dir string, activeId string, notAfter map[string]time.Time) (*KeyRing, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .pem keys in %s", dir)
+	}
+	sort.Strings(files)
+	ring := &KeyRing{keys: make(map[string]*SigningKey)}
+	for _, file := range files {
+		key, err := loadSigningKey(file)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", file, err)
+		}
+		ring.keys[key.Id] = key
+		if activeId == "" {
+			ring.active = key
+		}
+	}
+	if activeId != "" {
+		ring.active = ring.keys[activeId]
+		if ring.active == nil {
+			return nil, fmt.Errorf("signing key %q not found in %s", activeId, dir)
+		}
+	}
+	for id, date := range notAfter {
+		key, ok := ring.keys[id]
+		if !ok {
+			return nil, fmt.Errorf("not after date for unknown signing key %q", id)
+		}
+		if key == ring.active {
+			return nil, fmt.Errorf("signing key %q is active and cannot have a not after date", id)
+		}
+		key.NotAfter = date
+		if time.Now().After(date) {
+			log.Printf("jwt key %s is past its not after date, it can be removed", id)
+		}
+	}
+	return ring, nil
+}
+
+// AcceptHMAC sigue validando hasta notAfter los tokens HS256 sin kid firmados con el secret anterior,
+// así al pasar de JWT_SECRET a JWT_KEYS_DIR las sesiones abiertas no se cierran de golpe
+func (ring *KeyRing) AcceptHMAC(secret string, notAfter time.Time) error {
+	if notAfter.IsZero() {
+		return errors.New("previous secret requires a not after date")
+	}
+	if _, ok := ring.keys[""]; ok {
+		return errors.New("key ring already has a key without kid")
+	}
+	ring.keys[""] = &SigningKey{Method: jwt.SigningMethodHS256, signer: []byte(secret), public: []byte(secret), NotAfter: notAfter}
+	return nil
+}
+
+// loadSigningKey lee una llave privada en formato PEM, PKCS#1 o PKCS#8
+func loadSigningKey(file string) (*SigningKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid pem")
+	}
+	var private interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported pem type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := &SigningKey{Id: strings.TrimSuffix(filepath.Base(file), ".pem"), signer: private}
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		if private.N.BitLen() < MIN_RSA_KEY_BITS {
+			return nil, fmt.Errorf("rsa key must have at least %d bits", MIN_RSA_KEY_BITS)
+		}
+		key.Method = jwt.SigningMethodRS256
+		key.public = &private.PublicKey
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.public = private.Public()
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+	return key, nil
+}
+
+// Sign firma los claims con la llave activa y pone su kid en el header
+func (ring *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ring.active.Method, claims)
+	if ring.active.Id != "" {
+		token.Header["kid"] = ring.active.Id
+	}
+	return token.SignedString(ring.active.signer)
+}
+
+// keyFunc es la función que recibe jwt.ParseWithClaims, busca la llave por el kid del token y rechaza el token si su alg
+// no es el de esa llave, así nadie puede firmar con HS256 usando la llave pública como secret
+func (ring *KeyRing) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ring.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, ErrUnexpectedSigningMethod
+	}
+	if !key.NotAfter.IsZero() && time.Now().After(key.NotAfter) {
+		return nil, fmt.Errorf("signing key %q was retired", kid)
+	}
+	return key.public, nil
+}
+
+// JWK es una llave pública en formato JSON Web Key (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA
+	E   string `json:"e,omitempty"`   // RSA
+	Crv string `json:"crv,omitempty"` // Ed25519
+	X   string `json:"x,omitempty"`   // Ed25519
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS devuelve las llaves públicas que todavía validan tokens, con HS256 no hay llaves públicas y la lista va vacía
+func (ring *KeyRing) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	ids := make([]string, 0, len(ring.keys))
+	for id := range ring.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		key := ring.keys[id]
+		if !key.NotAfter.IsZero() && time.Now().After(key.NotAfter) {
+			continue
+		}
+		jwk := JWK{Kid: key.Id, Use: "sig", Alg: key.Method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
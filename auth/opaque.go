@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// bytes aleatorios de cada token opaco (refresh tokens, API keys y tokens para recuperar el password)
+const OPAQUE_TOKEN_BYTES = 32
+
+// newOpaqueToken genera un token aleatorio con el prefijo, devuelve el token que se entrega al cliente y el hash que se guarda en el repository
+func newOpaqueToken(prefix string) (token string, hash string, err error) {
+	data := make([]byte, OPAQUE_TOKEN_BYTES)
+	if _, err = rand.Read(data); err != nil {
+		return "", "", err
+	}
+	token = prefix + base64.RawURLEncoding.EncodeToString(data)
+	return token, HashToken(token), nil
+}
+
+// HashToken devuelve el hash con el que se busca un token opaco, en la db nunca se guarda el token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewRefreshToken genera un refresh token opaco y su hash
+func NewRefreshToken() (token string, hash string, err error) {
+	return newOpaqueToken("")
+}
+
+// NewPasswordResetToken genera el token opaco que se envía por correo para recuperar la cuenta y su hash
+func NewPasswordResetToken() (token string, hash string, err error) {
+	return newOpaqueToken("")
+}
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrPasswordMismatch = errors.New("password does not match")
+	// el hash no es del algoritmo del hasher, otro hasher lo puede verificar
+	ErrUnsupportedHash = errors.New("unsupported password hash")
+)
+
+// algoritmos con los que se pueden crear los hashes de los passwords
+const (
+	HASH_BCRYPT   = "bcrypt"
+	HASH_ARGON2ID = "argon2id"
+)
+
+// parámetros por defecto, los de argon2id son los que recomienda OWASP (19 MiB, 2 pasadas, 1 hilo)
+const (
+	DEFAULT_BCRYPT_COST    = 12
+	DEFAULT_ARGON2_TIME    = 2
+	DEFAULT_ARGON2_MEMORY  = 19 * 1024 // KiB
+	DEFAULT_ARGON2_THREADS = 1
+	ARGON2_SALT_BYTES      = 16
+	ARGON2_KEY_BYTES       = 32
+	// un hash guardado con un salt o una llave más cortos no se acepta, con una llave vacía cualquier password coincidiría
+	ARGON2_MIN_SALT_BYTES = 8
+	ARGON2_MIN_KEY_BYTES  = 16
+)
+
+// PasswordHasher crea y verifica los hashes de los passwords que se guardan en la db
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Verify devuelve ErrPasswordMismatch si el password no coincide y ErrUnsupportedHash si el hash es de otro algoritmo,
+	// needsRehash indica que el password es correcto pero el hash se creó con otros parámetros y conviene reemplazarlo
+	Verify(password string, hash string) (needsRehash bool, err error)
+}
+
+// HashConfig elige el algoritmo de los hashes nuevos ("argon2id" por defecto o "bcrypt") y sus parámetros, con cero se usan los valores por defecto
+type HashConfig struct {
+	Algorithm     string
+	BcryptCost    int
+	Argon2Time    uint32
+	Argon2Memory  uint32 // KiB
+	Argon2Threads uint8
+}
+
+// NewPasswordHasher crea el hasher de la configuración, los hashes del otro algoritmo se siguen aceptando
+// y Verify pide reemplazarlos, así se puede cambiar de algoritmo sin que los usuarios cambien su password
+func NewPasswordHasher(config HashConfig) (PasswordHasher, error) {
+	bcryptHasher := &BcryptHasher{Cost: config.BcryptCost}
+	if bcryptHasher.Cost == 0 {
+		bcryptHasher.Cost = DEFAULT_BCRYPT_COST
+	}
+	if bcryptHasher.Cost < bcrypt.MinCost || bcryptHasher.Cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	argon2Hasher := &Argon2idHasher{Time: config.Argon2Time, Memory: config.Argon2Memory, Threads: config.Argon2Threads}
+	if argon2Hasher.Time == 0 {
+		argon2Hasher.Time = DEFAULT_ARGON2_TIME
+	}
+	if argon2Hasher.Memory == 0 {
+		argon2Hasher.Memory = DEFAULT_ARGON2_MEMORY
+	}
+	if argon2Hasher.Threads == 0 {
+		argon2Hasher.Threads = DEFAULT_ARGON2_THREADS
+	}
+	switch config.Algorithm {
+	case "", HASH_ARGON2ID:
+		return &upgradingHasher{current: argon2Hasher, previous: []PasswordHasher{bcryptHasher}}, nil
+	case HASH_BCRYPT:
+		return &upgradingHasher{current: bcryptHasher, previous: []PasswordHasher{argon2Hasher}}, nil
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q, must be argon2id or bcrypt", config.Algorithm)
+	}
+}
+
+// upgradingHasher crea los hashes con el hasher actual y verifica también los de los hashers anteriores,
+// un hash de un hasher anterior siempre necesita rehash
+type upgradingHasher struct {
+	current  PasswordHasher
+	previous []PasswordHasher
+}
+
+func (h *upgradingHasher) Hash(password string) (string, error) {
+	return h.current.Hash(password)
+}
+
+func (h *upgradingHasher) Verify(password string, hash string) (bool, error) {
+	needsRehash, err := h.current.Verify(password, hash)
+	if !errors.Is(err, ErrUnsupportedHash) {
+		return needsRehash, err
+	}
+	for _, previous := range h.previous {
+		if _, err = previous.Verify(password, hash); !errors.Is(err, ErrUnsupportedHash) {
+			return err == nil, err
+		}
+	}
+	return false, ErrUnsupportedHash
+}
+
+// BcryptHasher crea hashes bcrypt con el costo indicado
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+func (h *BcryptHasher) Verify(password string, hash string) (bool, error) {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, ErrUnsupportedHash
+	}
+	if err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, ErrPasswordMismatch
+		}
+		return false, err
+	}
+	return cost != h.Cost, nil
+}
+
+// Argon2idHasher crea hashes argon2id en el formato PHC que usan las demás librerías: $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, ARGON2_SALT_BYTES)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, ARGON2_KEY_BYTES)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) Verify(password string, hash string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != HASH_ARGON2ID {
+		return false, ErrUnsupportedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, ErrUnsupportedHash
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+	// con t=0 o p=0 argon2.IDKey entra en pánico
+	if memory == 0 || time == 0 || threads == 0 {
+		return false, fmt.Errorf("invalid argon2id parameters: %s", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+	if len(salt) < ARGON2_MIN_SALT_BYTES {
+		return false, fmt.Errorf("invalid argon2id salt: %d bytes, want at least %d", len(salt), ARGON2_MIN_SALT_BYTES)
+	}
+	if len(key) < ARGON2_MIN_KEY_BYTES {
+		return false, fmt.Errorf("invalid argon2id hash: %d bytes, want at least %d", len(key), ARGON2_MIN_KEY_BYTES)
+	}
+	// se verifica con los parámetros con los que se creó el hash, no con los actuales
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, ErrPasswordMismatch
+	}
+	return memory != h.Memory || time != h.Time || threads != h.Threads || len(key) != ARGON2_KEY_BYTES, nil
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// parámetros bajos para que los tests no tarden, no se deben usar en producción
+var testHashConfig = HashConfig{BcryptCost: bcrypt.MinCost, Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 1}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	hasher := &Argon2idHasher{Time: 1, Memory: 64, Threads: 1}
+	hash, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("unexpected hash format %s", hash)
+	}
+	if needsRehash, err := hasher.Verify("correct horse", hash); err != nil || needsRehash {
+		t.Fatalf("expected a match without rehash, got %v %v", needsRehash, err)
+	}
+	if _, err := hasher.Verify("wrong horse", hash); !errors.Is(err, ErrPasswordMismatch) {
+		t.Fatalf("expected ErrPasswordMismatch, got %v", err)
+	}
+	if _, err := hasher.Verify("correct horse", "$2a$04$invalid"); !errors.Is(err, ErrUnsupportedHash) {
+		t.Fatalf("expected ErrUnsupportedHash for a bcrypt hash, got %v", err)
+	}
+}
+
+// un hash creado con otros parámetros sirve para el login pero pide rehash
+func TestArgon2idNeedsRehashAfterParameterChange(t *testing.T) {
+	hash, err := (&Argon2idHasher{Time: 1, Memory: 64, Threads: 1}).Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hasher := range []*Argon2idHasher{
+		{Time: 2, Memory: 64, Threads: 1},
+		{Time: 1, Memory: 128, Threads: 1},
+		{Time: 1, Memory: 64, Threads: 2},
+	} {
+		if needsRehash, err := hasher.Verify("correct horse", hash); err != nil || !needsRehash {
+			t.Errorf("%+v: expected a match that needs rehash, got %v %v", hasher, needsRehash, err)
+		}
+	}
+}
+
+// al cambiar de algoritmo los hashes del anterior se aceptan y piden rehash, en las dos direcciones
+func TestPasswordHasherUpgrade(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+	}{
+		{HASH_BCRYPT, HASH_ARGON2ID},
+		{HASH_ARGON2ID, HASH_BCRYPT},
+	}
+	for _, tc := range tests {
+		fromConfig, toConfig := testHashConfig, testHashConfig
+		fromConfig.Algorithm, toConfig.Algorithm = tc.from, tc.to
+		from, err := NewPasswordHasher(fromConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		to, err := NewPasswordHasher(toConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := from.Hash("correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if needsRehash, err := to.Verify("correct horse", hash); err != nil || !needsRehash {
+			t.Fatalf("%s to %s: expected a match that needs rehash, got %v %v", tc.from, tc.to, needsRehash, err)
+		}
+		if _, err := to.Verify("wrong horse", hash); !errors.Is(err, ErrPasswordMismatch) {
+			t.Fatalf("%s to %s: expected ErrPasswordMismatch, got %v", tc.from, tc.to, err)
+		}
+		rehashed, err := to.Hash("correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if needsRehash, err := to.Verify("correct horse", rehashed); err != nil || needsRehash {
+			t.Fatalf("%s to %s: expected the new hash to match without rehash, got %v %v", tc.from, tc.to, needsRehash, err)
+		}
+	}
+}
+
+// los hashes con parámetros inválidos o sin llave dan error, no pánico ni un password que coincide
+func TestArgon2idRejectsInvalidHashes(t *testing.T) {
+	hasher := &Argon2idHasher{Time: 1, Memory: 64, Threads: 1}
+	const salt = "c29tZXNhbHRzb21lc2FsdA"                     // 16 bytes
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U" // 32 bytes
+	tests := map[string]string{
+		"empty key":  "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$",
+		"short key":  "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$a2V5",
+		"empty salt": "$argon2id$v=19$m=64,t=1,p=1$$" + key,
+		"short salt": "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$" + key,
+		"zero time":  "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key,
+		"zero p":     "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key,
+		"zero m":     "$argon2id$v=19$m=0,t=1,p=1$" + salt + "$" + key,
+	}
+	for name, hash := range tests {
+		needsRehash, err := hasher.Verify("any password", hash)
+		if err == nil || errors.Is(err, ErrPasswordMismatch) || errors.Is(err, ErrUnsupportedHash) || needsRehash {
+			t.Errorf("%s: expected an invalid hash error, got %v %v", name, needsRehash, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DEFAULT_PASSWORD_MIN_LENGTH = 8
+	// bcrypt solo usa los primeros 72 bytes, con passwords más largos dos passwords distintos tendrían el mismo hash
+	PASSWORD_MAX_BYTES = 72
+)
+
+var ErrWeakPassword = errors.New("weak password")
+
+// passwords que aparecen primero en las listas de passwords filtrados, se comparan sin importar mayúsculas
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "passw0rd": true, "12345678": true, "123456789": true,
+	"1234567890": true, "11111111": true, "00000000": true, "87654321": true, "qwertyui": true, "qwerty123": true,
+	"qwertyuiop": true, "asdfghjkl": true, "iloveyou": true, "sunshine": true, "princess": true, "football": true,
+	"baseball": true, "superman": true, "whatever": true, "trustno1": true, "letmein1": true, "welcome1": true,
+	"abc12345": true, "abcd1234": true, "admin123": true, "changeme": true, "computer": true, "starwars": true,
+}
+
+// PasswordPolicy son las reglas que debe cumplir un password nuevo, siguiendo NIST 800-63B: se pide largo mínimo y se rechazan
+// los passwords comunes o que contienen el email, pero no se exigen mayúsculas, números o símbolos
+type PasswordPolicy struct {
+	MinLength int
+}
+
+// Validate devuelve un error que envuelve ErrWeakPassword y explica qué regla no cumple el password
+func (p PasswordPolicy) Validate(password string, email string) error {
+	minLength := p.MinLength
+	if minLength <= 0 {
+		minLength = DEFAULT_PASSWORD_MIN_LENGTH
+	}
+	if utf8.RuneCountInString(password) < minLength {
+		return fmt.Errorf("%w: must have at least %d characters", ErrWeakPassword, minLength)
+	}
+	if len(password) > PASSWORD_MAX_BYTES {
+		return fmt.Errorf("%w: must have at most %d bytes", ErrWeakPassword, PASSWORD_MAX_BYTES)
+	}
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return fmt.Errorf("%w: too common", ErrWeakPassword)
+	}
+	if strings.Count(lower, lower[:1]) == len(lower) {
+		return fmt.Errorf("%w: must not repeat a single character", ErrWeakPassword)
+	}
+	if local, _, _ := strings.Cut(strings.ToLower(email), "@"); len(local) >= 3 && strings.Contains(lower, local) {
+		return fmt.Errorf("%w: must not contain the email", ErrWeakPassword)
+	}
+	return nil
+}
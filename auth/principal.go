@@ -0,0 +1,60 @@
+// Package auth tiene la identidad del usuario autenticado (Principal) y la forma de obtenerla a partir de un token,
+// el middleware y el websocket usan el mismo Authenticator, así el mecanismo de autenticación se cambia en un solo lugar
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// Principal es el usuario autenticado en la petición
+type Principal struct {
+	UserId    string
+	Roles     []string
+	TokenId   string    // jti del token con el que se autenticó
+	IssuedAt  time.Time // cuándo se creó el token, sirve para cerrar todas las sesiones del usuario
+	ExpiresAt time.Time // cero si el token no vence
+	SessionId string    // sesión de la que salió el token, vacío con las API keys
+	// si se autenticó con una API key, su id y sus scopes, los tokens de sesión tienen todos los scopes
+	APIKeyId string
+	Scopes   []string
+}
+
+// HasScope indica si el principal puede hacer lo que permite el scope
+func (p *Principal) HasScope(scope string) bool {
+	if p.APIKeyId == "" {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAnyRole indica si el principal tiene alguno de los roles
+func (p *Principal) HasAnyRole(roles ...string) bool {
+	for _, have := range p.Roles {
+		for _, role := range roles {
+			if have == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tipo propio para la llave del contexto, así ningún otro paquete puede pisar el valor
+type principalKey struct{}
+
+// WithPrincipal devuelve un contexto que lleva el principal
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom devuelve el principal que puso el middleware en el contexto de la petición
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok && principal != nil
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/repository"
+)
+
+// tiempo que se guarda en memoria la respuesta de la db, con varias instancias un logout hecho en otra instancia se nota a más tardar en este tiempo
+const REVOCATION_CACHE_TTL = 30 * time.Second
+
+var ErrTokenRevoked = errors.New("token revoked")
+
+// RevocationStore guarda los tokens que se invalidaron antes de vencer
+type RevocationStore interface {
+	// RevokeToken invalida solo el token con el que se autenticó el principal (logout)
+	RevokeToken(ctx context.Context, principal *Principal) error
+	// RevokeUser invalida todos los tokens del usuario creados hasta ahora (cerrar todas las sesiones)
+	RevokeUser(ctx context.Context, userId string) error
+	// RevokeSession invalida los tokens de una sesión, until es cuándo vence el último token que pudo salir de ella
+	RevokeSession(ctx context.Context, userId string, sessionId string, until time.Time) error
+	IsRevoked(ctx context.Context, principal *Principal) (bool, error)
+}
+
+// CachedRevocationStore guarda las revocaciones en el repository y mantiene en memoria las consultas,
+// así cada petición autenticada no tiene que ir a la db
+type CachedRevocationStore struct {
+	ttl       time.Duration
+	mutex     sync.Mutex
+	tokens    map[string]cachedToken // por jti o id de sesión
+	users     map[string]cachedUser  // por id de usuario
+	lastPrune time.Time
+}
+
+type cachedToken struct {
+	revoked   bool
+	expiresAt time.Time
+	checkedAt time.Time
+}
+
+type cachedUser struct {
+	revokedBefore time.Time // cero si el usuario nunca cerró todas sus sesiones
+	checkedAt     time.Time
+}
+
+func NewCachedRevocationStore(ttl time.Duration) *CachedRevocationStore {
+	if ttl <= 0 {
+		ttl = REVOCATION_CACHE_TTL
+	}
+	return &CachedRevocationStore{
+		ttl:    ttl,
+		tokens: make(map[string]cachedToken),
+		users:  make(map[string]cachedUser),
+	}
+}
+
+func (store *CachedRevocationStore) RevokeToken(ctx context.Context, principal *Principal) error {
+	if principal.TokenId == "" {
+		return errors.New("token has no id")
+	}
+	err := repository.RevokeToken(ctx, &models.RevokedToken{
+		Id:        principal.TokenId,
+		UserId:    principal.UserId,
+		ExpiresAt: principal.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	// un token revocado no vuelve a ser válido, se guarda hasta que vence sin volver a consultar la db
+	store.tokens[principal.TokenId] = cachedToken{revoked: true, expiresAt: principal.ExpiresAt, checkedAt: time.Now()}
+	return nil
+}
+
+func (store *CachedRevocationStore) RevokeUser(ctx context.Context, userId string) error {
+	// los access tokens tienen la fecha de creación en microsegundos (la precisión de postgres), así un login justo después sigue valiendo,
+	// los tokens sin iat_us tienen el segundo truncado y quedan antes de before
+	before := time.Now().Truncate(time.Microsecond)
+	if err := repository.RevokeUserTokens(ctx, userId, before); err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.users[userId] = cachedUser{revokedBefore: before, checkedAt: time.Now()}
+	return nil
+}
+
+// RevokeSession guarda el id de la sesión junto a los jti revocados, los dos son ksuid y no se pueden confundir
+func (store *CachedRevocationStore) RevokeSession(ctx context.Context, userId string, sessionId string, until time.Time) error {
+	err := repository.RevokeToken(ctx, &models.RevokedToken{
+		Id:        sessionId,
+		UserId:    userId,
+		ExpiresAt: until,
+	})
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.tokens[sessionId] = cachedToken{revoked: true, expiresAt: until, checkedAt: time.Now()}
+	return nil
+}
+
+// IsRevoked indica si el token fue revocado con un logout, si se revocó su sesión o si el usuario cerró todas sus sesiones después de crearlo
+func (store *CachedRevocationStore) IsRevoked(ctx context.Context, principal *Principal) (bool, error) {
+	revokedBefore, err := store.userRevokedBefore(ctx, principal.UserId)
+	if err != nil {
+		return false, err
+	}
+	if !revokedBefore.IsZero() && !principal.IssuedAt.After(revokedBefore) {
+		return true, nil
+	}
+	for _, id := range []string{principal.TokenId, principal.SessionId} {
+		if id == "" {
+			continue
+		}
+		revoked, err := store.idRevoked(ctx, id, principal.ExpiresAt)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+	return false, nil
+}
+
+// idRevoked consulta si el jti o la sesión está revocada, expiresAt es hasta cuándo sirve guardar la respuesta
+func (store *CachedRevocationStore) idRevoked(ctx context.Context, id string, expiresAt time.Time) (bool, error) {
+	now := time.Now()
+	store.mutex.Lock()
+	cached, ok := store.tokens[id]
+	store.mutex.Unlock()
+	if ok && (cached.revoked || now.Sub(cached.checkedAt) < store.ttl) {
+		return cached.revoked, nil
+	}
+	revoked, err := repository.IsTokenRevoked(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.pruneLocked(now)
+	store.tokens[id] = cachedToken{revoked: revoked, expiresAt: expiresAt, checkedAt: now}
+	return revoked, nil
+}
+
+func (store *CachedRevocationStore) userRevokedBefore(ctx context.Context, userId string) (time.Time, error) {
+	now := time.Now()
+	store.mutex.Lock()
+	cached, ok := store.users[userId]
+	store.mutex.Unlock()
+	if ok && now.Sub(cached.checkedAt) < store.ttl {
+		return cached.revokedBefore, nil
+	}
+	revokedBefore, err := repository.GetUserTokensRevokedBefore(ctx, userId)
+	if err != nil {
+		return time.Time{}, err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.pruneLocked(now)
+	store.users[userId] = cachedUser{revokedBefore: revokedBefore, checkedAt: now}
+	return revokedBefore, nil
+}
+
+// pruneLocked quita de memoria los tokens vencidos y las consultas viejas, como mucho una vez cada ttl, debe llamarse con el mutex bloqueado
+func (store *CachedRevocationStore) pruneLocked(now time.Time) {
+	if now.Sub(store.lastPrune) < store.ttl {
+		return
+	}
+	store.lastPrune = now
+	for id, cached := range store.tokens {
+		expired := !cached.expiresAt.IsZero() && now.After(cached.expiresAt)
+		if expired || (!cached.revoked && now.Sub(cached.checkedAt) >= store.ttl) {
+			delete(store.tokens, id)
+		}
+	}
+	for id, cached := range store.users {
+		if now.Sub(cached.checkedAt) >= store.ttl {
+			delete(store.users, id)
+		}
+	}
+}
+
+// revokingAuthenticator rechaza los tokens revocados aunque su firma y vencimiento sean válidos
+type revokingAuthenticator struct {
+	Authenticator
+	store RevocationStore
+}
+
+// WithRevocation envuelve el authenticator para que además consulte el store, lo usan el middleware y el websocket
+func WithRevocation(authenticator Authenticator, store RevocationStore) Authenticator {
+	return &revokingAuthenticator{Authenticator: authenticator, store: store}
+}
+
+func (a *revokingAuthenticator) AuthenticateToken(ctx context.Context, tokenString string) (*Principal, error) {
+	principal, err := a.Authenticator.AuthenticateToken(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := a.store.IsRevoked(ctx, principal)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return principal, nil
+}
@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/repository"
+)
+
+// los fallos de login se olvidan cuando pasa este tiempo sin fallos nuevos
+const LOGIN_ATTEMPTS_WINDOW = time.Hour
+
+// largo máximo de las llaves de los contadores (la columna key de login_attempts), las más largas se guardan con su hash
+const ATTEMPT_KEY_MAX = 320
+
+// ThrottlePolicy define cuántos fallos se permiten antes de hacer esperar al cliente:
+// después de FreeAttempts fallos la espera empieza en BaseDelay y se duplica con cada fallo,
+// al llegar a LockoutAttempts se bloquea durante LockoutDuration, que también es la espera máxima
+type ThrottlePolicy struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	LockoutAttempts int
+	LockoutDuration time.Duration
+}
+
+var (
+	// por cuenta, una persona que se equivoca algunas veces no llega a esperar
+	DEFAULT_ACCOUNT_POLICY = ThrottlePolicy{FreeAttempts: 5, BaseDelay: time.Second, LockoutAttempts: 10, LockoutDuration: 15 * time.Minute}
+	// por ip se permiten más fallos, detrás de una misma ip (NAT, oficina) puede haber muchos usuarios
+	DEFAULT_IP_POLICY = ThrottlePolicy{FreeAttempts: 20, BaseDelay: time.Second, LockoutAttempts: 100, LockoutDuration: 15 * time.Minute}
+	// para recuperar el password cada pedido cuenta como un intento, nadie necesita muchos correos seguidos
+	DEFAULT_PASSWORD_RESET_ACCOUNT_POLICY = ThrottlePolicy{FreeAttempts: 3, BaseDelay: time.Minute, LockoutAttempts: 10, LockoutDuration: time.Hour}
+	DEFAULT_PASSWORD_RESET_IP_POLICY      = ThrottlePolicy{FreeAttempts: 20, BaseDelay: time.Second, LockoutAttempts: 100, LockoutDuration: time.Hour}
+)
+
+// delay devuelve cuánto hay que esperar después del último fallo cuando se acumularon failures fallos
+func (p ThrottlePolicy) delay(failures int) time.Duration {
+	if failures >= p.LockoutAttempts {
+		return p.LockoutDuration
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && delay < p.LockoutDuration; i++ {
+		delay *= 2
+	}
+	if delay > p.LockoutDuration {
+		return p.LockoutDuration
+	}
+	return delay
+}
+
+// AttemptStore guarda los contadores de fallos de login por llave (cuenta o ip)
+type AttemptStore interface {
+	// RecordFailure suma un fallo a la llave, si el último fallo es anterior a resetBefore el contador empieza de cero
+	RecordFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (*models.LoginAttempt, error)
+	// GetAttempt devuelve nil si la llave no tiene fallos
+	GetAttempt(ctx context.Context, key string) (*models.LoginAttempt, error)
+	ResetAttempts(ctx context.Context, key string) error
+}
+
+// LoginThrottle limita los intentos de login por cuenta y por ip, con varias instancias del servidor se usa el RepositoryAttemptStore
+// para que compartan los contadores; prefix separa los contadores de cada throttle que comparte el store
+type LoginThrottle struct {
+	store   AttemptStore
+	account ThrottlePolicy
+	ip      ThrottlePolicy
+	prefix  string
+}
+
+func NewLoginThrottle(store AttemptStore) *LoginThrottle {
+	return &LoginThrottle{store: store, account: DEFAULT_ACCOUNT_POLICY, ip: DEFAULT_IP_POLICY}
+}
+
+// NewPasswordResetThrottle limita los correos para recuperar el password por email y por ip, cada pedido se registra con Failure,
+// sus contadores no afectan a los del login
+func NewPasswordResetThrottle(store AttemptStore) *LoginThrottle {
+	return &LoginThrottle{store: store, account: DEFAULT_PASSWORD_RESET_ACCOUNT_POLICY, ip: DEFAULT_PASSWORD_RESET_IP_POLICY, prefix: "password-reset:"}
+}
+
+// las cuentas se cuentan por el email que se envía, exista o no, así la respuesta es la misma en los dos casos
+func (t *LoginThrottle) accountKey(email string) string {
+	return attemptKey(t.prefix + "account:" + strings.ToLower(strings.TrimSpace(email)))
+}
+
+func (t *LoginThrottle) ipKey(ip string) string {
+	return attemptKey(t.prefix + "ip:" + ip)
+}
+
+// attemptKey acorta las llaves que no caben en ATTEMPT_KEY_MAX, el email lo manda el cliente y puede ser tan largo como quiera
+func attemptKey(key string) string {
+	if len(key) <= ATTEMPT_KEY_MAX {
+		return key
+	}
+	return "sha256:" + HashToken(key)
+}
+
+// Check devuelve cuánto tiene que esperar el cliente antes de volver a intentar, cero si puede intentar ahora
+func (t *LoginThrottle) Check(ctx context.Context, email string, ip string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for key, policy := range map[string]ThrottlePolicy{t.accountKey(email): t.account, t.ipKey(ip): t.ip} {
+		attempt, err := t.store.GetAttempt(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if remaining := remainingWait(attempt, policy, now); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait, nil
+}
+
+// Failure registra un intento fallido para la cuenta y la ip y devuelve cuánto hay que esperar para el siguiente intento
+func (t *LoginThrottle) Failure(ctx context.Context, email string, ip string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for key, policy := range map[string]ThrottlePolicy{t.accountKey(email): t.account, t.ipKey(ip): t.ip} {
+		attempt, err := t.store.RecordFailure(ctx, key, now, now.Add(-LOGIN_ATTEMPTS_WINDOW))
+		if err != nil {
+			return 0, err
+		}
+		if remaining := remainingWait(attempt, policy, now); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait, nil
+}
+
+// Success borra los fallos de la cuenta después de un login correcto, los de la ip se mantienen
+// para que no se puedan borrar haciendo login con una cuenta propia
+func (t *LoginThrottle) Success(ctx context.Context, email string) error {
+	return t.store.ResetAttempts(ctx, t.accountKey(email))
+}
+
+func remainingWait(attempt *models.LoginAttempt, policy ThrottlePolicy, now time.Time) time.Duration {
+	if attempt == nil || now.Sub(attempt.LastFailureAt) > LOGIN_ATTEMPTS_WINDOW {
+		return 0
+	}
+	remaining := attempt.LastFailureAt.Add(policy.delay(attempt.Failures)).Sub(now)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// MemoryAttemptStore guarda los contadores en memoria, sirve con una sola instancia del servidor
+type MemoryAttemptStore struct {
+	mutex    sync.Mutex
+	attempts map[string]models.LoginAttempt
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: make(map[string]models.LoginAttempt)}
+}
+
+func (store *MemoryAttemptStore) RecordFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (*models.LoginAttempt, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	// se aprovecha para quitar las llaves que ya no tienen fallos recientes
+	for k, attempt := range store.attempts {
+		if attempt.LastFailureAt.Before(resetBefore) {
+			delete(store.attempts, k)
+		}
+	}
+	attempt := store.attempts[key]
+	attempt.Key = key
+	attempt.Failures++
+	attempt.LastFailureAt = at
+	store.attempts[key] = attempt
+	return &attempt, nil
+}
+
+func (store *MemoryAttemptStore) GetAttempt(ctx context.Context, key string) (*models.LoginAttempt, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	attempt, ok := store.attempts[key]
+	if !ok {
+		return nil, nil
+	}
+	return &attempt, nil
+}
+
+func (store *MemoryAttemptStore) ResetAttempts(ctx context.Context, key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.attempts, key)
+	return nil
+}
+
+// RepositoryAttemptStore guarda los contadores en el repository, así todas las instancias del servidor los comparten
+type RepositoryAttemptStore struct{}
+
+func (RepositoryAttemptStore) RecordFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (*models.LoginAttempt, error) {
+	return repository.RecordLoginFailure(ctx, key, at, resetBefore)
+}
+
+func (RepositoryAttemptStore) GetAttempt(ctx context.Context, key string) (*models.LoginAttempt, error) {
+	attempt, err := repository.GetLoginAttempt(ctx, key)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil
+	}
+	return attempt, err
+}
+
+func (RepositoryAttemptStore) ResetAttempts(ctx context.Context, key string) error {
+	return repository.DeleteLoginAttempt(ctx, key)
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"platzi.com/go/rest-ws/models"
+)
+
+// keyStore guarda las llaves con las que se llamó al store
+type keyStore struct {
+	*MemoryAttemptStore
+	keys []string
+}
+
+func (store *keyStore) RecordFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (*models.LoginAttempt, error) {
+	store.keys = append(store.keys, key)
+	return store.MemoryAttemptStore.RecordFailure(ctx, key, at, resetBefore)
+}
+
+// las llaves caben en la columna key de login_attempts aunque el cliente mande un email enorme, y dos emails largos no comparten contador
+func TestAttemptKeysFitTheColumn(t *testing.T) {
+	store := &keyStore{MemoryAttemptStore: NewMemoryAttemptStore()}
+	throttles := []*LoginThrottle{NewLoginThrottle(store), NewPasswordResetThrottle(store)}
+	emails := []string{"user@example.com", strings.Repeat("a", 1000) + "@example.com", strings.Repeat("b", 1000) + "@example.com"}
+	for _, throttle := range throttles {
+		for _, email := range emails {
+			if _, err := throttle.Failure(context.Background(), email, "192.0.2.1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, key := range store.keys {
+		if len(key) > ATTEMPT_KEY_MAX {
+			t.Errorf("key of %d bytes, want at most %d", len(key), ATTEMPT_KEY_MAX)
+		}
+		if !strings.HasPrefix(key, "ip:") && !strings.HasPrefix(key, "password-reset:ip:") {
+			if seen[key] {
+				t.Errorf("key %s used for two accounts", key)
+			}
+			seen[key] = true
+		}
+	}
+	if len(seen) != len(throttles)*len(emails) {
+		t.Errorf("got %d account keys, want %d", len(seen), len(throttles)*len(emails))
+	}
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// parámetros de los códigos TOTP (RFC 6238), son los que usan por defecto las apps de autenticación
+const (
+	TOTP_PERIOD       = 30 // segundos que dura cada código
+	TOTP_DIGITS       = 6
+	TOTP_SECRET_BYTES = 20
+	// códigos anteriores y siguientes que también se aceptan, por si el reloj del teléfono está un poco desfasado
+	TOTP_SKEW = 1
+	// cantidad de códigos de recuperación que se entregan al activar el TOTP
+	RECOVERY_CODES = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret genera el secret que comparten el servidor y la app de autenticación, en base32 como lo esperan las apps
+func NewTOTPSecret() (string, error) {
+	data := make([]byte, TOTP_SECRET_BYTES)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(data), nil
+}
+
+// TOTPURI arma la uri otpauth:// que se muestra como QR para agregar la cuenta en la app de autenticación
+func TOTPURI(issuer string, account string, secret string) string {
+	// los espacios van como %20 y no como +, algunas apps no entienden el +
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return fmt.Sprintf("otpauth://totp/%s?secret=%s&issuer=%s&algorithm=SHA1&digits=%d&period=%d",
+		label, secret, url.PathEscape(issuer), TOTP_DIGITS, TOTP_PERIOD)
+}
+
+// TOTPCode calcula el código del secret en el instante t
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	return totpCode(key, totpStep(t)), nil
+}
+
+// ValidateTOTP indica si el código es válido en el instante t y devuelve el paso de tiempo al que corresponde,
+// quien lo valida debe guardar el paso para que el mismo código no se pueda usar dos veces
+func ValidateTOTP(secret string, code string, t time.Time) (step int64, ok bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+	current := totpStep(t)
+	for skew := int64(-TOTP_SKEW); skew <= TOTP_SKEW; skew++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, current+skew)), []byte(code)) == 1 {
+			return current + skew, true
+		}
+	}
+	return 0, false
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / TOTP_PERIOD
+}
+
+// totpCode es el HOTP (RFC 4226) del contador con HMAC-SHA1 y truncamiento dinámico
+func totpCode(key []byte, counter int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulo)
+}
+
+// NewRecoveryCodes genera los códigos de recuperación (ej: abcde-fghij) que sirven una vez cada uno si se pierde la app,
+// devuelve los códigos que se muestran al usuario y los hashes que se guardan en el repository
+func NewRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < RECOVERY_CODES; i++ {
+		data := make([]byte, 7)
+		if _, err = rand.Read(data); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(data))[:10]
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode devuelve el hash del código sin importar mayúsculas, espacios o el guion
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(strings.ReplaceAll(code, "-", ""), " ", "")
+	return HashToken(code)
+}
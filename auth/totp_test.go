@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// vectores del apéndice B de RFC 6238 para SHA1, con 6 dígitos quedan los últimos 6 de cada código
+func TestTOTPCodeRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := totpEncoding.EncodeToString(key)
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tc := range tests {
+		at := time.Unix(tc.unix, 0)
+		if code := totpCode(key, totpStep(at)); code != tc.code {
+			t.Errorf("totpCode at %d: expected %s, got %s", tc.unix, tc.code, code)
+		}
+		if step, ok := ValidateTOTP(secret, tc.code, at); !ok || step != totpStep(at) {
+			t.Errorf("ValidateTOTP at %d: expected step %d, got %d %v", tc.unix, totpStep(at), step, ok)
+		}
+	}
+}
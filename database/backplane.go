@@ -0,0 +1,111 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// canal de postgres en el que se publican los eventos del hub
+	HUB_CHANNEL = "hub_events"
+	// postgres no acepta payloads de NOTIFY de 8000 bytes o más
+	MAX_NOTIFY_PAYLOAD = 7999
+	// los eventos más grandes se guardan en hub_events y el NOTIFY lleva "ref:<id>", los eventos siempre son json así que no se confunden
+	HUB_EVENT_REF_PREFIX = "ref:"
+	// tiempo que se guardan los eventos grandes, alcanza para que todas las instancias los lean
+	HUB_EVENT_TTL = 5 * time.Minute
+)
+
+// PostgresBackplane implementa el backplane del hub con LISTEN/NOTIFY, todas las instancias que se conecten a la misma db reciben los eventos
+type PostgresBackplane struct {
+	db       *sql.DB
+	listener *pq.Listener
+}
+
+// NewPostgresBackplane recibe la misma url de la db que usa el repository
+func NewPostgresBackplane(url string) (*PostgresBackplane, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	// el listener usa su propia conexión y se reconecta solo si se pierde
+	listener := pq.NewListener(url, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("backplane listener:", err)
+		}
+	})
+	return &PostgresBackplane{db: db, listener: listener}, nil
+}
+
+// Publish envía el payload en el NOTIFY, si no cabe lo guarda en hub_events y envía solo su id
+func (b *PostgresBackplane) Publish(ctx context.Context, payload []byte) error {
+	notification := string(payload)
+	if len(payload) > MAX_NOTIFY_PAYLOAD {
+		now := time.Now().UTC()
+		// se aprovecha para borrar los eventos grandes que ya leyeron todas las instancias
+		if _, err := b.db.ExecContext(ctx, "DELETE FROM hub_events WHERE created_at < $1", now.Add(-HUB_EVENT_TTL)); err != nil {
+			return err
+		}
+		var id int64
+		err := b.db.QueryRowContext(ctx, "INSERT INTO hub_events (payload, created_at) VALUES ($1, $2) RETURNING id", notification, now).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("backplane store event: %w", err)
+		}
+		notification = HUB_EVENT_REF_PREFIX + strconv.FormatInt(id, 10)
+	}
+	_, err := b.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", HUB_CHANNEL, notification)
+	return err
+}
+
+// load devuelve el payload de la notificación, si es una referencia lo lee de hub_events
+func (b *PostgresBackplane) load(notification string) ([]byte, error) {
+	if !strings.HasPrefix(notification, HUB_EVENT_REF_PREFIX) {
+		return []byte(notification), nil
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(notification, HUB_EVENT_REF_PREFIX), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	var payload string
+	if err = b.db.QueryRow("SELECT payload FROM hub_events WHERE id = $1", id).Scan(&payload); err != nil {
+		return nil, err
+	}
+	return []byte(payload), nil
+}
+
+// Subscribe empieza a escuchar el canal en otro goroutine, Listen se bloquea hasta que haya conexión con la db
+func (b *PostgresBackplane) Subscribe(handler func(payload []byte)) error {
+	go func() {
+		if err := b.listener.Listen(HUB_CHANNEL); err != nil {
+			log.Println("backplane listen:", err)
+			return
+		}
+		for notification := range b.listener.Notify {
+			// después de una reconexión llega una notificación nula, los eventos de mientras se pierden
+			if notification == nil {
+				continue
+			}
+			payload, err := b.load(notification.Extra)
+			if err != nil {
+				log.Println("backplane event:", notification.Extra, err)
+				continue
+			}
+			handler(payload)
+		}
+	}()
+	return nil
+}
+
+func (b *PostgresBackplane) Close() error {
+	if err := b.listener.Close(); err != nil {
+		return err
+	}
+	return b.db.Close()
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postgresURL devuelve DATABASE_URL con las migraciones aplicadas, sin una db de postgres el test se salta
+func postgresURL(t *testing.T) string {
+	t.Helper()
+	url := os.Getenv("DATABASE_URL")
+	if !strings.HasPrefix(url, "postgres") {
+		t.Skip("DATABASE_URL is not a postgres url")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return url
+}
+
+func TestPostgresBackplane(t *testing.T) {
+	url := postgresURL(t)
+	// cada backplane es una instancia distinta del servidor
+	var backplanes []*PostgresBackplane
+	var received []chan string
+	for i := 0; i < 2; i++ {
+		backplane, err := NewPostgresBackplane(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer backplane.Close()
+		events := make(chan string, 64)
+		backplane.Subscribe(func(payload []byte) {
+			events <- string(payload)
+		})
+		backplanes = append(backplanes, backplane)
+		received = append(received, events)
+	}
+	// Subscribe escucha en otro goroutine, se publica hasta que cada instancia reciba algo
+	deadline := time.Now().Add(5 * time.Second)
+	for _, events := range received {
+		for ready := false; !ready; {
+			if time.Now().After(deadline) {
+				t.Fatal("listeners not ready")
+			}
+			backplanes[0].Publish(context.Background(), []byte(`{"ping":true}`))
+			select {
+			case <-events:
+				ready = true
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+
+	// un evento más grande que el límite de NOTIFY llega completo a las dos instancias
+	large := `{"payload":"` + strings.Repeat("x", MAX_NOTIFY_PAYLOAD*2) + `"}`
+	if err := backplanes[0].Publish(context.Background(), []byte(large)); err != nil {
+		t.Fatal(err)
+	}
+	for _, events := range received {
+		for found := false; !found; {
+			select {
+			case payload := <-events:
+				found = payload == large
+			case <-time.After(5 * time.Second):
+				t.Fatal("large event not received")
+			}
+		}
+	}
+}
@@ -0,0 +1,807 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/repository"
+)
+
+// url con la que se elige el repositorio en memoria en lugar de postgres, ej: DATABASE_URL=memory://
+const MEMORY_URL_SCHEME = "memory://"
+
+// MemoryRepository implementa el repository guardando todo en memoria, sirve para los tests y para desarrollar sin postgres,
+// se comporta igual que PostgresRepository: email único, posts ordenados y solo el dueño puede editar o eliminar su post
+type MemoryRepository struct {
+	mutex         sync.RWMutex
+	users         map[string]models.User               // por id
+	userIds       []string                             // en orden de creación, igual que ORDER BY created_at
+	posts         map[string]models.Post               // por id
+	refreshTokens map[string]models.RefreshToken       // por id
+	revokedTokens map[string]models.RevokedToken       // por jti
+	revokedBefore map[string]time.Time                 // por id de usuario
+	apiKeys       map[string]models.APIKey             // por id
+	resetTokens   map[string]models.PasswordResetToken // por id
+	totp          map[string]models.TOTP               // por id de usuario
+	recoveryCodes map[string]map[string]bool           // por id de usuario y hash del código, true si ya se usó
+	loginAttempts map[string]models.LoginAttempt       // por llave
+	sessions      map[string]models.Session            // por id
+	identities    map[string]models.ExternalIdentity   // por proveedor y subject
+	oidcStates    map[string]models.OIDCLoginState     // por hash del state
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		users:         make(map[string]models.User),
+		posts:         make(map[string]models.Post),
+		refreshTokens: make(map[string]models.RefreshToken),
+		revokedTokens: make(map[string]models.RevokedToken),
+		revokedBefore: make(map[string]time.Time),
+		apiKeys:       make(map[string]models.APIKey),
+		resetTokens:   make(map[string]models.PasswordResetToken),
+		totp:          make(map[string]models.TOTP),
+		recoveryCodes: make(map[string]map[string]bool),
+		loginAttempts: make(map[string]models.LoginAttempt),
+		sessions:      make(map[string]models.Session),
+		identities:    make(map[string]models.ExternalIdentity),
+		oidcStates:    make(map[string]models.OIDCLoginState),
+	}
+}
+
+func (repo *MemoryRepository) InsertUser(ctx context.Context, user *models.User) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if _, ok := repo.users[user.Id]; ok {
+		return fmt.Errorf("user already exists: %w", repository.ErrConflict)
+	}
+	// igual que la restricción UNIQUE de la columna email
+	for _, u := range repo.users {
+		if u.Email == user.Email {
+			return fmt.Errorf("email already registered: %w", repository.ErrConflict)
+		}
+	}
+	stored := *user
+	stored.Roles = append([]string(nil), userRoles(user)...)
+	repo.users[user.Id] = stored
+	repo.userIds = append(repo.userIds, user.Id)
+	return nil
+}
+
+// GetUserByID igual que en postgres no devuelve el password
+func (repo *MemoryRepository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	user, ok := repo.users[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	user.Password = ""
+	user.Roles = append([]string(nil), user.Roles...)
+	return &user, nil
+}
+
+func (repo *MemoryRepository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	for _, user := range repo.users {
+		if user.Email == email {
+			user.Roles = append([]string(nil), user.Roles...)
+			return &user, nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (repo *MemoryRepository) InsertPost(ctx context.Context, post *models.Post) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if _, ok := repo.posts[post.Id]; ok {
+		return fmt.Errorf("post already exists: %w", repository.ErrConflict)
+	}
+	// igual que la llave foránea de posts.user_id
+	if _, ok := repo.users[post.UserId]; !ok {
+		return errors.New("user does not exist")
+	}
+	stored := *post
+	stored.CreatedAt = time.Now() // igual que DEFAULT NOW()
+	repo.posts[post.Id] = stored
+	return nil
+}
+
+func (repo *MemoryRepository) GetPostByID(ctx context.Context, id string) (*models.Post, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	post, ok := repo.posts[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	return &post, nil
+}
+
+func (repo *MemoryRepository) DeletePost(ctx context.Context, id string, userId string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if _, err := repo.ownedPost(id, userId); err != nil {
+		return err
+	}
+	delete(repo.posts, id)
+	return nil
+}
+
+func (repo *MemoryRepository) UpdatePost(ctx context.Context, post *models.Post, userId string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, err := repo.ownedPost(post.Id, userId)
+	if err != nil {
+		return err
+	}
+	stored.PostContent = post.PostContent
+	repo.posts[post.Id] = stored
+	*post = stored
+	return nil
+}
+
+// ownedPost devuelve el post si es del usuario, ErrNotFound si no existe o ErrForbidden si es de otro usuario, debe llamarse con el mutex bloqueado
+func (repo *MemoryRepository) ownedPost(id string, userId string) (models.Post, error) {
+	post, ok := repo.posts[id]
+	if !ok {
+		return post, repository.ErrNotFound
+	}
+	if post.UserId != userId {
+		return post, repository.ErrForbidden
+	}
+	return post, nil
+}
+
+// ListPost devuelve las páginas en el mismo orden que postgres: por fecha de creación y luego por id
+func (repo *MemoryRepository) ListPost(ctx context.Context, page uint64) ([]*models.Post, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	posts := make([]*models.Post, 0, len(repo.posts))
+	for _, post := range repo.posts {
+		post := post
+		posts = append(posts, &post)
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if !posts[i].CreatedAt.Equal(posts[j].CreatedAt) {
+			return posts[i].CreatedAt.Before(posts[j].CreatedAt)
+		}
+		return posts[i].Id < posts[j].Id
+	})
+	start := page * POSTS_PER_PAGE
+	if start >= uint64(len(posts)) {
+		return nil, nil
+	}
+	end := start + POSTS_PER_PAGE
+	if end > uint64(len(posts)) {
+		end = uint64(len(posts))
+	}
+	return posts[start:end], nil
+}
+
+func (repo *MemoryRepository) InsertRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for _, t := range repo.refreshTokens {
+		if t.Id == token.Id || t.TokenHash == token.TokenHash {
+			return fmt.Errorf("refresh token already exists: %w", repository.ErrConflict)
+		}
+	}
+	if _, ok := repo.users[token.UserId]; !ok {
+		return errors.New("user does not exist")
+	}
+	stored := *token
+	stored.CreatedAt = time.Now()
+	stored.UsedAt = nil
+	stored.RevokedAt = nil
+	repo.refreshTokens[token.Id] = stored
+	return nil
+}
+
+func (repo *MemoryRepository) GetRefreshTokenByHash(ctx context.Context, hash string) (*models.RefreshToken, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	for _, token := range repo.refreshTokens {
+		if token.TokenHash == hash {
+			return &token, nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (repo *MemoryRepository) UseRefreshToken(ctx context.Context, id string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	token, ok := repo.refreshTokens[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	if token.UsedAt != nil || token.RevokedAt != nil {
+		return fmt.Errorf("refresh token already used: %w", repository.ErrConflict)
+	}
+	now := time.Now()
+	token.UsedAt = &now
+	repo.refreshTokens[id] = token
+	return nil
+}
+
+func (repo *MemoryRepository) RevokeRefreshTokenFamily(ctx context.Context, familyId string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	now := time.Now()
+	for id, token := range repo.refreshTokens {
+		if token.FamilyId == familyId && token.RevokedAt == nil {
+			token.RevokedAt = &now
+			repo.refreshTokens[id] = token
+		}
+	}
+	return nil
+}
+
+func (repo *MemoryRepository) RevokeUserRefreshTokens(ctx context.Context, userId string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	now := time.Now()
+	for id, token := range repo.refreshTokens {
+		if token.UserId == userId && token.RevokedAt == nil {
+			token.RevokedAt = &now
+			repo.refreshTokens[id] = token
+		}
+	}
+	return nil
+}
+
+func (repo *MemoryRepository) RevokeToken(ctx context.Context, token *models.RevokedToken) error {
+	_, err := repo.insertRevokedToken(token)
+	return err
+}
+
+func (repo *MemoryRepository) ConsumeToken(ctx context.Context, token *models.RevokedToken) error {
+	inserted, err := repo.insertRevokedToken(token)
+	if err != nil {
+		return err
+	}
+	if !inserted {
+		return repository.ErrConflict
+	}
+	return nil
+}
+
+// insertRevokedToken guarda el jti si no estaba, con el mutex bloqueado para que dos peticiones no lo guarden a la vez
+func (repo *MemoryRepository) insertRevokedToken(token *models.RevokedToken) (bool, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if _, ok := repo.users[token.UserId]; !ok {
+		return false, errors.New("user does not exist")
+	}
+	now := time.Now()
+	for id, revoked := range repo.revokedTokens {
+		if !revoked.ExpiresAt.IsZero() && revoked.ExpiresAt.Before(now) {
+			delete(repo.revokedTokens, id)
+		}
+	}
+	if _, ok := repo.revokedTokens[token.Id]; ok {
+		return false, nil
+	}
+	repo.revokedTokens[token.Id] = *token
+	return true, nil
+}
+
+func (repo *MemoryRepository) IsTokenRevoked(ctx context.Context, id string) (bool, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	_, ok := repo.revokedTokens[id]
+	return ok, nil
+}
+
+func (repo *MemoryRepository) RevokeUserTokens(ctx context.Context, userId string, before time.Time) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if _, ok := repo.users[userId]; !ok {
+		return errors.New("user does not exist")
+	}
+	// igual que GREATEST en postgres, la fecha nunca retrocede
+	if before.After(repo.revokedBefore[userId]) {
+		repo.revokedBefore[userId] = before
+	}
+	return nil
+}
+
+func (repo *MemoryRepository) GetUserTokensRevokedBefore(ctx context.Context, userId string) (time.Time, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	return repo.revokedBefore[userId], nil
+}
+
+func (repo *MemoryRepository) ListUsers(ctx context.Context, page uint64) ([]*models.User, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	start := page * USERS_PER_PAGE
+	if start >= uint64(len(repo.userIds)) {
+		return nil, nil
+	}
+	end := start + USERS_PER_PAGE
+	if end > uint64(len(repo.userIds)) {
+		end = uint64(len(repo.userIds))
+	}
+	users := make([]*models.User, 0, end-start)
+	for _, id := range repo.userIds[start:end] {
+		user := repo.users[id]
+		user.Password = ""
+		user.Roles = append([]string(nil), user.Roles...)
+		users = append(users, &user)
+	}
+	return users, nil
+}
+
+func (repo *MemoryRepository) UpdateUserRoles(ctx context.Context, id string, roles []string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	user, ok := repo.users[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	user.Roles = append([]string(nil), roles...)
+	repo.users[id] = user
+	return nil
+}
+
+// copyAPIKey copia la llave para que quien la recibe no pueda modificar la guardada
+func copyAPIKey(key models.APIKey) *models.APIKey {
+	key.Scopes = append([]string(nil), key.Scopes...)
+	return &key
+}
+
+func (repo *MemoryRepository) InsertAPIKey(ctx context.Context, key *models.APIKey) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for _, k := range repo.apiKeys {
+		if k.Id == key.Id || k.KeyHash == key.KeyHash {
+			return fmt.Errorf("api key already exists: %w", repository.ErrConflict)
+		}
+	}
+	if _, ok := repo.users[key.UserId]; !ok {
+		return errors.New("user does not exist")
+	}
+	stored := *copyAPIKey(*key)
+	stored.CreatedAt = time.Now()
+	stored.RevokedAt = nil
+	repo.apiKeys[key.Id] = stored
+	return nil
+}
+
+func (repo *MemoryRepository) GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	for _, key := range repo.apiKeys {
+		if key.KeyHash == hash {
+			return copyAPIKey(key), nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (repo *MemoryRepository) ListAPIKeys(ctx context.Context, userId string) ([]*models.APIKey, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	var keys []*models.APIKey
+	for _, key := range repo.apiKeys {
+		if key.UserId == userId {
+			keys = append(keys, copyAPIKey(key))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].Id < keys[j].Id
+	})
+	return keys, nil
+}
+
+func (repo *MemoryRepository) RevokeAPIKey(ctx context.Context, id string, userId string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	key, ok := repo.apiKeys[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	if key.UserId != userId {
+		return repository.ErrForbidden
+	}
+	if key.RevokedAt == nil {
+		now := time.Now()
+		key.RevokedAt = &now
+		repo.apiKeys[id] = key
+	}
+	return nil
+}
+
+func (repo *MemoryRepository) RevokeUserAPIKeys(ctx context.Context, userId string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	now := time.Now()
+	for id, key := range repo.apiKeys {
+		if key.UserId == userId && key.RevokedAt == nil {
+			key.RevokedAt = &now
+			repo.apiKeys[id] = key
+		}
+	}
+	return nil
+}
+
+func (repo *MemoryRepository) UpdateUserPassword(ctx context.Context, id string, password string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	user, ok := repo.users[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	user.Password = password
+	repo.users[id] = user
+	return nil
+}
+
+func (repo *MemoryRepository) MarkUserVerified(ctx context.Context, id string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	user, ok := repo.users[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	user.Verified = true
+	repo.users[id] = user
+	return nil
+}
+
+func (repo *MemoryRepository) InsertPasswordResetToken(ctx context.Context, token *models.PasswordResetToken) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if _, ok := repo.users[token.UserId]; !ok {
+		return errors.New("user does not exist")
+	}
+	now := time.Now()
+	for id, t := range repo.resetTokens {
+		if t.Id == token.Id || t.TokenHash == token.TokenHash {
+			return fmt.Errorf("password reset token already exists: %w", repository.ErrConflict)
+		}
+		if t.ExpiresAt.Before(now) {
+			delete(repo.resetTokens, id)
+		}
+	}
+	stored := *token
+	stored.CreatedAt = now
+	stored.UsedAt = nil
+	repo.resetTokens[token.Id] = stored
+	return nil
+}
+
+func (repo *MemoryRepository) GetPasswordResetToken(ctx context.Context, hash string) (*models.PasswordResetToken, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	for _, token := range repo.resetTokens {
+		if token.TokenHash != hash {
+			continue
+		}
+		if token.UsedAt != nil || !token.ExpiresAt.After(time.Now()) {
+			return nil, repository.ErrNotFound
+		}
+		return &token, nil
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (repo *MemoryRepository) UsePasswordResetToken(ctx context.Context, hash string, password string) (*models.PasswordResetToken, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	now := time.Now()
+	for _, token := range repo.resetTokens {
+		if token.TokenHash != hash {
+			continue
+		}
+		if token.UsedAt != nil || !token.ExpiresAt.After(now) {
+			return nil, repository.ErrNotFound
+		}
+		user, ok := repo.users[token.UserId]
+		if !ok {
+			return nil, repository.ErrNotFound
+		}
+		user.Password = password
+		repo.users[token.UserId] = user
+		for id, t := range repo.resetTokens {
+			if t.UserId == token.UserId && t.UsedAt == nil {
+				t.UsedAt = &now
+				repo.resetTokens[id] = t
+			}
+		}
+		token.UsedAt = &now
+		return &token, nil
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (repo *MemoryRepository) SaveTOTPSecret(ctx context.Context, userId string, secret string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if _, ok := repo.users[userId]; !ok {
+		return errors.New("user does not exist")
+	}
+	if repo.totp[userId].Enabled {
+		return fmt.Errorf("totp already enabled: %w", repository.ErrConflict)
+	}
+	repo.totp[userId] = models.TOTP{UserId: userId, Secret: secret, CreatedAt: time.Now()}
+	return nil
+}
+
+func (repo *MemoryRepository) GetTOTP(ctx context.Context, userId string) (*models.TOTP, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	totp, ok := repo.totp[userId]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	return &totp, nil
+}
+
+func (repo *MemoryRepository) EnableTOTP(ctx context.Context, userId string, step int64) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	totp, ok := repo.totp[userId]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	if totp.Enabled {
+		return fmt.Errorf("totp already enabled: %w", repository.ErrConflict)
+	}
+	totp.Enabled = true
+	totp.LastUsedStep = step
+	repo.totp[userId] = totp
+	return nil
+}
+
+func (repo *MemoryRepository) UseTOTPStep(ctx context.Context, userId string, step int64) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	totp, ok := repo.totp[userId]
+	if !ok || !totp.Enabled || totp.LastUsedStep >= step {
+		return fmt.Errorf("totp code already used: %w", repository.ErrConflict)
+	}
+	totp.LastUsedStep = step
+	repo.totp[userId] = totp
+	return nil
+}
+
+func (repo *MemoryRepository) DeleteTOTP(ctx context.Context, userId string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if _, ok := repo.totp[userId]; !ok {
+		return repository.ErrNotFound
+	}
+	delete(repo.totp, userId)
+	delete(repo.recoveryCodes, userId)
+	return nil
+}
+
+func (repo *MemoryRepository) ReplaceRecoveryCodes(ctx context.Context, userId string, hashes []string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if _, ok := repo.users[userId]; !ok {
+		return errors.New("user does not exist")
+	}
+	codes := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		codes[hash] = false
+	}
+	repo.recoveryCodes[userId] = codes
+	return nil
+}
+
+func (repo *MemoryRepository) UseRecoveryCode(ctx context.Context, userId string, hash string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	used, ok := repo.recoveryCodes[userId][hash]
+	if !ok || used {
+		return repository.ErrNotFound
+	}
+	repo.recoveryCodes[userId][hash] = true
+	return nil
+}
+
+func (repo *MemoryRepository) RecordLoginFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (*models.LoginAttempt, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	attempt, ok := repo.loginAttempts[key]
+	if !ok || attempt.LastFailureAt.Before(resetBefore) {
+		attempt = models.LoginAttempt{Key: key}
+	}
+	attempt.Failures++
+	attempt.LastFailureAt = at
+	for k, a := range repo.loginAttempts {
+		if a.LastFailureAt.Before(resetBefore) {
+			delete(repo.loginAttempts, k)
+		}
+	}
+	repo.loginAttempts[key] = attempt
+	return &attempt, nil
+}
+
+func (repo *MemoryRepository) GetLoginAttempt(ctx context.Context, key string) (*models.LoginAttempt, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	attempt, ok := repo.loginAttempts[key]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	return &attempt, nil
+}
+
+func (repo *MemoryRepository) DeleteLoginAttempt(ctx context.Context, key string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	delete(repo.loginAttempts, key)
+	return nil
+}
+
+func (repo *MemoryRepository) InsertSession(ctx context.Context, session *models.Session) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if _, ok := repo.sessions[session.Id]; ok {
+		return fmt.Errorf("session already exists: %w", repository.ErrConflict)
+	}
+	if _, ok := repo.users[session.UserId]; !ok {
+		return errors.New("user does not exist")
+	}
+	stored := *session
+	stored.CreatedAt = time.Now()
+	stored.LastSeenAt = stored.CreatedAt
+	stored.RevokedAt = nil
+	repo.sessions[session.Id] = stored
+	return nil
+}
+
+func (repo *MemoryRepository) GetSession(ctx context.Context, id string) (*models.Session, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	session, ok := repo.sessions[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	return &session, nil
+}
+
+func (repo *MemoryRepository) ListSessions(ctx context.Context, userId string) ([]*models.Session, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	now := time.Now()
+	var sessions []*models.Session
+	for _, session := range repo.sessions {
+		if session.UserId == userId && session.RevokedAt == nil && session.ExpiresAt.After(now) {
+			session := session
+			sessions = append(sessions, &session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].CreatedAt.Equal(sessions[j].CreatedAt) {
+			return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+		}
+		return sessions[i].Id < sessions[j].Id
+	})
+	return sessions, nil
+}
+
+func (repo *MemoryRepository) TouchSession(ctx context.Context, id string, ip string, lastSeenAt time.Time, expiresAt time.Time) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	session, ok := repo.sessions[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	session.IP = ip
+	session.LastSeenAt = lastSeenAt
+	session.ExpiresAt = expiresAt
+	repo.sessions[id] = session
+	return nil
+}
+
+func (repo *MemoryRepository) RevokeSession(ctx context.Context, id string, userId string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	session, ok := repo.sessions[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	if session.UserId != userId {
+		return repository.ErrForbidden
+	}
+	if session.RevokedAt == nil {
+		now := time.Now()
+		session.RevokedAt = &now
+		repo.sessions[id] = session
+	}
+	return nil
+}
+
+func (repo *MemoryRepository) RevokeUserSessions(ctx context.Context, userId string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	now := time.Now()
+	for id, session := range repo.sessions {
+		if session.UserId == userId && session.RevokedAt == nil {
+			session.RevokedAt = &now
+			repo.sessions[id] = session
+		}
+	}
+	return nil
+}
+
+// identityKey es la llave de la identidad en el map, el proveedor no puede tener espacios
+func identityKey(provider string, subject string) string {
+	return provider + " " + subject
+}
+
+func (repo *MemoryRepository) InsertExternalIdentity(ctx context.Context, identity *models.ExternalIdentity) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	key := identityKey(identity.Provider, identity.Subject)
+	if _, ok := repo.identities[key]; ok {
+		return fmt.Errorf("external identity already linked: %w", repository.ErrConflict)
+	}
+	if _, ok := repo.users[identity.UserId]; !ok {
+		return errors.New("user does not exist")
+	}
+	stored := *identity
+	stored.CreatedAt = time.Now()
+	repo.identities[key] = stored
+	return nil
+}
+
+func (repo *MemoryRepository) GetExternalIdentity(ctx context.Context, provider string, subject string) (*models.ExternalIdentity, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	identity, ok := repo.identities[identityKey(provider, subject)]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	return &identity, nil
+}
+
+func (repo *MemoryRepository) InsertOIDCLoginState(ctx context.Context, state *models.OIDCLoginState) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	now := time.Now()
+	for hash, stored := range repo.oidcStates {
+		if stored.ExpiresAt.Before(now) {
+			delete(repo.oidcStates, hash)
+		}
+	}
+	if _, ok := repo.oidcStates[state.StateHash]; ok {
+		return fmt.Errorf("login state already exists: %w", repository.ErrConflict)
+	}
+	stored := *state
+	stored.CreatedAt = now
+	repo.oidcStates[state.StateHash] = stored
+	return nil
+}
+
+func (repo *MemoryRepository) UseOIDCLoginState(ctx context.Context, stateHash string) (*models.OIDCLoginState, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	state, ok := repo.oidcStates[stateHash]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	delete(repo.oidcStates, stateHash)
+	if !time.Now().Before(state.ExpiresAt) {
+		return nil, repository.ErrNotFound
+	}
+	return &state, nil
+}
+
+func (repo *MemoryRepository) Close() error {
+	return nil
+}
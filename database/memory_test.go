@@ -0,0 +1,14 @@
+package database
+
+import (
+	"testing"
+
+	"platzi.com/go/rest-ws/repository"
+	"platzi.com/go/rest-ws/repository/repositorytest"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.Repository {
+		return NewMemoryRepository()
+	})
+}
@@ -0,0 +1,263 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// las migraciones se incluyen en el binario, cada una tiene un archivo NNNN_nombre.up.sql y otro NNNN_nombre.down.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// id del advisory lock de postgres que evita que dos instancias migren al mismo tiempo
+const MIGRATIONS_LOCK_ID = 7243561
+
+// Migration es una migración numerada con su sql de subida y de bajada, el checksum es del sql de subida
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationStatus es el estado de una migración en la db
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+	// el checksum guardado en la db no coincide con el del archivo, alguien modificó una migración ya aplicada
+	ChecksumMismatch bool
+}
+
+// Migrator aplica las migraciones y guarda cuáles ya se aplicaron en la tabla schema_migrations
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// NewMigrator recibe la conexión a la db y carga las migraciones incluidas en el binario
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// loadMigrations lee los archivos de migrations/ y los ordena por versión
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("invalid migration file name %q", fileName)
+		}
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		versionStr, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name %q", fileName)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %q", fileName)
+		}
+		content, err := migrationFiles.ReadFile(path.Join("migrations", fileName))
+		if err != nil {
+			return nil, err
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: name}
+			byVersion[version] = migration
+		}
+		if direction == "up" {
+			migration.Up = string(content)
+			sum := sha256.Sum256(content)
+			migration.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			migration.Down = string(content)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d needs an up and a down file", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// ensureTable crea la tabla de migraciones si no existe
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		checksum VARCHAR(64) NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`)
+	return err
+}
+
+// Status devuelve todas las migraciones con su estado en la db
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := m.db.QueryContext(ctx, "SELECT version, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type applied struct {
+		checksum  string
+		appliedAt time.Time
+	}
+	appliedVersions := make(map[int]applied)
+	for rows.Next() {
+		var version int
+		var a applied
+		if err = rows.Scan(&version, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		appliedVersions[version] = a
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Migration: migration}
+		if a, ok := appliedVersions[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = a.appliedAt
+			status.ChecksumMismatch = a.checksum != migration.Checksum
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Check devuelve un error si falta aplicar alguna migración o si alguna aplicada fue modificada
+func (m *Migrator) Check(ctx context.Context) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			return fmt.Errorf("migration %04d_%s is not applied", status.Version, status.Name)
+		}
+		if status.ChecksumMismatch {
+			return fmt.Errorf("migration %04d_%s was modified after being applied", status.Version, status.Name)
+		}
+	}
+	return nil
+}
+
+// Up aplica todas las migraciones pendientes en orden, cada una en su propia transacción, y devuelve las que aplicó
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for _, migration := range m.migrations {
+		ok, err := m.apply(ctx, migration)
+		if err != nil {
+			return applied, fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+		if ok {
+			applied = append(applied, migration)
+		}
+	}
+	return applied, nil
+}
+
+// apply aplica la migración si no estaba aplicada, devuelve false si ya lo estaba
+func (m *Migrator) apply(ctx context.Context, migration Migration) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	// el lock se libera solo al terminar la transacción
+	if _, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", MIGRATIONS_LOCK_ID); err != nil {
+		return false, err
+	}
+	var count int
+	if err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM schema_migrations WHERE version = $1", migration.Version).Scan(&count); err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	if _, err = tx.ExecContext(ctx, migration.Up); err != nil {
+		return false, err
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)", migration.Version, migration.Name, migration.Checksum); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Down revierte las últimas steps migraciones aplicadas, de la más nueva a la más vieja, y devuelve las que revirtió
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var reverted []Migration
+	for i := len(statuses) - 1; i >= 0 && len(reverted) < steps; i-- {
+		if !statuses[i].Applied {
+			continue
+		}
+		migration := statuses[i].Migration
+		if err = m.revert(ctx, migration); err != nil {
+			return reverted, fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+		reverted = append(reverted, migration)
+	}
+	return reverted, nil
+}
+
+func (m *Migrator) revert(ctx context.Context, migration Migration) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", MIGRATIONS_LOCK_ID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, migration.Down); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", migration.Version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
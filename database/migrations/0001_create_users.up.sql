@@ -0,0 +1,7 @@
+-- IF NOT EXISTS para poder adoptar las dbs creadas con el antiguo up.sql
+CREATE TABLE IF NOT EXISTS users (
+  id VARCHAR(32) PRIMARY KEY,
+  password VARCHAR(255) NOT NULL,
+  email VARCHAR(255) NOT NULL UNIQUE,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS posts (
+  id VARCHAR(32) PRIMARY KEY,
+  post_content VARCHAR(32) NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  user_id VARCHAR(32) NOT NULL,
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
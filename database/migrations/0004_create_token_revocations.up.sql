@@ -0,0 +1,14 @@
+-- access tokens revocados con logout, por jti, se pueden borrar cuando vencen
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+  id VARCHAR(32) PRIMARY KEY,
+  user_id VARCHAR(32) NOT NULL,
+  expires_at TIMESTAMP,
+  revoked_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+-- cuando el usuario cierra todas sus sesiones, los tokens creados hasta revoked_before dejan de servir
+CREATE TABLE IF NOT EXISTS user_token_revocations (
+  user_id VARCHAR(32) PRIMARY KEY,
+  revoked_before TIMESTAMP NOT NULL,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
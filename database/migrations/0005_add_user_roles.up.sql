@@ -0,0 +1,2 @@
+-- los usuarios que ya existían quedan con el rol user
+ALTER TABLE users ADD COLUMN IF NOT EXISTS roles TEXT[] NOT NULL DEFAULT '{user}';
@@ -0,0 +1,14 @@
+-- solo se guarda el hash de la llave, prefix son los primeros caracteres para reconocerla
+CREATE TABLE IF NOT EXISTS api_keys (
+  id VARCHAR(32) PRIMARY KEY,
+  user_id VARCHAR(32) NOT NULL,
+  name VARCHAR(255) NOT NULL,
+  prefix VARCHAR(16) NOT NULL,
+  key_hash VARCHAR(64) NOT NULL UNIQUE,
+  scopes TEXT[] NOT NULL,
+  expires_at TIMESTAMP,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  revoked_at TIMESTAMP,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id);
@@ -0,0 +1,3 @@
+-- los usuarios que ya existían quedan verificados, los nuevos empiezan sin verificar
+ALTER TABLE users ADD COLUMN IF NOT EXISTS verified BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE users ALTER COLUMN verified SET DEFAULT FALSE;
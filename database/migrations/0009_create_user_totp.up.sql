@@ -0,0 +1,16 @@
+-- segundo factor de los usuarios, los códigos de recuperación se guardan con hash y sirven una vez cada uno
+CREATE TABLE IF NOT EXISTS user_totp (
+  user_id VARCHAR(32) PRIMARY KEY,
+  secret VARCHAR(64) NOT NULL,
+  last_used_step BIGINT NOT NULL DEFAULT 0,
+  enabled BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS recovery_codes (
+  user_id VARCHAR(32) NOT NULL,
+  code_hash VARCHAR(64) NOT NULL,
+  used_at TIMESTAMP,
+  PRIMARY KEY (user_id, code_hash),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
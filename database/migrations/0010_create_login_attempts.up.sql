@@ -0,0 +1,6 @@
+-- intentos de login fallidos por cuenta o por ip (key), se borran cuando pasa el tiempo sin fallos nuevos
+CREATE TABLE IF NOT EXISTS login_attempts (
+  key VARCHAR(320) PRIMARY KEY,
+  failures INTEGER NOT NULL,
+  last_failure_at TIMESTAMP NOT NULL
+);
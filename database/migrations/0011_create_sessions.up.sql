@@ -0,0 +1,14 @@
+-- una fila por login, el id es el de la familia de refresh tokens de ese login
+CREATE TABLE IF NOT EXISTS sessions (
+  id VARCHAR(32) PRIMARY KEY,
+  user_id VARCHAR(32) NOT NULL,
+  device VARCHAR(255) NOT NULL,
+  user_agent TEXT NOT NULL,
+  ip VARCHAR(64) NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  last_seen_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMP NOT NULL,
+  revoked_at TIMESTAMP,
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
@@ -0,0 +1,20 @@
+-- cuentas de proveedores externos (OpenID Connect) vinculadas a los usuarios
+CREATE TABLE IF NOT EXISTS external_identities (
+  provider VARCHAR(64) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  user_id VARCHAR(32) NOT NULL,
+  email VARCHAR(255) NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (provider, subject),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS external_identities_user_id_idx ON external_identities (user_id);
+-- logins con un proveedor externo que todavía no vuelven al callback, solo se guarda el hash del state
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+  state_hash VARCHAR(64) PRIMARY KEY,
+  provider VARCHAR(64) NOT NULL,
+  nonce VARCHAR(64) NOT NULL,
+  code_verifier VARCHAR(128) NOT NULL,
+  expires_at TIMESTAMP NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,7 @@
+-- eventos del hub que no caben en un NOTIFY (8000 bytes), el NOTIFY lleva solo el id de la fila
+CREATE TABLE IF NOT EXISTS hub_events (
+  id BIGSERIAL PRIMARY KEY,
+  payload TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS hub_events_created_at_idx ON hub_events (created_at);
@@ -3,12 +3,22 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/repository"
 )
 
+// cantidad de posts que devuelve cada página de ListPost
+const POSTS_PER_PAGE = 5
+
+// cantidad de usuarios que devuelve cada página de ListUsers
+const USERS_PER_PAGE = 20
+
 // crear la representación de la conexión con la db en PostgresRepository:
 type PostgresRepository struct {
 	db *sql.DB
@@ -27,7 +37,10 @@ func NewPostgresRepository(url string) (*PostgresRepository, error) {
 // Crear la funcion de tipo PostgresRepository, para insertar el User a la db, se crea como un receiver function, a la función se le pasa el context y el user que viene de los modelos de Usuario, y devolver un error si existe:
 func (repo *PostgresRepository) InsertUser(ctx context.Context, user *models.User) error {
 	// EJecución de sql para insertar el usuario, el ExecContext devuelve el resultado de sql y el error, si no requiero el resultado de sql, le pongo _
-	_, err := repo.db.ExecContext(ctx, "INSERT INTO users (id, email, password) VALUES ($1, $2, $3)", user.Id, user.Email, user.Password)
+	_, err := repo.db.ExecContext(ctx, "INSERT INTO users (id, email, password, roles, verified) VALUES ($1, $2, $3, $4, $5)", user.Id, user.Email, user.Password, pq.Array(userRoles(user)), user.Verified)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("email already registered: %w", repository.ErrConflict)
+	}
 	return err
 }
 
@@ -35,13 +48,16 @@ func (repo *PostgresRepository) InsertUser(ctx context.Context, user *models.Use
 func (repo *PostgresRepository) InsertPost(ctx context.Context, post *models.Post) error {
 	// EJecución de sql para insertar el post, el ExecContext devuelve el resultado de sql y el error, si no requiero el resultado de sql, le pongo _
 	_, err := repo.db.ExecContext(ctx, "INSERT INTO posts (id, post_content, user_id) VALUES ($1, $2, $3)", post.Id, post.PostContent, post.UserId)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("post already exists: %w", repository.ErrConflict)
+	}
 	return err
 }
 
 // Crear funcion de tipo PostgresRepository, que se llama GetUserByID, se le pasa el contexto y el id de tipo string, devolverá un usuario o un error
 func (repo *PostgresRepository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
 	// Se hace la query a la db, en la que se pasa el contexto y la query, y lo que devuelve sería las filas de la query y si hay algun error:
-	rows, err := repo.db.QueryContext(ctx, "SELECT id, email FROM users WHERE id = $1", id)
+	rows, err := repo.db.QueryContext(ctx, "SELECT id, email, roles, verified FROM users WHERE id = $1", id)
 	if err != nil {
 		return nil, err
 	}
@@ -57,7 +73,7 @@ func (repo *PostgresRepository) GetUserByID(ctx context.Context, id string) (*mo
 	// Crear la función de parseo que pase los rows al user:
 	for rows.Next() {
 		// Checar si hay un error al hacer un Scan, Scan permite copiar las columnas que se leen dentro de un la interfaz que se definió (en user)
-		if err = rows.Scan(&user.Id, &user.Email); err == nil {
+		if err = rows.Scan(&user.Id, &user.Email, pq.Array(&user.Roles), &user.Verified); err == nil {
 			return &user, nil
 		}
 	}
@@ -65,14 +81,14 @@ func (repo *PostgresRepository) GetUserByID(ctx context.Context, id string) (*mo
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	// Si no hay problema, retornar el usuario y error nulo:
-	return &user, nil
+	// Si no hay filas, el usuario no existe:
+	return nil, repository.ErrNotFound
 }
 
 // Crear funcion de tipo PostgresRepository, que se llama GetUserByEmail, se le pasa el contexto y el email de tipo string, devolverá un usuario o un error
 func (repo *PostgresRepository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
 	// Se hace la query a la db, en la que se pasa el contexto y la query, y lo que devuelve sería las filas de la query y si hay algun error:
-	rows, err := repo.db.QueryContext(ctx, "SELECT id, email, password FROM users WHERE email = $1", email)
+	rows, err := repo.db.QueryContext(ctx, "SELECT id, email, password, roles, verified FROM users WHERE email = $1", email)
 	if err != nil {
 		return nil, err
 	}
@@ -88,7 +104,7 @@ func (repo *PostgresRepository) GetUserByEmail(ctx context.Context, email string
 	// Crear la función de parseo que pase los rows al user:
 	for rows.Next() {
 		// Checar si hay un error al hacer un Scan, Scan permite copiar las columnas que se leen dentro de un la interfaz que se definió (en user)
-		if err = rows.Scan(&user.Id, &user.Email, &user.Password); err == nil {
+		if err = rows.Scan(&user.Id, &user.Email, &user.Password, pq.Array(&user.Roles), &user.Verified); err == nil {
 			return &user, nil
 		}
 	}
@@ -96,8 +112,13 @@ func (repo *PostgresRepository) GetUserByEmail(ctx context.Context, email string
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	// Si no hay problema, retornar el usuario y error nulo:
-	return &user, nil
+	// Si no hay filas, el usuario no existe:
+	return nil, repository.ErrNotFound
+}
+
+// Migrator devuelve el que aplica las migraciones sobre la misma conexión del repositorio
+func (repo *PostgresRepository) Migrator() (*Migrator, error) {
+	return NewMigrator(repo.db)
 }
 
 // Crear función que se encarga de cerrar la conexión de la db cuando ya no se requiera
@@ -126,21 +147,68 @@ func (repo *PostgresRepository) GetPostByID(ctx context.Context, id string) (*mo
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	return &post, nil
+	return nil, repository.ErrNotFound
 }
 
 func (repo *PostgresRepository) DeletePost(ctx context.Context, id string, userId string) error {
-	_, err := repo.db.ExecContext(ctx, "DELETE FROM posts WHERE id = $1 and user_id = $2", id, userId)
-	return err
+	result, err := repo.db.ExecContext(ctx, "DELETE FROM posts WHERE id = $1 and user_id = $2", id, userId)
+	if err != nil {
+		return err
+	}
+	return repo.checkPostChanged(ctx, result, id)
 }
 
+// UpdatePost deja en post la fila guardada, con su user_id y created_at
 func (repo *PostgresRepository) UpdatePost(ctx context.Context, post *models.Post, userId string) error {
-	_, err := repo.db.ExecContext(ctx, "UPDATE posts SET post_content = $1 WHERE id = $2 and user_id = $3", post.PostContent, post.Id, userId)
+	err := repo.db.QueryRowContext(ctx, "UPDATE posts SET post_content = $1 WHERE id = $2 and user_id = $3 RETURNING user_id, created_at", post.PostContent, post.Id, userId).
+		Scan(&post.UserId, &post.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return repo.missingPostError(ctx, post.Id)
+	}
 	return err
 }
 
+// checkPostChanged revisa si el UPDATE o DELETE modificó el post, si no lo hizo es porque el post no existe (ErrNotFound) o es de otro usuario (ErrForbidden)
+func (repo *PostgresRepository) checkPostChanged(ctx context.Context, result sql.Result, id string) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return nil
+	}
+	return repo.missingPostError(ctx, id)
+}
+
+// missingPostError devuelve por qué no se modificó el post: no existe (ErrNotFound) o es de otro usuario (ErrForbidden)
+func (repo *PostgresRepository) missingPostError(ctx context.Context, id string) error {
+	var exists bool
+	if err := repo.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM posts WHERE id = $1)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return repository.ErrForbidden
+	}
+	return repository.ErrNotFound
+}
+
+// userRoles devuelve los roles con los que se guarda el usuario, si no tiene ninguno queda con ROLE_USER
+func userRoles(user *models.User) []string {
+	if len(user.Roles) == 0 {
+		return []string{models.ROLE_USER}
+	}
+	return user.Roles
+}
+
+// isUniqueViolation indica si el error de postgres es por una restricción UNIQUE o PRIMARY KEY
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
 func (repo *PostgresRepository) ListPost(ctx context.Context, page uint64) ([]*models.Post, error) {
-	rows, err := repo.db.QueryContext(ctx, "SELECT id, post_content, user_id, created_at FROM posts LIMIT $1 OFFSET $2", 5, page*5)
+	// se ordena para que las páginas sean estables, el orden es por fecha de creación y luego por id
+	rows, err := repo.db.QueryContext(ctx, "SELECT id, post_content, user_id, created_at FROM posts ORDER BY created_at, id LIMIT $1 OFFSET $2", POSTS_PER_PAGE, page*POSTS_PER_PAGE)
 	if err != nil {
 		return nil, err
 	}
@@ -162,3 +230,648 @@ func (repo *PostgresRepository) ListPost(ctx context.Context, page uint64) ([]*m
 	}
 	return posts, nil
 }
+
+func (repo *PostgresRepository) InsertRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	_, err := repo.db.ExecContext(ctx, "INSERT INTO refresh_tokens (id, user_id, family_id, token_hash, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		token.Id, token.UserId, token.FamilyId, token.TokenHash, token.ExpiresAt.UTC())
+	if isUniqueViolation(err) {
+		return fmt.Errorf("refresh token already exists: %w", repository.ErrConflict)
+	}
+	return err
+}
+
+func (repo *PostgresRepository) GetRefreshTokenByHash(ctx context.Context, hash string) (*models.RefreshToken, error) {
+	var token = models.RefreshToken{}
+	err := repo.db.QueryRowContext(ctx, "SELECT id, user_id, family_id, token_hash, expires_at, created_at, used_at, revoked_at FROM refresh_tokens WHERE token_hash = $1", hash).
+		Scan(&token.Id, &token.UserId, &token.FamilyId, &token.TokenHash, &token.ExpiresAt, &token.CreatedAt, &token.UsedAt, &token.RevokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, repository.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// UseRefreshToken marca el token como usado solo si nadie lo usó antes, así dos refresh al mismo tiempo con el mismo token no pueden rotar los dos
+func (repo *PostgresRepository) UseRefreshToken(ctx context.Context, id string) error {
+	result, err := repo.db.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1 AND used_at IS NULL AND revoked_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return nil
+	}
+	var exists bool
+	if err = repo.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM refresh_tokens WHERE id = $1)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("refresh token already used: %w", repository.ErrConflict)
+	}
+	return repository.ErrNotFound
+}
+
+func (repo *PostgresRepository) RevokeRefreshTokenFamily(ctx context.Context, familyId string) error {
+	_, err := repo.db.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL", familyId)
+	return err
+}
+
+func (repo *PostgresRepository) RevokeUserRefreshTokens(ctx context.Context, userId string) error {
+	_, err := repo.db.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userId)
+	return err
+}
+
+func (repo *PostgresRepository) RevokeToken(ctx context.Context, token *models.RevokedToken) error {
+	_, err := repo.insertRevokedToken(ctx, token)
+	return err
+}
+
+// ConsumeToken usa el mismo INSERT que RevokeToken, si la fila ya existía otra petición usó el token primero
+func (repo *PostgresRepository) ConsumeToken(ctx context.Context, token *models.RevokedToken) error {
+	inserted, err := repo.insertRevokedToken(ctx, token)
+	if err != nil {
+		return err
+	}
+	if !inserted {
+		return repository.ErrConflict
+	}
+	return nil
+}
+
+// insertRevokedToken guarda el jti si no estaba y aprovecha para borrar los tokens revocados que ya vencieron, ya no hace falta recordarlos
+func (repo *PostgresRepository) insertRevokedToken(ctx context.Context, token *models.RevokedToken) (bool, error) {
+	var expiresAt interface{}
+	if !token.ExpiresAt.IsZero() {
+		expiresAt = token.ExpiresAt.UTC()
+	}
+	result, err := repo.db.ExecContext(ctx, "INSERT INTO revoked_tokens (id, user_id, expires_at) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING", token.Id, token.UserId, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	_, err = repo.db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at < $1", time.Now().UTC())
+	return rows > 0, err
+}
+
+func (repo *PostgresRepository) IsTokenRevoked(ctx context.Context, id string) (bool, error) {
+	var revoked bool
+	err := repo.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE id = $1)", id).Scan(&revoked)
+	return revoked, err
+}
+
+func (repo *PostgresRepository) RevokeUserTokens(ctx context.Context, userId string, before time.Time) error {
+	_, err := repo.db.ExecContext(ctx, `INSERT INTO user_token_revocations (user_id, revoked_before) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET revoked_before = GREATEST(user_token_revocations.revoked_before, EXCLUDED.revoked_before)`, userId, before.UTC())
+	return err
+}
+
+func (repo *PostgresRepository) GetUserTokensRevokedBefore(ctx context.Context, userId string) (time.Time, error) {
+	var before time.Time
+	err := repo.db.QueryRowContext(ctx, "SELECT revoked_before FROM user_token_revocations WHERE user_id = $1", userId).Scan(&before)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return before, err
+}
+
+// ListUsers igual que GetUserByID no devuelve los passwords
+func (repo *PostgresRepository) ListUsers(ctx context.Context, page uint64) ([]*models.User, error) {
+	rows, err := repo.db.QueryContext(ctx, "SELECT id, email, roles, verified FROM users ORDER BY created_at, id LIMIT $1 OFFSET $2", USERS_PER_PAGE, page*USERS_PER_PAGE)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	var users []*models.User
+	for rows.Next() {
+		var user = models.User{}
+		if err = rows.Scan(&user.Id, &user.Email, pq.Array(&user.Roles), &user.Verified); err == nil {
+			users = append(users, &user)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (repo *PostgresRepository) UpdateUserRoles(ctx context.Context, id string, roles []string) error {
+	result, err := repo.db.ExecContext(ctx, "UPDATE users SET roles = $1 WHERE id = $2", pq.Array(roles), id)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+// nullTime convierte la fecha opcional en un valor para la db, nil se guarda como NULL
+func nullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+func (repo *PostgresRepository) InsertAPIKey(ctx context.Context, key *models.APIKey) error {
+	_, err := repo.db.ExecContext(ctx, "INSERT INTO api_keys (id, user_id, name, prefix, key_hash, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		key.Id, key.UserId, key.Name, key.Prefix, key.KeyHash, pq.Array(key.Scopes), nullTime(key.ExpiresAt))
+	if isUniqueViolation(err) {
+		return fmt.Errorf("api key already exists: %w", repository.ErrConflict)
+	}
+	return err
+}
+
+const apiKeyColumns = "id, user_id, name, prefix, key_hash, scopes, expires_at, created_at, revoked_at"
+
+// scanAPIKey lee una fila con las columnas de apiKeyColumns
+func scanAPIKey(scanner interface{ Scan(...interface{}) error }) (*models.APIKey, error) {
+	var key = models.APIKey{}
+	err := scanner.Scan(&key.Id, &key.UserId, &key.Name, &key.Prefix, &key.KeyHash, pq.Array(&key.Scopes), &key.ExpiresAt, &key.CreatedAt, &key.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (repo *PostgresRepository) GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error) {
+	key, err := scanAPIKey(repo.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = $1", hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, repository.ErrNotFound
+	}
+	return key, err
+}
+
+func (repo *PostgresRepository) ListAPIKeys(ctx context.Context, userId string) ([]*models.APIKey, error) {
+	rows, err := repo.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id = $1 ORDER BY created_at, id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	var keys []*models.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (repo *PostgresRepository) RevokeAPIKey(ctx context.Context, id string, userId string) error {
+	result, err := repo.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = COALESCE(revoked_at, NOW()) WHERE id = $1 AND user_id = $2", id, userId)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return nil
+	}
+	var exists bool
+	if err = repo.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM api_keys WHERE id = $1)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return repository.ErrForbidden
+	}
+	return repository.ErrNotFound
+}
+
+func (repo *PostgresRepository) RevokeUserAPIKeys(ctx context.Context, userId string) error {
+	_, err := repo.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userId)
+	return err
+}
+
+func (repo *PostgresRepository) UpdateUserPassword(ctx context.Context, id string, password string) error {
+	result, err := repo.db.ExecContext(ctx, "UPDATE users SET password = $2 WHERE id = $1", id, password)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+func (repo *PostgresRepository) MarkUserVerified(ctx context.Context, id string) error {
+	result, err := repo.db.ExecContext(ctx, "UPDATE users SET verified = TRUE WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+// InsertPasswordResetToken aprovecha para borrar los tokens que ya vencieron
+func (repo *PostgresRepository) InsertPasswordResetToken(ctx context.Context, token *models.PasswordResetToken) error {
+	_, err := repo.db.ExecContext(ctx, "INSERT INTO password_reset_tokens (id, user_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		token.Id, token.UserId, token.TokenHash, token.ExpiresAt.UTC())
+	if isUniqueViolation(err) {
+		return fmt.Errorf("password reset token already exists: %w", repository.ErrConflict)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = repo.db.ExecContext(ctx, "DELETE FROM password_reset_tokens WHERE expires_at < $1", time.Now().UTC())
+	return err
+}
+
+func (repo *PostgresRepository) GetPasswordResetToken(ctx context.Context, hash string) (*models.PasswordResetToken, error) {
+	var token = models.PasswordResetToken{}
+	err := repo.db.QueryRowContext(ctx, "SELECT id, user_id, token_hash, expires_at, created_at, used_at FROM password_reset_tokens WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2", hash, time.Now().UTC()).
+		Scan(&token.Id, &token.UserId, &token.TokenHash, &token.ExpiresAt, &token.CreatedAt, &token.UsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, repository.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// UsePasswordResetToken marca el token en un solo UPDATE, así dos resets al mismo tiempo con el mismo token no pueden usarlo los dos,
+// y en la misma transacción cambia el password, si algo falla el token sigue sirviendo
+func (repo *PostgresRepository) UsePasswordResetToken(ctx context.Context, hash string, password string) (*models.PasswordResetToken, error) {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	var token = models.PasswordResetToken{}
+	err = tx.QueryRowContext(ctx, "UPDATE password_reset_tokens SET used_at = $2 WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2 RETURNING id, user_id, token_hash, expires_at, created_at, used_at", hash, now).
+		Scan(&token.Id, &token.UserId, &token.TokenHash, &token.ExpiresAt, &token.CreatedAt, &token.UsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, repository.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// los demás enlaces que se pidieron antes ya no sirven
+	if _, err = tx.ExecContext(ctx, "UPDATE password_reset_tokens SET used_at = $2 WHERE user_id = $1 AND used_at IS NULL", token.UserId, now); err != nil {
+		return nil, err
+	}
+	result, err := tx.ExecContext(ctx, "UPDATE users SET password = $2 WHERE id = $1", token.UserId, password)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, repository.ErrNotFound
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (repo *PostgresRepository) SaveTOTPSecret(ctx context.Context, userId string, secret string) error {
+	// si ya hay un secret sin activar se reemplaza, si está activo no se toca
+	result, err := repo.db.ExecContext(ctx, `INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_used_step = 0, created_at = NOW() WHERE user_totp.enabled = FALSE`, userId, secret)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return fmt.Errorf("totp already enabled: %w", repository.ErrConflict)
+	}
+	return nil
+}
+
+func (repo *PostgresRepository) GetTOTP(ctx context.Context, userId string) (*models.TOTP, error) {
+	var totp = models.TOTP{}
+	err := repo.db.QueryRowContext(ctx, "SELECT user_id, secret, last_used_step, enabled, created_at FROM user_totp WHERE user_id = $1", userId).
+		Scan(&totp.UserId, &totp.Secret, &totp.LastUsedStep, &totp.Enabled, &totp.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, repository.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &totp, nil
+}
+
+func (repo *PostgresRepository) EnableTOTP(ctx context.Context, userId string, step int64) error {
+	result, err := repo.db.ExecContext(ctx, "UPDATE user_totp SET enabled = TRUE, last_used_step = $2 WHERE user_id = $1 AND enabled = FALSE", userId, step)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return nil
+	}
+	var exists bool
+	if err = repo.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1)", userId).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("totp already enabled: %w", repository.ErrConflict)
+	}
+	return repository.ErrNotFound
+}
+
+// UseTOTPStep solo avanza el paso, así dos logins al mismo tiempo con el mismo código no pueden usarlo los dos
+func (repo *PostgresRepository) UseTOTPStep(ctx context.Context, userId string, step int64) error {
+	result, err := repo.db.ExecContext(ctx, "UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1 AND enabled = TRUE AND last_used_step < $2", userId, step)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return fmt.Errorf("totp code already used: %w", repository.ErrConflict)
+	}
+	return nil
+}
+
+func (repo *PostgresRepository) DeleteTOTP(ctx context.Context, userId string) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = $1", userId)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return repository.ErrNotFound
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repo *PostgresRepository) ReplaceRecoveryCodes(ctx context.Context, userId string, hashes []string) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userId, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (repo *PostgresRepository) UseRecoveryCode(ctx context.Context, userId string, hash string) error {
+	result, err := repo.db.ExecContext(ctx, "UPDATE recovery_codes SET used_at = $3 WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL", userId, hash, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+// RecordLoginFailure suma el fallo en un solo upsert, así los intentos al mismo tiempo no se pierden
+func (repo *PostgresRepository) RecordLoginFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (*models.LoginAttempt, error) {
+	var attempt = models.LoginAttempt{Key: key}
+	err := repo.db.QueryRowContext(ctx, `INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure_at < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure_at = EXCLUDED.last_failure_at
+		RETURNING failures, last_failure_at`, key, at.UTC(), resetBefore.UTC()).
+		Scan(&attempt.Failures, &attempt.LastFailureAt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = repo.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE last_failure_at < $1", resetBefore.UTC()); err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+func (repo *PostgresRepository) GetLoginAttempt(ctx context.Context, key string) (*models.LoginAttempt, error) {
+	var attempt = models.LoginAttempt{}
+	err := repo.db.QueryRowContext(ctx, "SELECT key, failures, last_failure_at FROM login_attempts WHERE key = $1", key).
+		Scan(&attempt.Key, &attempt.Failures, &attempt.LastFailureAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, repository.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+func (repo *PostgresRepository) DeleteLoginAttempt(ctx context.Context, key string) error {
+	_, err := repo.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE key = $1", key)
+	return err
+}
+
+func (repo *PostgresRepository) InsertSession(ctx context.Context, session *models.Session) error {
+	_, err := repo.db.ExecContext(ctx, "INSERT INTO sessions (id, user_id, device, user_agent, ip, expires_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		session.Id, session.UserId, session.Device, session.UserAgent, session.IP, session.ExpiresAt.UTC())
+	if isUniqueViolation(err) {
+		return fmt.Errorf("session already exists: %w", repository.ErrConflict)
+	}
+	return err
+}
+
+const sessionColumns = "id, user_id, device, user_agent, ip, created_at, last_seen_at, expires_at, revoked_at"
+
+// scanSession lee una fila con las columnas de sessionColumns
+func scanSession(scanner interface{ Scan(...interface{}) error }) (*models.Session, error) {
+	var session = models.Session{}
+	err := scanner.Scan(&session.Id, &session.UserId, &session.Device, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (repo *PostgresRepository) GetSession(ctx context.Context, id string) (*models.Session, error) {
+	session, err := scanSession(repo.db.QueryRowContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, repository.ErrNotFound
+	}
+	return session, err
+}
+
+func (repo *PostgresRepository) ListSessions(ctx context.Context, userId string) ([]*models.Session, error) {
+	rows, err := repo.db.QueryContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2 ORDER BY created_at, id",
+		userId, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	var sessions []*models.Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (repo *PostgresRepository) TouchSession(ctx context.Context, id string, ip string, lastSeenAt time.Time, expiresAt time.Time) error {
+	result, err := repo.db.ExecContext(ctx, "UPDATE sessions SET ip = $2, last_seen_at = $3, expires_at = $4 WHERE id = $1", id, ip, lastSeenAt.UTC(), expiresAt.UTC())
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+func (repo *PostgresRepository) RevokeSession(ctx context.Context, id string, userId string) error {
+	result, err := repo.db.ExecContext(ctx, "UPDATE sessions SET revoked_at = COALESCE(revoked_at, NOW()) WHERE id = $1 AND user_id = $2", id, userId)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		return nil
+	}
+	var exists bool
+	if err = repo.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM sessions WHERE id = $1)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return repository.ErrForbidden
+	}
+	return repository.ErrNotFound
+}
+
+func (repo *PostgresRepository) RevokeUserSessions(ctx context.Context, userId string) error {
+	_, err := repo.db.ExecContext(ctx, "UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userId)
+	return err
+}
+
+func (repo *PostgresRepository) InsertExternalIdentity(ctx context.Context, identity *models.ExternalIdentity) error {
+	_, err := repo.db.ExecContext(ctx, "INSERT INTO external_identities (provider, subject, user_id, email) VALUES ($1, $2, $3, $4)",
+		identity.Provider, identity.Subject, identity.UserId, identity.Email)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("external identity already linked: %w", repository.ErrConflict)
+	}
+	return err
+}
+
+func (repo *PostgresRepository) GetExternalIdentity(ctx context.Context, provider string, subject string) (*models.ExternalIdentity, error) {
+	var identity = models.ExternalIdentity{}
+	err := repo.db.QueryRowContext(ctx, "SELECT provider, subject, user_id, email, created_at FROM external_identities WHERE provider = $1 AND subject = $2", provider, subject).
+		Scan(&identity.Provider, &identity.Subject, &identity.UserId, &identity.Email, &identity.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, repository.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (repo *PostgresRepository) InsertOIDCLoginState(ctx context.Context, state *models.OIDCLoginState) error {
+	_, err := repo.db.ExecContext(ctx, "INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		state.StateHash, state.Provider, state.Nonce, state.CodeVerifier, state.ExpiresAt.UTC())
+	if isUniqueViolation(err) {
+		return fmt.Errorf("login state already exists: %w", repository.ErrConflict)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = repo.db.ExecContext(ctx, "DELETE FROM oidc_login_states WHERE expires_at < $1", time.Now().UTC())
+	return err
+}
+
+// UseOIDCLoginState borra el login con DELETE ... RETURNING, así dos callbacks con el mismo state no pueden usarlo los dos
+func (repo *PostgresRepository) UseOIDCLoginState(ctx context.Context, stateHash string) (*models.OIDCLoginState, error) {
+	var state = models.OIDCLoginState{}
+	err := repo.db.QueryRowContext(ctx, "DELETE FROM oidc_login_states WHERE state_hash = $1 RETURNING state_hash, provider, nonce, code_verifier, expires_at, created_at", stateHash).
+		Scan(&state.StateHash, &state.Provider, &state.Nonce, &state.CodeVerifier, &state.ExpiresAt, &state.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, repository.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(state.ExpiresAt) {
+		return nil, repository.ErrNotFound
+	}
+	return &state, nil
+}
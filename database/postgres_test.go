@@ -0,0 +1,35 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"platzi.com/go/rest-ws/repository"
+	"platzi.com/go/rest-ws/repository/repositorytest"
+)
+
+// TRUNCATE_TABLES vacía todas las tablas menos la de las migraciones
+const TRUNCATE_TABLES = `DO $$
+DECLARE tables TEXT;
+BEGIN
+	SELECT string_agg(quote_ident(tablename), ', ') INTO tables
+	FROM pg_tables WHERE schemaname = current_schema() AND tablename <> 'schema_migrations';
+	IF tables IS NOT NULL THEN
+		EXECUTE 'TRUNCATE ' || tables || ' CASCADE';
+	END IF;
+END $$`
+
+func TestPostgresConformance(t *testing.T) {
+	url := postgresURL(t)
+	repositorytest.Run(t, func(t *testing.T) repository.Repository {
+		repo, err := NewPostgresRepository(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { repo.Close() })
+		if _, err = repo.db.ExecContext(context.Background(), TRUNCATE_TABLES); err != nil {
+			t.Fatal(err)
+		}
+		return repo
+	})
+}
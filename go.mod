@@ -12,3 +12,5 @@ require (
 	github.com/segmentio/ksuid v1.0.4
 	golang.org/x/crypto v0.0.0-20220926161630-eccd6366d1be
 )
+
+require golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/repository"
+	"platzi.com/go/rest-ws/server"
+)
+
+type UpdateRolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// ListUsersHandler devuelve los usuarios por páginas (?page=), solo para admins
+func ListUsersHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		var page = uint64(0)
+		if pageStr := r.URL.Query().Get("page"); pageStr != "" {
+			page, err = strconv.ParseUint(pageStr, 10, 64)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		users, err := repository.ListUsers(r.Context(), page)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+	}
+}
+
+// GetUserHandler devuelve un usuario por id, solo para admins
+func GetUserHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := repository.GetUserByID(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+	}
+}
+
+// UpdateUserRolesHandler reemplaza los roles del usuario, solo para admins,
+// sus access tokens se revocan para que con el siguiente refresh reciba un token con los roles nuevos
+func UpdateUserRolesHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		var request = UpdateRolesRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// todos los usuarios tienen el rol user, los roles repetidos se guardan una sola vez
+		roles := []string{models.ROLE_USER}
+		seen := map[string]bool{models.ROLE_USER: true}
+		for _, role := range request.Roles {
+			if !models.ValidRole(role) {
+				http.Error(w, "invalid role "+strconv.Quote(role), http.StatusBadRequest)
+				return
+			}
+			if !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+		if err := repository.UpdateUserRoles(r.Context(), id, roles); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		if err := s.Revocations().RevokeUser(r.Context(), id); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		user, err := repository.GetUserByID(r.Context(), id)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+	}
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+	"platzi.com/go/rest-ws/auth"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/repository"
+	"platzi.com/go/rest-ws/server"
+)
+
+// caracteres de la llave que se guardan para reconocerla en la lista (el prefijo rws_ y algunos más)
+const API_KEY_DISPLAY_PREFIX = 12
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"` // opcional, sin fecha la llave no vence
+}
+
+// la llave solo se devuelve al crearla, después solo se puede ver su prefijo
+type CreateAPIKeyResponse struct {
+	*models.APIKey
+	Key string `json:"key"`
+}
+
+type APIKeyRevokedResponse struct {
+	Message string `json:"message"`
+}
+
+func CreateAPIKeyHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		var request = CreateAPIKeyRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if len(request.Scopes) == 0 {
+			http.Error(w, "at least one scope is required", http.StatusBadRequest)
+			return
+		}
+		for _, scope := range request.Scopes {
+			if !models.ValidScope(scope) {
+				http.Error(w, "invalid scope "+strconv.Quote(scope), http.StatusBadRequest)
+				return
+			}
+		}
+		if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+			http.Error(w, "expiresAt must be in the future", http.StatusBadRequest)
+			return
+		}
+		key, hash, err := auth.NewAPIKey()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		apiKey := &models.APIKey{
+			Id:        ksuid.New().String(),
+			UserId:    principal.UserId,
+			Name:      request.Name,
+			Prefix:    key[:API_KEY_DISPLAY_PREFIX],
+			KeyHash:   hash,
+			Scopes:    request.Scopes,
+			ExpiresAt: request.ExpiresAt,
+			CreatedAt: time.Now(),
+		}
+		if err = repository.InsertAPIKey(r.Context(), apiKey); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(CreateAPIKeyResponse{APIKey: apiKey, Key: key})
+	}
+}
+
+// ListAPIKeysHandler devuelve las API keys del usuario, sin la llave
+func ListAPIKeysHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		keys, err := repository.ListAPIKeys(r.Context(), principal.UserId)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		if keys == nil {
+			keys = []*models.APIKey{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	}
+}
+
+// RevokeAPIKeyHandler revoca la API key, si no existe o es de otro usuario se responde 404 o 403
+func RevokeAPIKeyHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		if err := repository.RevokeAPIKey(r.Context(), mux.Vars(r)["id"], principal.UserId); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIKeyRevokedResponse{Message: "API key revoked"})
+	}
+}
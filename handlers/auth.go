@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"platzi.com/go/rest-ws/auth"
+	"platzi.com/go/rest-ws/server"
+)
+
+// requirePrincipal devuelve el usuario que el middleware dejó en el contexto, si no está responde 401,
+// solo pasa si el handler se registró en una ruta sin el middleware de autenticación
+func requirePrincipal(w http.ResponseWriter, r *http.Request) (*auth.Principal, bool) {
+	principal, ok := auth.PrincipalFrom(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+	return principal, ok
+}
+
+// clientIP devuelve la ip del cliente, con TrustProxyHeaders se toma la última ip de X-Forwarded-For, que es la que agregó
+// nuestro proxy; las anteriores las manda el cliente y puede poner cualquier cosa. La ip se devuelve normalizada
+// (ej: 2001:db8::1), si el header no trae una ip válida se usa la de la conexión
+func clientIP(s server.Server, r *http.Request) string {
+	if s.Config().TrustProxyHeaders {
+		// el proxy puede agregar su valor al final del header o en un header nuevo
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			forwarded := values[len(values)-1]
+			last := forwarded[strings.LastIndex(forwarded, ",")+1:]
+			if ip := net.ParseIP(strings.TrimSpace(last)); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"platzi.com/go/rest-ws/repository"
+)
+
+// writeRepositoryError es el único lugar donde los errores del repository se convierten en status http:
+// ErrNotFound -> 404, ErrConflict -> 409, ErrForbidden -> 403, y cualquier otro error -> 500 sin mostrar el detalle al cliente
+func writeRepositoryError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, repository.ErrConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, repository.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		log.Println("repository error:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"platzi.com/go/rest-ws/server"
+)
+
+// handler que devuelve los contadores del hub (clientes conectados, mensajes entregados, descartados y clientes desconectados por lentos)
+func HubMetricsHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Hub().Metrics())
+	}
+}
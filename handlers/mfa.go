@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"platzi.com/go/rest-ws/auth"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/repository"
+	"platzi.com/go/rest-ws/server"
+)
+
+// tiempo que tiene el usuario para enviar el código del segundo factor después de enviar su password
+const MFA_PENDING_TOKEN_TTL = 5 * time.Minute
+
+var errInvalidMFACode = errors.New("invalid code")
+
+// respuesta del login cuando el usuario tiene TOTP, el mfaToken se cambia por los tokens en /login/mfa junto con el código
+type MFARequiredResponse struct {
+	MFARequired bool      `json:"mfaRequired"`
+	MFAToken    string    `json:"mfaToken"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+type LoginMFARequest struct {
+	MFAToken string `json:"mfaToken"`
+	Code     string `json:"code"` // código de la app de autenticación o un código de recuperación
+}
+
+// la uri otpauth:// se muestra como QR para agregar la cuenta en la app de autenticación
+type TOTPSetupResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+// los códigos de recuperación solo se muestran al generarlos
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type MFAResponse struct {
+	Message string `json:"message"`
+}
+
+// writeMFARequired responde el token mfa_pending en lugar de los tokens de sesión, se llama desde el login
+func writeMFARequired(w http.ResponseWriter, s server.Server, user *models.User) {
+	token, err := s.Issuer().IssuePurposeToken(user.Id, auth.PURPOSE_MFA_PENDING, MFA_PENDING_TOKEN_TTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFARequiredResponse{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresAt:   time.Now().Add(MFA_PENDING_TOKEN_TTL),
+	})
+}
+
+// verifySecondFactor acepta un código TOTP que no se haya usado antes o un código de recuperación sin usar,
+// devuelve errInvalidMFACode si no es ninguno de los dos
+func verifySecondFactor(ctx context.Context, totp *models.TOTP, code string) error {
+	code = strings.TrimSpace(code)
+	if step, ok := auth.ValidateTOTP(totp.Secret, code, time.Now()); ok {
+		err := repository.UseTOTPStep(ctx, totp.UserId, step)
+		if errors.Is(err, repository.ErrConflict) {
+			return errInvalidMFACode
+		}
+		return err
+	}
+	err := repository.UseRecoveryCode(ctx, totp.UserId, auth.HashRecoveryCode(code))
+	if errors.Is(err, repository.ErrNotFound) {
+		return errInvalidMFACode
+	}
+	return err
+}
+
+// verifyThrottledSecondFactor verifica el código con el límite de intentos del login, los códigos equivocados cuentan
+// como logins fallidos de la cuenta, así no se pueden probar todos los códigos. Si el código no sirve responde
+// invalidStatus y devuelve false
+func verifyThrottledSecondFactor(w http.ResponseWriter, r *http.Request, s server.Server, email string, totp *models.TOTP, code string, invalidStatus int) bool {
+	ip := clientIP(s, r)
+	wait, err := s.LoginThrottle().Check(r.Context(), email, ip)
+	if err != nil {
+		writeRepositoryError(w, err)
+		return false
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return false
+	}
+	if err = verifySecondFactor(r.Context(), totp, code); errors.Is(err, errInvalidMFACode) {
+		if wait, err = s.LoginThrottle().Failure(r.Context(), email, ip); err != nil {
+			writeRepositoryError(w, err)
+			return false
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		}
+		http.Error(w, errInvalidMFACode.Error(), invalidStatus)
+		return false
+	}
+	if err != nil {
+		writeRepositoryError(w, err)
+		return false
+	}
+	if err = s.LoginThrottle().Success(r.Context(), email); err != nil {
+		writeRepositoryError(w, err)
+		return false
+	}
+	return true
+}
+
+// enabledTOTP devuelve el TOTP activo del usuario, responde 404 si no tiene
+func enabledTOTP(w http.ResponseWriter, r *http.Request, userId string) (*models.TOTP, bool) {
+	totp, err := repository.GetTOTP(r.Context(), userId)
+	if err == nil && !totp.Enabled {
+		err = repository.ErrNotFound
+	}
+	if err != nil {
+		writeRepositoryError(w, err)
+		return nil, false
+	}
+	return totp, true
+}
+
+// LoginMFAHandler termina el login del usuario con TOTP: cambia el token mfa_pending y un código válido por los tokens de sesión,
+// el token mfa_pending sirve para un solo login
+func LoginMFAHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request = LoginMFARequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		claims, err := s.Issuer().ParsePurposeToken(request.MFAToken, auth.PURPOSE_MFA_PENDING)
+		if err != nil {
+			http.Error(w, "invalid mfa token", http.StatusUnauthorized)
+			return
+		}
+		user, err := repository.GetUserByID(r.Context(), claims.UserId)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		totp, err := repository.GetTOTP(r.Context(), claims.UserId)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			writeRepositoryError(w, err)
+			return
+		}
+		// si desactivó el TOTP después de pedir el token, tiene que volver a hacer login
+		if err != nil || !totp.Enabled {
+			http.Error(w, "invalid mfa token", http.StatusUnauthorized)
+			return
+		}
+		if !verifyThrottledSecondFactor(w, r, s, user.Email, totp, request.Code, http.StatusUnauthorized) {
+			return
+		}
+		// con el código correcto se usa el token, si otra petición lo usó primero no se abre otra sesión
+		err = repository.ConsumeToken(r.Context(), &models.RevokedToken{
+			Id:        claims.Id,
+			UserId:    claims.UserId,
+			ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+		})
+		if errors.Is(err, repository.ErrConflict) {
+			http.Error(w, "invalid mfa token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		response, err := startSession(r, s, user)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// SetupTOTPHandler genera un secret nuevo para el usuario, el TOTP no se pide en el login hasta confirmarlo con un código en ConfirmTOTPHandler
+func SetupTOTPHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		user, err := repository.GetUserByID(r.Context(), principal.UserId)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		secret, err := auth.NewTOTPSecret()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// si ya tiene el TOTP activo responde 409, primero lo tiene que desactivar
+		if err = repository.SaveTOTPSecret(r.Context(), user.Id, secret); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TOTPSetupResponse{
+			Secret: secret,
+			URI:    auth.TOTPURI(s.Config().TOTPIssuer, user.Email, secret),
+		})
+	}
+}
+
+// ConfirmTOTPHandler activa el TOTP con un código de la app, así se sabe que la app quedó bien configurada, y devuelve los códigos de recuperación
+func ConfirmTOTPHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		var request = MFACodeRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		totp, err := repository.GetTOTP(r.Context(), principal.UserId)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		step, valid := auth.ValidateTOTP(totp.Secret, strings.TrimSpace(request.Code), time.Now())
+		if !valid {
+			http.Error(w, errInvalidMFACode.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = repository.EnableTOTP(r.Context(), principal.UserId, step); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		writeRecoveryCodes(w, r, principal.UserId)
+	}
+}
+
+// RegenerateRecoveryCodesHandler reemplaza los códigos de recuperación, los anteriores dejan de servir
+func RegenerateRecoveryCodesHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		var request = MFACodeRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user, err := repository.GetUserByID(r.Context(), principal.UserId)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		totp, ok := enabledTOTP(w, r, principal.UserId)
+		if !ok {
+			return
+		}
+		if !verifyThrottledSecondFactor(w, r, s, user.Email, totp, request.Code, http.StatusBadRequest) {
+			return
+		}
+		writeRecoveryCodes(w, r, principal.UserId)
+	}
+}
+
+// DisableTOTPHandler desactiva el TOTP del usuario, pide un código con el mismo límite de intentos del login para que no
+// lo pueda desactivar alguien que solo tiene el token
+func DisableTOTPHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		var request = MFACodeRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user, err := repository.GetUserByID(r.Context(), principal.UserId)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		totp, ok := enabledTOTP(w, r, principal.UserId)
+		if !ok {
+			return
+		}
+		if !verifyThrottledSecondFactor(w, r, s, user.Email, totp, request.Code, http.StatusBadRequest) {
+			return
+		}
+		if err := repository.DeleteTOTP(r.Context(), principal.UserId); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(MFAResponse{Message: "totp disabled"})
+	}
+}
+
+// writeRecoveryCodes genera códigos de recuperación nuevos para el usuario y los responde
+func writeRecoveryCodes(w http.ResponseWriter, r *http.Request, userId string) {
+	codes, hashes, err := auth.NewRecoveryCodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = repository.ReplaceRecoveryCodes(r.Context(), userId, hashes); err != nil {
+		writeRepositoryError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
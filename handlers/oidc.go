@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+	"platzi.com/go/rest-ws/auth"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/oidc"
+	"platzi.com/go/rest-ws/repository"
+	"platzi.com/go/rest-ws/server"
+)
+
+// tiempo que tiene el usuario para hacer login en el proveedor y volver al callback
+const OIDC_LOGIN_STATE_TTL = 10 * time.Minute
+
+var (
+	errOIDCNoEmail      = errors.New("identity provider did not return an email")
+	errOIDCInvalidEmail = errors.New("identity provider returned an invalid email")
+	// el email ya tiene una cuenta y el proveedor no asegura que el email sea del usuario, vincularla permitiría tomar esa cuenta
+	errOIDCUnverifiedEmail = errors.New("email already registered, the identity provider did not verify it")
+	// la cuenta con ese email nunca verificó el email, la pudo crear otra persona antes que el dueño del email
+	// y vincularla le dejaría a esa persona el password, las sesiones y las API keys de la cuenta
+	errOIDCUnverifiedAccount = errors.New("email already registered to an account that has not verified it, verify the email first")
+)
+
+// OIDCLoginHandler empieza el login con el proveedor externo: guarda el state, el nonce y el code verifier y redirige al proveedor
+func OIDCLoginHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := s.OIDCProvider(mux.Vars(r)["provider"])
+		if !ok {
+			http.Error(w, "unknown identity provider", http.StatusNotFound)
+			return
+		}
+		request, err := oidc.NewLoginRequest()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = repository.InsertOIDCLoginState(r.Context(), &models.OIDCLoginState{
+			StateHash:    auth.HashToken(request.State),
+			Provider:     provider.Name(),
+			Nonce:        request.Nonce,
+			CodeVerifier: request.CodeVerifier,
+			ExpiresAt:    time.Now().Add(OIDC_LOGIN_STATE_TTL),
+		})
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		location, err := provider.AuthCodeURL(r.Context(), request)
+		if err != nil {
+			log.Println("oidc discovery:", err)
+			http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+			return
+		}
+		http.Redirect(w, r, location, http.StatusFound)
+	}
+}
+
+// OIDCCallbackHandler termina el login: cambia el código por el id token, vincula la identidad con un usuario
+// y responde los tokens de sesión igual que /login, con TOTP activo responde el token mfa_pending
+func OIDCCallbackHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := s.OIDCProvider(mux.Vars(r)["provider"])
+		if !ok {
+			http.Error(w, "unknown identity provider", http.StatusNotFound)
+			return
+		}
+		query := r.URL.Query()
+		// el usuario canceló o el proveedor rechazó el login
+		if providerError := query.Get("error"); providerError != "" {
+			http.Error(w, "identity provider returned "+providerError, http.StatusUnauthorized)
+			return
+		}
+		state, err := repository.UseOIDCLoginState(r.Context(), auth.HashToken(query.Get("state")))
+		if errors.Is(err, repository.ErrNotFound) || (err == nil && state.Provider != provider.Name()) {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		identity, err := provider.Exchange(r.Context(), query.Get("code"), state.CodeVerifier, state.Nonce)
+		if errors.Is(err, oidc.ErrInvalidIDToken) || errors.Is(err, oidc.ErrInvalidGrant) {
+			log.Println("oidc callback:", err)
+			http.Error(w, "invalid login", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Println("oidc callback:", err)
+			http.Error(w, "identity provider error", http.StatusBadGateway)
+			return
+		}
+		user, err := linkExternalIdentity(r.Context(), s, identity)
+		if errors.Is(err, errOIDCNoEmail) || errors.Is(err, errOIDCInvalidEmail) || errors.Is(err, errOIDCUnverifiedEmail) || errors.Is(err, errOIDCUnverifiedAccount) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		if s.Config().RequireVerifiedEmail && !user.Verified {
+			http.Error(w, "email not verified", http.StatusForbidden)
+			return
+		}
+		// el proveedor no reemplaza el segundo factor de la cuenta
+		totp, err := repository.GetTOTP(r.Context(), user.Id)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			writeRepositoryError(w, err)
+			return
+		}
+		if err == nil && totp.Enabled {
+			writeMFARequired(w, s, user)
+			return
+		}
+		response, err := startSession(r, s, user)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// linkExternalIdentity devuelve el usuario vinculado a la identidad, si no hay uno la vincula al usuario con el mismo email
+// (solo si el proveedor y la cuenta verificaron el email) o crea un usuario nuevo sin password, que puede crear uno con /password/forgot
+func linkExternalIdentity(ctx context.Context, s server.Server, identity *oidc.Identity) (*models.User, error) {
+	linked, err := repository.GetExternalIdentity(ctx, identity.Provider, identity.Subject)
+	if err == nil {
+		return repository.GetUserByID(ctx, linked.UserId)
+	}
+	if !errors.Is(err, repository.ErrNotFound) {
+		return nil, err
+	}
+	if identity.Email == "" {
+		return nil, errOIDCNoEmail
+	}
+	// el email se guarda en el usuario y va en los headers de los correos, solo se acepta una dirección sin nombre
+	if address, err := mail.ParseAddress(identity.Email); err != nil || address.Address != identity.Email {
+		return nil, errOIDCInvalidEmail
+	}
+	user, err := repository.GetUserByEmail(ctx, identity.Email)
+	switch {
+	case err == nil && !identity.EmailVerified:
+		return nil, errOIDCUnverifiedEmail
+	case err == nil && !user.Verified:
+		return nil, errOIDCUnverifiedAccount
+	case errors.Is(err, repository.ErrNotFound):
+		if user, err = newExternalUser(ctx, s, identity); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+	err = repository.InsertExternalIdentity(ctx, &models.ExternalIdentity{
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		UserId:   user.Id,
+		Email:    identity.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// newExternalUser crea el usuario de una identidad externa, su password es aleatorio y nadie lo conoce,
+// así el login con password falla igual que con un password equivocado
+func newExternalUser(ctx context.Context, s server.Server, identity *oidc.Identity) (*models.User, error) {
+	password, _, err := auth.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	hashedPassword, err := s.Passwords().Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	user := &models.User{
+		Id:       ksuid.New().String(),
+		Email:    identity.Email,
+		Password: hashedPassword,
+		Roles:    []string{models.ROLE_USER},
+		Verified: identity.EmailVerified,
+	}
+	if err = repository.InsertUser(ctx, user); err != nil {
+		return nil, err
+	}
+	// igual que en el signup, si el proveedor no verificó el email se le envía el enlace
+	if !user.Verified {
+		if err = sendVerificationEmail(ctx, s, user); err != nil {
+			log.Println("error sending verification email:", err)
+		}
+	}
+	return user, nil
+}
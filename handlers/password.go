@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"platzi.com/go/rest-ws/auth"
+	"platzi.com/go/rest-ws/mail"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/repository"
+	"platzi.com/go/rest-ws/server"
+)
+
+const (
+	// tiempo que sirve el token para recuperar el password
+	PASSWORD_RESET_TOKEN_TTL = time.Hour
+	// tiempo máximo para crear el token y enviar el correo, se hace fuera de la petición
+	PASSWORD_RESET_SEND_TIMEOUT = 30 * time.Second
+	// correos de recuperación que se envían a la vez, si hay más pedidos esperando se descartan
+	PASSWORD_RESET_MAX_SENDING = 16
+)
+
+// cupos para las goroutines que envían los correos de recuperación
+var passwordResetSending = make(chan struct{}, PASSWORD_RESET_MAX_SENDING)
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type PasswordResponse struct {
+	Message string `json:"message"`
+}
+
+// ForgotPasswordHandler envía al usuario un token para cambiar su password, siempre responde 202 exista o no el email,
+// así no sirve para averiguar qué emails están registrados; el correo se envía en otra goroutine para que el tiempo de respuesta tampoco lo delate.
+// Los pedidos se limitan por email y por ip con el PasswordResetThrottle, y como mucho se envían PASSWORD_RESET_MAX_SENDING correos a la vez
+func ForgotPasswordHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request = ForgotPasswordRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ip := clientIP(s, r)
+		wait, err := s.PasswordResetThrottle().Check(r.Context(), request.Email, ip)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", retryAfterSeconds(wait))
+			http.Error(w, "too many password reset requests, try again later", http.StatusTooManyRequests)
+			return
+		}
+		// cada pedido cuenta, exista o no el email
+		if _, err = s.PasswordResetThrottle().Failure(r.Context(), request.Email, ip); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		select {
+		case passwordResetSending <- struct{}{}:
+			go func() {
+				defer func() { <-passwordResetSending }()
+				ctx, cancel := context.WithTimeout(context.Background(), PASSWORD_RESET_SEND_TIMEOUT)
+				defer cancel()
+				if err := sendPasswordResetEmail(ctx, s, request.Email); err != nil {
+					log.Println("error sending password reset email:", err)
+				}
+			}()
+		default:
+			log.Println("password reset email not sent, too many emails being sent")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(PasswordResponse{Message: "if the email is registered you will receive a message to reset your password"})
+	}
+}
+
+// sendPasswordResetEmail crea el token y lo envía por correo, si el email no está registrado no hace nada
+func sendPasswordResetEmail(ctx context.Context, s server.Server, email string) error {
+	user, err := repository.GetUserByEmail(ctx, email)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	token, hash, err := auth.NewPasswordResetToken()
+	if err != nil {
+		return err
+	}
+	err = repository.InsertPasswordResetToken(ctx, &models.PasswordResetToken{
+		Id:        ksuid.New().String(),
+		UserId:    user.Id,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(PASSWORD_RESET_TOKEN_TTL),
+	})
+	if err != nil {
+		return err
+	}
+	return s.Mailer().Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your account, if it wasn't you ignore this message.\n\n"+
+			"To choose a new password send this token to POST %s/password/reset, it expires in %s:\n\n%s\n",
+			s.Config().PublicURL, PASSWORD_RESET_TOKEN_TTL, token),
+	})
+}
+
+// ResetPasswordHandler cambia el password con el token que llegó por correo, el token solo sirve una vez
+// y al cambiar el password se cierran todas las sesiones del usuario y se revocan sus API keys
+func ResetPasswordHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request = ResetPasswordRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if request.Token == "" || request.Password == "" {
+			http.Error(w, "token and password are required", http.StatusBadRequest)
+			return
+		}
+		// el token se busca sin usarlo, así un password que no cumple las reglas no lo gasta
+		hash := auth.HashToken(request.Token)
+		token, err := repository.GetPasswordResetToken(r.Context(), hash)
+		if errors.Is(err, repository.ErrNotFound) {
+			http.Error(w, "invalid or expired reset token", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		user, err := repository.GetUserByID(r.Context(), token.UserId)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		if err = s.Config().PasswordPolicy.Validate(request.Password, user.Email); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hashedPassword, err := s.Passwords().Hash(request.Password)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// el token se usa y el password se cambia en una sola operación, si otra petición usó el token primero responde que no sirve
+		if _, err = repository.UsePasswordResetToken(r.Context(), hash, hashedPassword); errors.Is(err, repository.ErrNotFound) {
+			http.Error(w, "invalid or expired reset token", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		// el token llegó a su correo, así que el email también queda verificado
+		if err = repository.MarkUserVerified(r.Context(), token.UserId); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		if err = revokeUserSessions(r.Context(), s, token.UserId); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		// las API keys las pudo crear quien tenía el password anterior
+		if err = repository.RevokeUserAPIKeys(r.Context(), token.UserId); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(PasswordResponse{Message: "password changed"})
+	}
+}
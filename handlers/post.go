@@ -4,14 +4,13 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
-	"strings"
 
-	"github.com/golang-jwt/jwt"
 	"github.com/gorilla/mux"
 	"github.com/segmentio/ksuid"
 	"platzi.com/go/rest-ws/models"
 	"platzi.com/go/rest-ws/repository"
 	"platzi.com/go/rest-ws/server"
+	"platzi.com/go/rest-ws/websocket"
 )
 
 // Se cambia de nombre de insert a upsert para que sirva para crear o actualizar
@@ -30,55 +29,47 @@ type PostDeletedResponse struct {
 
 func InsertPostHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokenString := strings.TrimSpace(r.Header.Get("Authorization"))
-		token, err := jwt.ParseWithClaims(tokenString, &models.AppClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(s.Config().JWTSecret), nil
-		})
+		// el usuario autenticado lo deja el middleware en el contexto
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		// crear el postRequest
+		var postRequest = UpsertPostRequest{}
+		err := json.NewDecoder(r.Body).Decode(&postRequest)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if claims, ok := token.Claims.(*models.AppClaims); ok && token.Valid {
-			// crear el postRequest
-			var postRequest = UpsertPostRequest{}
-			err := json.NewDecoder(r.Body).Decode(&postRequest)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			// crear el id
-			id, err := ksuid.NewRandom()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			post := models.Post{
-				Id:          id.String(),
-				PostContent: postRequest.PostContent,
-				UserId:      claims.UserId,
-			}
-			// insertar el post
-			err = repository.InsertPost(r.Context(), &post)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			// enviar mensaje:
-			var postMessage = models.WebsocketMessage{
-				Type:    "Post_Created",
-				Payload: post,
-			}
-			// llamar a la función de Broadcast, y se envía en el broadcast el postMessage y en este caso un valor nulo, en este caso no queremos que ningún cliente evite recibir este mensaje
-			s.Hub().Broadcast(postMessage, nil)
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(PostResponse{
-				Id:          post.Id,
-				PostContent: post.PostContent,
-			})
-		} else {
+		// crear el id
+		id, err := ksuid.NewRandom()
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		post := models.Post{
+			Id:          id.String(),
+			PostContent: postRequest.PostContent,
+			UserId:      principal.UserId,
+		}
+		// insertar el post
+		err = repository.InsertPost(r.Context(), &post)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		// enviar mensaje:
+		var postMessage = models.WebsocketMessage{
+			Type:    models.EVENT_POST_CREATED,
+			Payload: post,
+		}
+		// publicar el postMessage a los clientes suscritos a todos los posts, a los posts del usuario o a ese post
+		s.Hub().Publish(postMessage, websocket.TOPIC_POSTS, websocket.UserTopic(post.UserId), websocket.PostTopic(post.Id))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(PostResponse{
+			Id:          post.Id,
+			PostContent: post.PostContent,
+		})
 	}
 
 }
@@ -88,7 +79,7 @@ func GetPostByIDHandler(s server.Server) http.HandlerFunc {
 		params := mux.Vars(r) // para extraer el id
 		post, err := repository.GetPostByID(r.Context(), params["id"])
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeRepositoryError(w, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -99,67 +90,78 @@ func GetPostByIDHandler(s server.Server) http.HandlerFunc {
 
 func DeletePostByIdHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		params := mux.Vars(r)
-		tokenString := strings.TrimSpace(r.Header.Get("Authorization"))
-		token, err := jwt.ParseWithClaims(tokenString, &models.AppClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(s.Config().JWTSecret), nil
-		})
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+		// el usuario autenticado lo deja el middleware en el contexto
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
 			return
 		}
-		if claims, ok := token.Claims.(*models.AppClaims); ok && token.Valid {
-			err = repository.DeletePost(r.Context(), params["id"], claims.UserId)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(PostDeletedResponse{
-				Message: "Post deleted",
-			})
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		deletePost(w, r, s, mux.Vars(r)["id"], principal.UserId)
+	}
+}
+
+// DeleteAnyPostHandler elimina el post de cualquier usuario como si fuera el dueño, la ruta solo lo usa con los moderadores
+func DeleteAnyPostHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		post, err := repository.GetPostByID(r.Context(), id)
+		if err != nil {
+			writeRepositoryError(w, err)
 			return
 		}
+		deletePost(w, r, s, id, post.UserId)
+	}
+}
+
+// deletePost elimina el post de ownerId y avisa a los clientes,
+// si el post no existe o es de otro usuario se responde 404 o 403 y no se avisa a los clientes
+func deletePost(w http.ResponseWriter, r *http.Request, s server.Server, id string, ownerId string) {
+	if err := repository.DeletePost(r.Context(), id, ownerId); err != nil {
+		writeRepositoryError(w, err)
+		return
 	}
+	s.Hub().Publish(models.WebsocketMessage{
+		Type:    models.EVENT_POST_DELETED,
+		Payload: models.PostDeleted{Id: id, UserId: ownerId},
+	}, websocket.TOPIC_POSTS, websocket.UserTopic(ownerId), websocket.PostTopic(id))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PostDeletedResponse{
+		Message: "Post deleted",
+	})
 }
 
 func UpdatePostByIdHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		params := mux.Vars(r)
-		tokenString := strings.TrimSpace(r.Header.Get("Authorization"))
-		token, err := jwt.ParseWithClaims(tokenString, &models.AppClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(s.Config().JWTSecret), nil
-		})
+		// el usuario autenticado lo deja el middleware en el contexto
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		var postRequest = UpsertPostRequest{}
+		err := json.NewDecoder(r.Body).Decode(&postRequest)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if claims, ok := token.Claims.(*models.AppClaims); ok && token.Valid {
-			var postRequest = UpsertPostRequest{}
-			err := json.NewDecoder(r.Body).Decode(&postRequest)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			post := models.Post{
-				PostContent: postRequest.PostContent,
-				Id:          params["id"],
-			}
-			err = repository.UpdatePost(r.Context(), &post, claims.UserId)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(PostDeletedResponse{
-				Message: "Post Update",
-			})
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		post := models.Post{
+			PostContent: postRequest.PostContent,
+			Id:          params["id"],
+		}
+		// si el post no existe o es de otro usuario se responde 404 o 403 y no se avisa a los clientes,
+		// si se editó post queda con la fila guardada y eso es lo que reciben los clientes
+		err = repository.UpdatePost(r.Context(), &post, principal.UserId)
+		if err != nil {
+			writeRepositoryError(w, err)
 			return
 		}
+		s.Hub().Publish(models.WebsocketMessage{
+			Type:    models.EVENT_POST_UPDATED,
+			Payload: post,
+		}, websocket.TOPIC_POSTS, websocket.UserTopic(post.UserId), websocket.PostTopic(post.Id))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(PostDeletedResponse{
+			Message: "Post Update",
+		})
 	}
 }
 
@@ -178,7 +180,7 @@ func ListPostHandler(s server.Server) http.HandlerFunc {
 		}
 		posts, err := repository.ListPost(r.Context(), page)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeRepositoryError(w, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/repository"
+	"platzi.com/go/rest-ws/server"
+)
+
+// largo máximo del user agent que se guarda, el cliente lo puede mandar tan largo como quiera
+const SESSION_USER_AGENT_MAX = 512
+
+// la sesión con la que se hizo la petición viene marcada como current
+type SessionResponse struct {
+	*models.Session
+	Current bool `json:"current"`
+}
+
+type SessionRevokedResponse struct {
+	Message string `json:"message"`
+}
+
+// startSession guarda la sesión del login con el dispositivo y la ip de la petición y entrega sus primeros tokens,
+// el id de la sesión es la familia de los refresh tokens
+func startSession(r *http.Request, s server.Server, user *models.User) (*LoginResponse, error) {
+	// Postgres rechaza los textos que no son UTF-8 válido, el header puede traer cualquier byte
+	userAgent := strings.ToValidUTF8(r.UserAgent(), "\uFFFD")
+	if len(userAgent) > SESSION_USER_AGENT_MAX {
+		// se corta al inicio de un caracter para no partir uno de varios bytes
+		end := SESSION_USER_AGENT_MAX
+		for end > 0 && !utf8.RuneStart(userAgent[end]) {
+			end--
+		}
+		userAgent = userAgent[:end]
+	}
+	session := &models.Session{
+		Id:        ksuid.New().String(),
+		UserId:    user.Id,
+		Device:    deviceName(userAgent),
+		UserAgent: userAgent,
+		IP:        clientIP(s, r),
+		ExpiresAt: time.Now().Add(s.Config().RefreshTokenTTL),
+	}
+	if err := repository.InsertSession(r.Context(), session); err != nil {
+		return nil, err
+	}
+	return issueTokens(r.Context(), s, user, session.Id)
+}
+
+// revokeSession termina la sesión: revoca sus refresh tokens y sus access tokens y cierra sus websockets,
+// devuelve ErrNotFound si la sesión no existe o ErrForbidden si es de otro usuario
+func revokeSession(ctx context.Context, s server.Server, userId string, sessionId string) error {
+	if err := repository.RevokeSession(ctx, sessionId, userId); err != nil {
+		return err
+	}
+	if err := repository.RevokeRefreshTokenFamily(ctx, sessionId); err != nil {
+		return err
+	}
+	// los access tokens de la sesión que ya se entregaron vencen a más tardar en AccessTokenTTL
+	if err := s.Revocations().RevokeSession(ctx, userId, sessionId, time.Now().Add(s.Config().AccessTokenTTL)); err != nil {
+		return err
+	}
+	s.Hub().DisconnectSession(sessionId)
+	return nil
+}
+
+// ListSessionsHandler devuelve las sesiones activas del usuario
+func ListSessionsHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		sessions, err := repository.ListSessions(r.Context(), principal.UserId)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		response := []SessionResponse{}
+		for _, session := range sessions {
+			response = append(response, SessionResponse{Session: session, Current: session.Id == principal.SessionId})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// RevokeSessionHandler cierra una sesión del usuario, si no existe o es de otro usuario se responde 404 o 403
+func RevokeSessionHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		if err := revokeSession(r.Context(), s, principal.UserId, mux.Vars(r)["id"]); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SessionRevokedResponse{Message: "Session revoked"})
+	}
+}
+
+// touchSession guarda la ip y la hora del refresh, las familias creadas antes de guardar sesiones no tienen sesión y se ignoran
+func touchSession(r *http.Request, s server.Server, sessionId string) error {
+	now := time.Now()
+	err := repository.TouchSession(r.Context(), sessionId, clientIP(s, r), now, now.Add(s.Config().RefreshTokenTTL))
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// deviceName arma un nombre legible del dispositivo a partir del user agent (ej: Chrome on Windows),
+// si no es un navegador conocido devuelve el primer producto del user agent (ej: curl)
+func deviceName(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+	var browser string
+	// el orden importa: Edge y Opera también dicen Chrome, y Chrome también dice Safari
+	for _, known := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+	} {
+		if strings.Contains(userAgent, known.token) {
+			browser = known.name
+			break
+		}
+	}
+	var system string
+	for _, known := range []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, known.token) {
+			system = known.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	product, _, _ := strings.Cut(userAgent, " ")
+	product, _, _ = strings.Cut(product, "/")
+	return product
+}
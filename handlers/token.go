@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"platzi.com/go/rest-ws/auth"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/repository"
+	"platzi.com/go/rest-ws/server"
+)
+
+// también es el body opcional de /logout, si viene se revoca ese refresh token junto con el access token
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type LogoutResponse struct {
+	Message string `json:"message"`
+}
+
+// issueTokens crea el access token del usuario y un refresh token nuevo dentro de la familia, la familia es la sesión que nace en el login
+func issueTokens(ctx context.Context, s server.Server, user *models.User, familyId string) (*LoginResponse, error) {
+	tokenString, expiresAt, err := s.Issuer().IssueAccessToken(user, familyId)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, hash, err := auth.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	err = repository.InsertRefreshToken(ctx, &models.RefreshToken{
+		Id:        ksuid.New().String(),
+		UserId:    user.Id,
+		FamilyId:  familyId,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(s.Config().RefreshTokenTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResponse{
+		Token:        tokenString,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt,
+	}, nil
+}
+
+// RefreshTokenHandler cambia un refresh token por un access token y un refresh token nuevos, el refresh token que se usó ya no sirve,
+// si alguien presenta un refresh token ya usado es porque se lo robaron, entonces se revoca toda la familia y el usuario debe volver a hacer login
+func RefreshTokenHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request = RefreshTokenRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stored, err := repository.GetRefreshTokenByHash(r.Context(), auth.HashToken(request.RefreshToken))
+		if errors.Is(err, repository.ErrNotFound) {
+			http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		if stored.RevokedAt != nil || time.Now().After(stored.ExpiresAt) {
+			http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		if stored.UsedAt != nil {
+			revokeFamily(w, r, s, stored)
+			return
+		}
+		// si otro refresh usó el token entre la lectura y este punto, también es un reuso
+		err = repository.UseRefreshToken(r.Context(), stored.Id)
+		if errors.Is(err, repository.ErrConflict) {
+			revokeFamily(w, r, s, stored)
+			return
+		}
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		user, err := repository.GetUserByID(r.Context(), stored.UserId)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		response, err := issueTokens(r.Context(), s, user, stored.FamilyId)
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		if err = touchSession(r, s, stored.FamilyId); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// revokeFamily cierra la sesión del token reusado, con todos los refresh tokens que salieron del mismo login, y responde 401
+func revokeFamily(w http.ResponseWriter, r *http.Request, s server.Server, reused *models.RefreshToken) {
+	log.Printf("refresh token %s of user %s was reused, revoking family %s", reused.Id, reused.UserId, reused.FamilyId)
+	err := revokeSession(r.Context(), s, reused.UserId, reused.FamilyId)
+	// las familias creadas antes de guardar sesiones no tienen sesión
+	if errors.Is(err, repository.ErrNotFound) {
+		err = repository.RevokeRefreshTokenFamily(r.Context(), reused.FamilyId)
+	}
+	if err != nil {
+		writeRepositoryError(w, err)
+		return
+	}
+	http.Error(w, "refresh token already used", http.StatusUnauthorized)
+}
+
+// LogoutHandler revoca el access token con el que se hizo la petición y cierra su sesión, si viene un refresh token en el body también se revoca su familia
+func LogoutHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		var request = RefreshTokenRequest{}
+		// el body es opcional
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.Revocations().RevokeToken(r.Context(), principal); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		// los tokens creados antes de guardar sesiones no traen sid o su sesión no existe
+		if principal.SessionId != "" {
+			if err := revokeSession(r.Context(), s, principal.UserId, principal.SessionId); err != nil && !errors.Is(err, repository.ErrNotFound) {
+				writeRepositoryError(w, err)
+				return
+			}
+		}
+		if request.RefreshToken != "" {
+			stored, err := repository.GetRefreshTokenByHash(r.Context(), auth.HashToken(request.RefreshToken))
+			if err != nil && !errors.Is(err, repository.ErrNotFound) {
+				writeRepositoryError(w, err)
+				return
+			}
+			// solo se revoca si el refresh token es del mismo usuario
+			if err == nil && stored.UserId == principal.UserId {
+				if err = repository.RevokeRefreshTokenFamily(r.Context(), stored.FamilyId); err != nil {
+					writeRepositoryError(w, err)
+					return
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(LogoutResponse{Message: "Logged out"})
+	}
+}
+
+// LogoutAllHandler cierra todas las sesiones del usuario: revoca todos sus access y refresh tokens y cierra sus websockets
+func LogoutAllHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		if err := revokeUserSessions(r.Context(), s, principal.UserId); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(LogoutResponse{Message: "Logged out of all sessions"})
+	}
+}
+
+// revokeUserSessions revoca todas las sesiones del usuario con sus access y refresh tokens y cierra sus websockets, lo usan el logout
+// de todas las sesiones y el cambio de password
+func revokeUserSessions(ctx context.Context, s server.Server, userId string) error {
+	if err := s.Revocations().RevokeUser(ctx, userId); err != nil {
+		return err
+	}
+	if err := repository.RevokeUserRefreshTokens(ctx, userId); err != nil {
+		return err
+	}
+	if err := repository.RevokeUserSessions(ctx, userId); err != nil {
+		return err
+	}
+	s.Hub().DisconnectUser(userId)
+	return nil
+}
+
+// JWKSHandler publica las llaves públicas con las que otros servicios pueden validar nuestros tokens sin conocer ningún secret
+func JWKSHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(s.Keys().JWKS())
+	}
+}
@@ -1,33 +1,34 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"strings"
+	netmail "net/mail"
+	"strconv"
 	"time"
 
-	"github.com/golang-jwt/jwt"
 	"github.com/segmentio/ksuid"
-	"golang.org/x/crypto/bcrypt"
+	"platzi.com/go/rest-ws/auth"
 	"platzi.com/go/rest-ws/models"
 	"platzi.com/go/rest-ws/repository"
 	"platzi.com/go/rest-ws/server"
 )
 
-const (
-	HASH_COST = 8
-)
-
 // Lo que se espera devolver
 type SignUpResponse struct {
 	ID    string `json:"id"`
 	Email string `json:"email"`
 }
 
-// se envia token de tipo string que cuando se pase a json se llamará token
+// se envia token de tipo string que cuando se pase a json se llamará token, es el access token que vence en expiresAt,
+// cuando vence se pide otro en /token/refresh con el refreshToken
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refreshToken"`
+	ExpiresAt    time.Time `json:"expiresAt"`
 }
 
 // Tipo de request que se espera para que el usuario se pueda registrar
@@ -48,8 +49,17 @@ func SignUpHandler(s server.Server) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		// función para generar password hashed:
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(request.Password), HASH_COST) // HASH_COST es cuantas veces va a estar pasando el algoritmo, si no pusieramos, por defecto se debería poner bcrypt.DefaultCost
+		// el email tiene que ser una dirección válida porque se le envía el enlace de verificación
+		if address, err := netmail.ParseAddress(request.Email); err != nil || address.Address != request.Email {
+			http.Error(w, "invalid email", http.StatusBadRequest)
+			return
+		}
+		if err = s.Config().PasswordPolicy.Validate(request.Password, request.Email); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// función para generar password hashed, el algoritmo y sus parámetros salen de la configuración:
+		hashedPassword, err := s.Passwords().Hash(request.Password)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -64,16 +74,22 @@ func SignUpHandler(s server.Server) http.HandlerFunc {
 		// si no hay errores, crear variable del usuario:
 		var user = models.User{
 			Email:    request.Email,
-			Password: string(hashedPassword),
+			Password: hashedPassword,
 			Id:       id.String(),
+			Roles:    []string{models.ROLE_USER}, // los roles de moderador o admin los asigna un admin
+			Verified: false,                      // hasta que abra el enlace que le llega por correo
 		}
 		// Insertar el usuario a la db usando el repository
 		err = repository.InsertUser(r.Context(), &user)
 		if err != nil {
-			// Si hay error, responder un 500 con http.StatusInternalServerError
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			// Si hay error, responder según el error del repository, por ejemplo un 409 si el email ya está registrado
+			writeRepositoryError(w, err)
 			return
 		}
+		// si el correo no sale el usuario ya quedó creado, se registra el error y se responde igual
+		if err = sendVerificationEmail(r.Context(), s, &user); err != nil {
+			log.Println("error sending verification email:", err)
+		}
 		// pasar el header de tipo application/json
 		w.Header().Set("Content-Type", "application/json")
 		// enviar la respuesta codificada:
@@ -94,74 +110,126 @@ func LoginHandler(s server.Server) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		user, err := repository.GetUserByEmail(r.Context(), request.Email)
+		ip := clientIP(s, r)
+		// si la cuenta o la ip tienen demasiados fallos recientes no se revisa el password
+		wait, err := s.LoginThrottle().Check(r.Context(), request.Email, ip)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeRepositoryError(w, err)
 			return
 		}
+		if wait > 0 {
+			writeTooManyAttempts(w, wait)
+			return
+		}
+		user, err := repository.GetUserByEmail(r.Context(), request.Email)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			writeRepositoryError(w, err)
+			return
+		}
+		// si el email no existe se calcula igual un hash para que la respuesta tarde lo mismo
 		if user == nil {
-			http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
+			s.Passwords().Hash(request.Password)
+			loginFailed(w, r, s, request.Email, ip)
 			return
 		}
 		// Comparar lo que está almacenado en la db con lo que se está pasando por el usuario:
-		log.Println(user.Password)
-		if err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(request.Password)); err != nil {
-			log.Println(err)
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
-		}
-		// Crear claim en el que se va a pasar el userId, y de StandardClaims pasar el parámetro de cuanto tiempo durará el token:
-		claims := models.AppClaims{
-			UserId: user.Id,
-			StandardClaims: jwt.StandardClaims{
-				ExpiresAt: time.Now().Add(2 * time.Hour * 24).Unix(), // token que dure 2 días
-			},
-		}
-		// creación de token con parámetro algoritmo de firmado HS256
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		// creación de string a partir del token usando el secret que se pasa en la configuración
-		tokenString, err := token.SignedString([]byte(s.Config().JWTSecret))
+		needsRehash, err := s.Passwords().Verify(request.Password, user.Password)
+		if errors.Is(err, auth.ErrPasswordMismatch) {
+			loginFailed(w, r, s, request.Email, ip)
+			return
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println("error verifying password:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		// el hash se creó con otro algoritmo o con parámetros anteriores, se reemplaza ahora que se conoce el password
+		if needsRehash {
+			rehashPassword(r.Context(), s, user, request.Password)
+		}
+		if err = s.LoginThrottle().Success(r.Context(), request.Email); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		if s.Config().RequireVerifiedEmail && !user.Verified {
+			http.Error(w, "email not verified", http.StatusForbidden)
+			return
+		}
+		// con TOTP activo el login tiene dos pasos, aquí solo se entrega el token mfa_pending para /login/mfa
+		totp, err := repository.GetTOTP(r.Context(), user.Id)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			writeRepositoryError(w, err)
+			return
+		}
+		if err == nil && totp.Enabled {
+			writeMFARequired(w, s, user)
+			return
+		}
+		// guardar la sesión y crear el access token y el primer refresh token de la familia de la sesión
+		response, err := startSession(r, s, user)
+		if err != nil {
+			writeRepositoryError(w, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		// pasar en la structura de LoginResponse el token
-		json.NewEncoder(w).Encode(LoginResponse{
-			Token: tokenString,
-		})
+		// pasar en la structura de LoginResponse los tokens
+		json.NewEncoder(w).Encode(response)
+
+	}
+}
 
+// rehashPassword guarda el password con el hasher actual, si falla el login sigue y se intenta de nuevo en el siguiente login
+func rehashPassword(ctx context.Context, s server.Server, user *models.User, password string) {
+	hashedPassword, err := s.Passwords().Hash(password)
+	if err == nil {
+		err = repository.UpdateUserPassword(ctx, user.Id, hashedPassword)
+	}
+	if err != nil {
+		log.Printf("error rehashing password of user %s: %v", user.Id, err)
 	}
 }
 
+// loginFailed registra el intento fallido y responde 401, igual si el email no existe o si el password no coincide,
+// si con este fallo ya hay que esperar se indica en Retry-After
+func loginFailed(w http.ResponseWriter, r *http.Request, s server.Server, email string, ip string) {
+	wait, err := s.LoginThrottle().Failure(r.Context(), email, ip)
+	if err != nil {
+		writeRepositoryError(w, err)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+	}
+	http.Error(w, "invalid credentials", http.StatusUnauthorized)
+}
+
+// writeTooManyAttempts responde 429 con los segundos que hay que esperar en Retry-After
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", retryAfterSeconds(wait))
+	http.Error(w, "too many failed attempts, try again later", http.StatusTooManyRequests)
+}
+
+// retryAfterSeconds redondea hacia arriba, un Retry-After de 0 haría que el cliente reintente antes de tiempo
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10)
+}
+
 // handler para recibir un token, decodificarlo, validarlo y devolver la data del usuario registrado con ese token
 func MeHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Obtener el token:
-		tokenString := strings.TrimSpace(r.Header.Get("Authorization"))
-		// validar el token
-		token, err := jwt.ParseWithClaims(tokenString, &models.AppClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(s.Config().JWTSecret), nil
-		})
-		// Si hay un error:
+		// el middleware ya validó el token y dejó el usuario autenticado en el contexto
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		// Devolver el usuario:
+		user, err := repository.GetUserByID(r.Context(), principal.UserId)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
-		}
-		// crear variable llamada claim para devolver un modelo como el definido en models/claims.go
-		if claims, ok := token.Claims.(*models.AppClaims); ok && token.Valid {
-			// Devolver el usuario:
-			user, err := repository.GetUserByID(r.Context(), claims.UserId)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			// Si no hay error:
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(user)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeRepositoryError(w, err)
 			return
 		}
+		// Si no hay error:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
 	}
 }
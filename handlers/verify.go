@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"platzi.com/go/rest-ws/auth"
+	"platzi.com/go/rest-ws/mail"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/repository"
+	"platzi.com/go/rest-ws/server"
+)
+
+// tiempo que sirve el enlace de verificación que se envía al registrarse
+const VERIFY_EMAIL_TOKEN_TTL = 24 * time.Hour
+
+type VerifyEmailResponse struct {
+	Message string `json:"message"`
+}
+
+// sendVerificationEmail envía al usuario el enlace con el token firmado para verificar su email
+func sendVerificationEmail(ctx context.Context, s server.Server, user *models.User) error {
+	token, err := s.Issuer().IssuePurposeToken(user.Id, auth.PURPOSE_VERIFY_EMAIL, VERIFY_EMAIL_TOKEN_TTL)
+	if err != nil {
+		return err
+	}
+	link := s.Config().PublicURL + "/verify?token=" + url.QueryEscape(token)
+	return s.Mailer().Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body:    fmt.Sprintf("Open this link to verify your email, it expires in %s:\n\n%s\n", VERIFY_EMAIL_TOKEN_TTL, link),
+	})
+}
+
+// VerifyEmailHandler activa la cuenta con el token del enlace que llegó por correo, el token solo se puede usar una vez:
+// su jti se guarda como revocado hasta que vence
+func VerifyEmailHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := s.Issuer().ParsePurposeToken(r.URL.Query().Get("token"), auth.PURPOSE_VERIFY_EMAIL)
+		if err != nil {
+			http.Error(w, "invalid verification token", http.StatusBadRequest)
+			return
+		}
+		// se guarda el jti antes de verificar, si dos peticiones usan el mismo enlace a la vez solo una lo consigue
+		err = repository.ConsumeToken(r.Context(), &models.RevokedToken{
+			Id:        claims.Id,
+			UserId:    claims.UserId,
+			ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+		})
+		if errors.Is(err, repository.ErrConflict) {
+			http.Error(w, "verification token already used", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		if err = repository.MarkUserVerified(r.Context(), claims.UserId); err != nil {
+			writeRepositoryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(VerifyEmailResponse{Message: "email verified"})
+	}
+}
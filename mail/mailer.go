@@ -0,0 +1,97 @@
+// Package mail envía los correos de la aplicación (verificación de email, recuperar password, etc) a través de un Mailer,
+// así en desarrollo se escriben en la consola o en archivos y en producción se envían por SMTP
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// Message es un correo de texto plano
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer envía los correos, la implementación se elige con la configuración
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// Config elige el mailer: "console" (por defecto), "file" (escribe cada correo en Dir) o "smtp"
+type Config struct {
+	Mailer       string
+	From         string
+	Dir          string
+	SMTPAddr     string // host:puerto
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// NewMailer crea el mailer de la configuración
+func NewMailer(config Config) (Mailer, error) {
+	switch config.Mailer {
+	case "", "console":
+		return ConsoleMailer{}, nil
+	case "file":
+		if config.Dir == "" {
+			return nil, errors.New("mail dir is required")
+		}
+		return &FileMailer{Dir: config.Dir, From: config.From}, nil
+	case "smtp":
+		if config.SMTPAddr == "" || config.From == "" {
+			return nil, errors.New("smtp addr and mail from are required")
+		}
+		return NewSMTPMailer(config.SMTPAddr, config.From, config.SMTPUsername, config.SMTPPassword), nil
+	default:
+		return nil, fmt.Errorf("invalid mailer %q, must be console, file or smtp", config.Mailer)
+	}
+}
+
+// ConsoleMailer escribe los correos en el log, para desarrollar sin servidor de correo
+type ConsoleMailer struct{}
+
+func (ConsoleMailer) Send(ctx context.Context, message Message) error {
+	log.Printf("mail to %s: %s\n%s", message.To, message.Subject, message.Body)
+	return nil
+}
+
+// FileMailer escribe cada correo en un archivo .eml del directorio
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(ctx context.Context, message Message) error {
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	file := filepath.Join(m.Dir, time.Now().Format("20060102T150405")+"-"+ksuid.New().String()+".eml")
+	return os.WriteFile(file, format(m.From, message), 0o644)
+}
+
+// format arma el correo con sus headers, en el formato que espera SMTP (líneas terminadas en \r\n)
+func format(from string, message Message) []byte {
+	var b strings.Builder
+	if from != "" {
+		fmt.Fprintf(&b, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", message.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", message.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(message.Body, "\r\n", "\n"), "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,126 @@
+// Package mailtest tiene un servidor SMTP falso que guarda los correos que recibe, sirve para probar el SMTPMailer sin un servidor real:
+//
+//	server, _ := mailtest.NewServer()
+//	defer server.Close()
+//	mailer := mail.NewSMTPMailer(server.Addr, "app@example.com", "", "")
+package mailtest
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Received es un correo que recibió el servidor, Data es el correo completo con sus headers
+type Received struct {
+	From string
+	To   []string
+	Data string
+}
+
+// Server es un servidor SMTP mínimo (HELO/EHLO, MAIL, RCPT, DATA, RSET, NOOP, QUIT) que escucha en localhost
+type Server struct {
+	Addr     string
+	listener net.Listener
+	mutex    sync.Mutex
+	messages []Received
+	wg       sync.WaitGroup
+}
+
+// NewServer empieza a escuchar en un puerto libre de localhost
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{Addr: listener.Addr().String(), listener: listener}
+	server.wg.Add(1)
+	go server.accept()
+	return server, nil
+}
+
+// Messages devuelve los correos recibidos hasta ahora
+func (s *Server) Messages() []Received {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Received(nil), s.messages...)
+}
+
+// Close deja de escuchar y espera a que terminen las conexiones abiertas
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.serve(textproto.NewConn(conn))
+		}()
+	}
+}
+
+// serve atiende una conexión, cada correo termina con DATA y se guarda en messages
+func (s *Server) serve(conn *textproto.Conn) {
+	conn.PrintfLine("220 localhost fake smtp")
+	var current Received
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(command) {
+		case "HELO", "EHLO":
+			conn.PrintfLine("250 localhost")
+		case "MAIL":
+			current = Received{From: address(arg)}
+			conn.PrintfLine("250 OK")
+		case "RCPT":
+			current.To = append(current.To, address(arg))
+			conn.PrintfLine("250 OK")
+		case "DATA":
+			conn.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := conn.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			current.Data = string(data)
+			s.mutex.Lock()
+			s.messages = append(s.messages, current)
+			s.mutex.Unlock()
+			current = Received{}
+			conn.PrintfLine("250 OK")
+		case "RSET":
+			current = Received{}
+			conn.PrintfLine("250 OK")
+		case "NOOP":
+			conn.PrintfLine("250 OK")
+		case "QUIT":
+			conn.PrintfLine("221 bye")
+			return
+		default:
+			conn.PrintfLine("502 %s not implemented", command)
+		}
+	}
+}
+
+// address saca el correo de "FROM:<a@b.c>" o "TO:<a@b.c>"
+func address(arg string) string {
+	_, value, _ := strings.Cut(arg, ":")
+	value = strings.TrimSpace(value)
+	if i := strings.Index(value, ">"); i >= 0 {
+		value = value[:i+1]
+	}
+	return strings.Trim(value, "<>")
+}
@@ -0,0 +1,31 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+)
+
+// SMTPMailer envía los correos a un servidor SMTP, si tiene usuario se autentica con PLAIN (smtp.PlainAuth solo lo permite con TLS o en localhost)
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTPMailer(addr string, from string, username string, password string) *SMTPMailer {
+	mailer := &SMTPMailer{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, message Message) error {
+	// smtp.SendMail no recibe contexto, si ya se canceló no se intenta enviar
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{message.To}, format(m.from, message))
+}
@@ -2,14 +2,22 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"platzi.com/go/rest-ws/auth"
 	"platzi.com/go/rest-ws/handlers"
+	"platzi.com/go/rest-ws/mail"
 	"platzi.com/go/rest-ws/middleware"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/oidc"
 	"platzi.com/go/rest-ws/server"
 )
 
@@ -23,13 +31,105 @@ func main() {
 	// Cargar los parámetros definidos en el archovo de entorno:
 	PORT := os.Getenv("PORT")
 	JWT_SECRET := os.Getenv("JWT_SECRET")
+	// para firmar con RS256/EdDSA en lugar de HS256: directorio con las llaves <kid>.pem, kid de la llave activa y hasta cuándo validan
+	// las anteriores (ej: JWT_KEYS_NOT_AFTER=2022-09=2022-10-02T00:00:00Z), al dejar JWT_SECRET se puede pasar como JWT_PREVIOUS_SECRET
+	// con JWT_PREVIOUS_SECRET_NOT_AFTER para que los tokens HS256 ya emitidos sigan valiendo hasta esa fecha
+	JWT_KEYS_DIR := os.Getenv("JWT_KEYS_DIR")
+	JWT_SIGNING_KEY := os.Getenv("JWT_SIGNING_KEY")
+	JWT_KEYS_NOT_AFTER, err := keysNotAfterFromEnv(os.Getenv("JWT_KEYS_NOT_AFTER"))
+	if err != nil {
+		log.Fatalf("Error parsing JWT_KEYS_NOT_AFTER %v\n", err)
+	}
+	JWT_PREVIOUS_SECRET := os.Getenv("JWT_PREVIOUS_SECRET")
+	JWT_PREVIOUS_SECRET_NOT_AFTER, err := notAfterFromEnv(os.Getenv("JWT_PREVIOUS_SECRET_NOT_AFTER"))
+	if err != nil {
+		log.Fatalf("Error parsing JWT_PREVIOUS_SECRET_NOT_AFTER %v\n", err)
+	}
 	DATABASE_URL := os.Getenv("DATABASE_URL")
+	// parámetros opcionales de las colas del websocket, si no vienen se usan los valores por defecto del hub:
+	WS_QUEUE_SIZE, _ := strconv.Atoi(os.Getenv("WS_QUEUE_SIZE"))
+	WS_OVERFLOW_POLICY := os.Getenv("WS_OVERFLOW_POLICY")
+	WS_HISTORY_SIZE, _ := strconv.Atoi(os.Getenv("WS_HISTORY_SIZE"))
+	// con varias instancias del servidor se usa BACKPLANE=postgres para que los mensajes del websocket lleguen a todas:
+	BACKPLANE := os.Getenv("BACKPLANE")
+	// duración de los tokens, ej: ACCESS_TOKEN_TTL=15m y REFRESH_TOKEN_TTL=720h, vacías usan los valores por defecto
+	ACCESS_TOKEN_TTL, _ := time.ParseDuration(os.Getenv("ACCESS_TOKEN_TTL"))
+	REFRESH_TOKEN_TTL, _ := time.ParseDuration(os.Getenv("REFRESH_TOKEN_TTL"))
+	// correos: MAILER=console|file|smtp, con file se escriben en MAIL_DIR y con smtp se envían a SMTP_ADDR (host:puerto)
+	MAILER := os.Getenv("MAILER")
+	MAIL_FROM := os.Getenv("MAIL_FROM")
+	MAIL_DIR := os.Getenv("MAIL_DIR")
+	SMTP_ADDR := os.Getenv("SMTP_ADDR")
+	SMTP_USERNAME := os.Getenv("SMTP_USERNAME")
+	SMTP_PASSWORD := os.Getenv("SMTP_PASSWORD")
+	// url pública del API para los enlaces de los correos, ej: https://api.example.com
+	PUBLIC_URL := os.Getenv("PUBLIC_URL")
+	// con REQUIRE_VERIFIED_EMAIL=true solo pueden hacer login los usuarios que verificaron su email
+	REQUIRE_VERIFIED_EMAIL, _ := strconv.ParseBool(os.Getenv("REQUIRE_VERIFIED_EMAIL"))
+	// nombre con el que aparece la cuenta en las apps de autenticación (TOTP)
+	TOTP_ISSUER := os.Getenv("TOTP_ISSUER")
+	// con varias instancias se usa LOGIN_ATTEMPTS=repository para que los logins fallidos se cuenten en la db,
+	// TRUST_PROXY_HEADERS=true toma la ip del cliente de X-Forwarded-For (solo detrás de un proxy)
+	LOGIN_ATTEMPTS := os.Getenv("LOGIN_ATTEMPTS")
+	TRUST_PROXY_HEADERS, _ := strconv.ParseBool(os.Getenv("TRUST_PROXY_HEADERS"))
+	// hashes de los passwords: PASSWORD_HASH=argon2id|bcrypt y sus parámetros, vacíos usan los valores por defecto,
+	// los hashes del otro algoritmo o con otros parámetros se reemplazan en el siguiente login
+	PASSWORD_HASH := os.Getenv("PASSWORD_HASH")
+	BCRYPT_COST, _ := strconv.Atoi(os.Getenv("BCRYPT_COST"))
+	ARGON2_TIME, _ := strconv.ParseUint(os.Getenv("ARGON2_TIME"), 10, 32)
+	ARGON2_MEMORY, _ := strconv.ParseUint(os.Getenv("ARGON2_MEMORY"), 10, 32) // KiB
+	ARGON2_THREADS, _ := strconv.ParseUint(os.Getenv("ARGON2_THREADS"), 10, 8)
+	PASSWORD_MIN_LENGTH, _ := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH"))
+	// proveedores de login externos separados por coma, ej: OIDC_PROVIDERS=google con OIDC_GOOGLE_ISSUER, OIDC_GOOGLE_CLIENT_ID,
+	// OIDC_GOOGLE_CLIENT_SECRET y opcionales OIDC_GOOGLE_SCOPES (separados por espacio) y OIDC_GOOGLE_REDIRECT_URL
+	OIDC_PROVIDERS := oidcProvidersFromEnv(os.Getenv("OIDC_PROVIDERS"))
+
+	// el mismo binario aplica las migraciones de la db: migrate up|down|status
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(context.Background(), DATABASE_URL, os.Args[2:]); err != nil {
+			log.Fatalf("Error running migrations %v\n", err)
+		}
+		return
+	}
 
 	// Crear nuevo servidor, en el que se pasa el context y la configuarción:
 	s, err := server.NewServer(context.Background(), &server.Config{
-		Port:        PORT,
-		JWTSecret:   JWT_SECRET,
-		DatabaseUrl: DATABASE_URL,
+		Port:                      PORT,
+		JWTSecret:                 JWT_SECRET,
+		JWTKeysDir:                JWT_KEYS_DIR,
+		JWTSigningKey:             JWT_SIGNING_KEY,
+		JWTKeysNotAfter:           JWT_KEYS_NOT_AFTER,
+		JWTPreviousSecret:         JWT_PREVIOUS_SECRET,
+		JWTPreviousSecretNotAfter: JWT_PREVIOUS_SECRET_NOT_AFTER,
+		DatabaseUrl:               DATABASE_URL,
+		WSQueueSize:               WS_QUEUE_SIZE,
+		WSOverflowPolicy:          WS_OVERFLOW_POLICY,
+		WSHistorySize:             WS_HISTORY_SIZE,
+		Backplane:                 BACKPLANE,
+		AccessTokenTTL:            ACCESS_TOKEN_TTL,
+		RefreshTokenTTL:           REFRESH_TOKEN_TTL,
+		Mail: mail.Config{
+			Mailer:       MAILER,
+			From:         MAIL_FROM,
+			Dir:          MAIL_DIR,
+			SMTPAddr:     SMTP_ADDR,
+			SMTPUsername: SMTP_USERNAME,
+			SMTPPassword: SMTP_PASSWORD,
+		},
+		PublicURL:            PUBLIC_URL,
+		RequireVerifiedEmail: REQUIRE_VERIFIED_EMAIL,
+		TOTPIssuer:           TOTP_ISSUER,
+		LoginAttempts:        LOGIN_ATTEMPTS,
+		TrustProxyHeaders:    TRUST_PROXY_HEADERS,
+		PasswordHashing: auth.HashConfig{
+			Algorithm:     PASSWORD_HASH,
+			BcryptCost:    BCRYPT_COST,
+			Argon2Time:    uint32(ARGON2_TIME),
+			Argon2Memory:  uint32(ARGON2_MEMORY),
+			Argon2Threads: uint8(ARGON2_THREADS),
+		},
+		PasswordPolicy: auth.PasswordPolicy{MinLength: PASSWORD_MIN_LENGTH},
+		OIDCProviders:  OIDC_PROVIDERS,
 	})
 
 	// Como go no tiene manejo de Exepciones como tal, por eso siempre se juega con la variable de error:
@@ -51,11 +151,91 @@ func BindRoutes(s server.Server, r *mux.Router) {
 	r.HandleFunc("/", handlers.HomeHandler(s)).Methods(http.MethodGet)
 	r.HandleFunc("/signup", handlers.SignUpHandler(s)).Methods(http.MethodPost)
 	r.HandleFunc("/login", handlers.LoginHandler(s)).Methods(http.MethodPost)
+	r.HandleFunc("/login/mfa", handlers.LoginMFAHandler(s)).Methods(http.MethodPost)             // segundo paso del login con TOTP
+	r.HandleFunc("/auth/{provider}/login", handlers.OIDCLoginHandler(s)).Methods(http.MethodGet) // login con un proveedor externo (OpenID Connect)
+	r.HandleFunc("/auth/{provider}/callback", handlers.OIDCCallbackHandler(s)).Methods(http.MethodGet)
+	r.HandleFunc("/verify", handlers.VerifyEmailHandler(s)).Methods(http.MethodGet) // enlace que llega por correo al registrarse
+	r.HandleFunc("/password/forgot", handlers.ForgotPasswordHandler(s)).Methods(http.MethodPost)
+	r.HandleFunc("/password/reset", handlers.ResetPasswordHandler(s)).Methods(http.MethodPost)
+	r.HandleFunc("/.well-known/jwks.json", handlers.JWKSHandler(s)).Methods(http.MethodGet) // llaves públicas para validar los tokens
+	r.HandleFunc("/token/refresh", handlers.RefreshTokenHandler(s)).Methods(http.MethodPost)
 	api.HandleFunc("/me", handlers.MeHandler(s)).Methods(http.MethodGet)
-	api.HandleFunc("/posts", handlers.InsertPostHandler(s)).Methods(http.MethodPost)
+	api.HandleFunc("/logout", handlers.LogoutHandler(s)).Methods(http.MethodPost)
+	api.HandleFunc("/logout/all", handlers.LogoutAllHandler(s)).Methods(http.MethodPost)
+	api.HandleFunc("/sessions", handlers.ListSessionsHandler(s)).Methods(http.MethodGet)
+	api.HandleFunc("/sessions/{id}", handlers.RevokeSessionHandler(s)).Methods(http.MethodDelete)
+	api.HandleFunc("/mfa/totp", handlers.SetupTOTPHandler(s)).Methods(http.MethodPost)
+	api.HandleFunc("/mfa/totp/confirm", handlers.ConfirmTOTPHandler(s)).Methods(http.MethodPost)
+	api.HandleFunc("/mfa/totp", handlers.DisableTOTPHandler(s)).Methods(http.MethodDelete)
+	api.HandleFunc("/mfa/recovery-codes", handlers.RegenerateRecoveryCodesHandler(s)).Methods(http.MethodPost)
+	api.HandleFunc("/apikeys", handlers.CreateAPIKeyHandler(s)).Methods(http.MethodPost)
+	api.HandleFunc("/apikeys", handlers.ListAPIKeysHandler(s)).Methods(http.MethodGet)
+	api.HandleFunc("/apikeys/{id}", handlers.RevokeAPIKeyHandler(s)).Methods(http.MethodDelete)
+	// las rutas de api solo aceptan API keys si se declaran con AllowAPIKey y el scope que necesitan
+	middleware.AllowAPIKey(api.HandleFunc("/posts", handlers.InsertPostHandler(s)).Methods(http.MethodPost), models.SCOPE_POSTS_WRITE)
 	r.HandleFunc("/posts/{id}", handlers.GetPostByIDHandler(s)).Methods(http.MethodGet)
-	api.HandleFunc("/posts/{id}", handlers.UpdatePostByIdHandler(s)).Methods(http.MethodPut)
-	api.HandleFunc("/posts/{id}", handlers.DeletePostByIdHandler(s)).Methods(http.MethodDelete)
+	middleware.AllowAPIKey(api.HandleFunc("/posts/{id}", handlers.UpdatePostByIdHandler(s)).Methods(http.MethodPut), models.SCOPE_POSTS_WRITE)
+	// los moderadores pueden eliminar el post de cualquier usuario, los demás solo los suyos
+	moderator := middleware.AnyRole(models.ROLE_MODERATOR, models.ROLE_ADMIN)
+	deletePost := middleware.Either(moderator, handlers.DeleteAnyPostHandler(s), handlers.DeletePostByIdHandler(s))
+	middleware.AllowAPIKey(api.Handle("/posts/{id}", deletePost).Methods(http.MethodDelete), models.SCOPE_POSTS_WRITE)
 	r.HandleFunc("/posts", handlers.ListPostHandler(s)).Methods(http.MethodGet)
 	r.HandleFunc("/ws", s.Hub().HandleWebSocket)
+	r.HandleFunc("/events", s.Hub().HandleEvents).Methods(http.MethodGet) // alternativa a /ws con Server-Sent Events
+	// políticas por ruta: solo los admins administran a los usuarios y ven las métricas del hub, si no tienen el rol reciben un 403
+	admin := middleware.Authorize(middleware.AnyRole(models.ROLE_ADMIN))
+	api.Handle("/users", admin(handlers.ListUsersHandler(s))).Methods(http.MethodGet)
+	api.Handle("/users/{id}", admin(handlers.GetUserHandler(s))).Methods(http.MethodGet)
+	api.Handle("/users/{id}/roles", admin(handlers.UpdateUserRolesHandler(s))).Methods(http.MethodPut)
+	api.Handle("/ws/metrics", admin(handlers.HubMetricsHandler(s))).Methods(http.MethodGet) // contadores del hub, solo para los admins
+}
+
+// oidcProvidersFromEnv lee la configuración de cada proveedor de las variables OIDC_<NOMBRE>_*
+func oidcProvidersFromEnv(names string) []oidc.ProviderConfig {
+	var providers []oidc.ProviderConfig
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		providers = append(providers, oidc.ProviderConfig{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+		})
+	}
+	return providers
+}
+
+// keysNotAfterFromEnv lee las fechas de las llaves retiradas separadas por coma, ej: 2022-09=2022-10-02T00:00:00Z,2022-08=2022-09-01T00:00:00Z
+func keysNotAfterFromEnv(value string) (map[string]time.Time, error) {
+	notAfter := make(map[string]time.Time)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, date, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q, expected kid=date", entry)
+		}
+		parsed, err := notAfterFromEnv(date)
+		if err != nil {
+			return nil, err
+		}
+		notAfter[kid] = parsed
+	}
+	return notAfter, nil
+}
+
+// notAfterFromEnv lee una fecha RFC 3339, vacía devuelve cero
+func notAfterFromEnv(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
 }
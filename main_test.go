@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"platzi.com/go/rest-ws/database"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/repository"
+	"platzi.com/go/rest-ws/server"
+)
+
+const TEST_PASSWORD = "correct horse battery"
+
+// testAPI es el API completo con las rutas de BindRoutes sobre el repositorio en memoria
+type testAPI struct {
+	t      *testing.T
+	server *httptest.Server
+	broker *server.Broker
+	repo   *database.MemoryRepository
+}
+
+// newTestAPI arranca el API con la configuración indicada, si config es nil se usa una configuración mínima,
+// el servidor se crea antes que el broker para que PublicURL pueda apuntar a él
+func newTestAPI(t *testing.T, config *server.Config) *testAPI {
+	t.Helper()
+	if config == nil {
+		config = &server.Config{}
+	}
+	router := mux.NewRouter()
+	httpServer := httptest.NewServer(router)
+	config.Port = ":0"
+	config.DatabaseUrl = "memory://"
+	if config.JWTSecret == "" {
+		config.JWTSecret = "test-secret"
+	}
+	if config.PublicURL == "" {
+		config.PublicURL = httpServer.URL
+	}
+	repo := database.NewMemoryRepository()
+	repository.SetRepository(repo)
+	broker, err := server.NewServer(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	BindRoutes(broker, router)
+	go broker.Hub().Run()
+	t.Cleanup(func() {
+		httpServer.Close()
+		broker.Hub().Shutdown()
+	})
+	return &testAPI{t: t, server: httpServer, broker: broker, repo: repo}
+}
+
+// request hace la petición al API y devuelve el status y el body
+func (api *testAPI) request(method string, path string, token string, body interface{}) (int, string) {
+	api.t.Helper()
+	var payload io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, api.server.URL+path, payload)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(data)
+}
+
+// signup registra al usuario con TEST_PASSWORD y devuelve el usuario guardado
+func (api *testAPI) signup(email string) *models.User {
+	api.t.Helper()
+	if status, body := api.request(http.MethodPost, "/signup", "", map[string]string{"email": email, "password": TEST_PASSWORD}); status != http.StatusOK {
+		api.t.Fatalf("signup %s: %d %s", email, status, body)
+	}
+	user, err := api.repo.GetUserByEmail(context.Background(), email)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	return user
+}
+
+// login devuelve el access token del usuario
+func (api *testAPI) login(email string) string {
+	api.t.Helper()
+	status, body := api.request(http.MethodPost, "/login", "", map[string]string{"email": email, "password": TEST_PASSWORD})
+	if status != http.StatusOK {
+		api.t.Fatalf("login %s: %d %s", email, status, body)
+	}
+	var response struct{ Token string }
+	json.Unmarshal([]byte(body), &response)
+	return response.Token
+}
+
+// setRoles cambia los roles del usuario directamente en el repositorio, el usuario debe volver a hacer login
+func (api *testAPI) setRoles(user *models.User, roles ...string) {
+	api.t.Helper()
+	if err := api.repo.UpdateUserRoles(context.Background(), user.Id, roles); err != nil {
+		api.t.Fatal(err)
+	}
+}
+
+func TestHubMetricsRequiresAdmin(t *testing.T) {
+	api := newTestAPI(t, nil)
+	api.signup("user@example.com")
+	admin := api.signup("admin@example.com")
+	api.setRoles(admin, models.ROLE_USER, models.ROLE_ADMIN)
+
+	if status, _ := api.request(http.MethodGet, "/api/v1/ws/metrics", "", nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", status)
+	}
+	if status, _ := api.request(http.MethodGet, "/api/v1/ws/metrics", api.login("user@example.com"), nil); status != http.StatusForbidden {
+		t.Fatalf("expected 403 for a user, got %d", status)
+	}
+	if status, body := api.request(http.MethodGet, "/api/v1/ws/metrics", api.login("admin@example.com"), nil); status != http.StatusOK {
+		t.Fatalf("expected 200 for an admin, got %d %s", status, body)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"platzi.com/go/rest-ws/auth"
+)
+
+// enableTOTP activa el TOTP del usuario del token y devuelve el secret y los códigos de recuperación,
+// el código que lo confirma es el del paso actual
+func (api *testAPI) enableTOTP(token string) (string, []string) {
+	api.t.Helper()
+	status, body := api.request(http.MethodPost, "/api/v1/mfa/totp", token, nil)
+	if status != http.StatusOK {
+		api.t.Fatalf("setup totp: %d %s", status, body)
+	}
+	var setup struct{ Secret string }
+	json.Unmarshal([]byte(body), &setup)
+	status, body = api.request(http.MethodPost, "/api/v1/mfa/totp/confirm", token, map[string]string{"code": api.totpCode(setup.Secret, 0)})
+	if status != http.StatusOK {
+		api.t.Fatalf("confirm totp: %d %s", status, body)
+	}
+	var codes struct{ RecoveryCodes []string }
+	json.Unmarshal([]byte(body), &codes)
+	if len(codes.RecoveryCodes) != auth.RECOVERY_CODES {
+		api.t.Fatalf("expected %d recovery codes, got %d", auth.RECOVERY_CODES, len(codes.RecoveryCodes))
+	}
+	return setup.Secret, codes.RecoveryCodes
+}
+
+// totpCode devuelve el código del secret steps pasos después del actual
+func (api *testAPI) totpCode(secret string, steps int) string {
+	api.t.Helper()
+	code, err := auth.TOTPCode(secret, time.Now().Add(time.Duration(steps)*auth.TOTP_PERIOD*time.Second))
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	return code
+}
+
+// mfaToken hace el primer paso del login de un usuario con TOTP y devuelve el mfaToken
+func (api *testAPI) mfaToken(email string) string {
+	api.t.Helper()
+	status, body := api.request(http.MethodPost, "/login", "", map[string]string{"email": email, "password": TEST_PASSWORD})
+	var response struct {
+		MFARequired bool
+		MFAToken    string
+	}
+	json.Unmarshal([]byte(body), &response)
+	if status != http.StatusOK || !response.MFARequired {
+		api.t.Fatalf("expected mfaRequired from login, got %d %s", status, body)
+	}
+	return response.MFAToken
+}
+
+func TestLoginWithTOTP(t *testing.T) {
+	api := newTestAPI(t, nil)
+	api.signup("user@example.com")
+	secret, recovery := api.enableTOTP(api.login("user@example.com"))
+
+	mfaToken := api.mfaToken("user@example.com")
+	tests := []struct {
+		name     string
+		mfaToken string
+		code     string
+		status   int
+	}{
+		{"wrong code", mfaToken, "123-wrong", http.StatusUnauthorized},
+		{"code that confirmed the totp", mfaToken, api.totpCode(secret, 0), http.StatusUnauthorized},
+		{"next code", mfaToken, api.totpCode(secret, 1), http.StatusOK},
+		{"used mfa token", mfaToken, api.totpCode(secret, 1), http.StatusUnauthorized},
+		{"reused code", api.mfaToken("user@example.com"), api.totpCode(secret, 1), http.StatusUnauthorized},
+		{"recovery code", api.mfaToken("user@example.com"), recovery[0], http.StatusOK},
+		{"used recovery code", api.mfaToken("user@example.com"), recovery[0], http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		status, body := api.request(http.MethodPost, "/login/mfa", "", map[string]string{"mfaToken": tc.mfaToken, "code": tc.code})
+		if status != tc.status {
+			t.Fatalf("%s: expected %d, got %d %s", tc.name, tc.status, status, body)
+		}
+		if status != http.StatusOK {
+			continue
+		}
+		var response struct{ Token string }
+		json.Unmarshal([]byte(body), &response)
+		if status, body := api.request(http.MethodGet, "/api/v1/me", response.Token, nil); status != http.StatusOK {
+			t.Fatalf("%s: expected a valid access token, got %d %s", tc.name, status, body)
+		}
+	}
+}
+
+func TestRegenerateRecoveryCodes(t *testing.T) {
+	api := newTestAPI(t, nil)
+	api.signup("user@example.com")
+	token := api.login("user@example.com")
+	_, recovery := api.enableTOTP(token)
+
+	status, body := api.request(http.MethodPost, "/api/v1/mfa/recovery-codes", token, map[string]string{"code": recovery[0]})
+	if status != http.StatusOK {
+		t.Fatalf("regenerate recovery codes: %d %s", status, body)
+	}
+	var codes struct{ RecoveryCodes []string }
+	json.Unmarshal([]byte(body), &codes)
+	if status, _ := api.request(http.MethodPost, "/login/mfa", "", map[string]string{"mfaToken": api.mfaToken("user@example.com"), "code": recovery[1]}); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a replaced recovery code, got %d", status)
+	}
+	if status, body := api.request(http.MethodPost, "/login/mfa", "", map[string]string{"mfaToken": api.mfaToken("user@example.com"), "code": codes.RecoveryCodes[0]}); status != http.StatusOK {
+		t.Fatalf("expected 200 for a new recovery code, got %d %s", status, body)
+	}
+}
+
+func TestDisableTOTP(t *testing.T) {
+	api := newTestAPI(t, nil)
+	api.signup("user@example.com")
+	token := api.login("user@example.com")
+	secret, _ := api.enableTOTP(token)
+
+	if status, _ := api.request(http.MethodDelete, "/api/v1/mfa/totp", token, map[string]string{"code": "123-wrong"}); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a wrong code, got %d", status)
+	}
+	if status, body := api.request(http.MethodDelete, "/api/v1/mfa/totp", token, map[string]string{"code": api.totpCode(secret, 1)}); status != http.StatusOK {
+		t.Fatalf("disable totp: %d %s", status, body)
+	}
+	// sin TOTP el login vuelve a responder los tokens
+	if status, _ := api.request(http.MethodGet, "/api/v1/me", api.login("user@example.com"), nil); status != http.StatusOK {
+		t.Fatalf("expected a login without mfa, got %d", status)
+	}
+}
+
+// con solo el access token no se pueden probar todos los códigos para desactivar el TOTP o sacar códigos de recuperación
+func TestSecondFactorThrottled(t *testing.T) {
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodDelete, "/api/v1/mfa/totp"},
+		{http.MethodPost, "/api/v1/mfa/recovery-codes"},
+	} {
+		api := newTestAPI(t, nil)
+		api.signup("user@example.com")
+		token := api.login("user@example.com")
+		secret, _ := api.enableTOTP(token)
+
+		for i := 0; i <= auth.DEFAULT_ACCOUNT_POLICY.FreeAttempts; i++ {
+			if status, _ := api.request(tc.method, tc.path, token, map[string]string{"code": "123-wrong"}); status != http.StatusBadRequest {
+				t.Fatalf("%s %s: expected 400 for a wrong code, got %d", tc.method, tc.path, status)
+			}
+		}
+		if status, _ := api.request(tc.method, tc.path, token, map[string]string{"code": api.totpCode(secret, 1)}); status != http.StatusTooManyRequests {
+			t.Fatalf("%s %s: expected 429 after %d wrong codes, got %d", tc.method, tc.path, auth.DEFAULT_ACCOUNT_POLICY.FreeAttempts+1, status)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"platzi.com/go/rest-ws/auth"
+)
+
+// scope que necesita una API key en cada ruta, las rutas que no están aquí solo aceptan tokens de sesión
+var (
+	apiKeyScopes      = make(map[*mux.Route]string)
+	apiKeyScopesMutex sync.RWMutex
+)
+
+// AllowAPIKey permite usar la ruta con una API key que tenga el scope, se declara en BindRoutes:
+//
+//	middleware.AllowAPIKey(api.HandleFunc("/posts", handlers.InsertPostHandler(s)).Methods(http.MethodPost), models.SCOPE_POSTS_WRITE)
+func AllowAPIKey(route *mux.Route, scope string) *mux.Route {
+	apiKeyScopesMutex.Lock()
+	defer apiKeyScopesMutex.Unlock()
+	apiKeyScopes[route] = scope
+	return route
+}
+
+// authorizeAPIKey revisa que la ruta acepte API keys y que la llave tenga el scope de la ruta, si no responde 403
+func authorizeAPIKey(w http.ResponseWriter, r *http.Request, principal *auth.Principal) bool {
+	apiKeyScopesMutex.RLock()
+	scope, ok := apiKeyScopes[mux.CurrentRoute(r)]
+	apiKeyScopesMutex.RUnlock()
+	if !ok {
+		http.Error(w, "api keys can't be used on this route", http.StatusForbidden)
+		return false
+	}
+	if !principal.HasScope(scope) {
+		http.Error(w, auth.ErrMissingScope.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
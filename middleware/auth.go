@@ -4,8 +4,7 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/golang-jwt/jwt"
-	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/auth"
 	"platzi.com/go/rest-ws/server"
 )
 
@@ -40,19 +39,20 @@ func CheckAuthMiddleware(s server.Server) func(h http.Handler) http.Handler {
 				next.ServeHTTP(w, r) // si la ruta no está protegida, entonces puede seguir sin el token, por eso se llama al next (al siguiente handler)
 				return
 			}
-			// Si la ruta está protegida validar el token
-			tokenString := strings.TrimSpace(r.Header.Get("Authorization"))
-			// En ParseWithClaims pasar el token, los claims (tipo de dato para descompilar el token), y recibe una funcion que tiene como parametro un token que devolverá una interface vacía o un error, y debe devolver el secret:
-			_, err := jwt.ParseWithClaims(tokenString, &models.AppClaims{}, func(token *jwt.Token) (interface{}, error) {
-				return []byte(s.Config().JWTSecret), nil
-			})
+			// Si la ruta está protegida validar el token (jwt o API key, con o sin "Bearer ") con el Authenticator del servidor
+			tokenString := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(r.Header.Get("Authorization")), "Bearer "))
+			principal, err := s.Auth().AuthenticateToken(r.Context(), tokenString)
 			// si existe un error (token vencido, token inválido, etc) devolver el error:
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusUnauthorized)
 				return
 			}
-			// si todo va bien, entonces se enviará al siguiente handler:
-			next.ServeHTTP(w, r)
+			// las API keys solo pueden usar las rutas declaradas con AllowAPIKey
+			if principal.APIKeyId != "" && !authorizeAPIKey(w, r, principal) {
+				return
+			}
+			// si todo va bien, entonces se enviará al siguiente handler con el usuario autenticado en el contexto, los handlers lo leen con auth.PrincipalFrom:
+			next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
 		})
 
 	}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+
+	"platzi.com/go/rest-ws/auth"
+)
+
+// Policy decide si el usuario autenticado puede usar una ruta, las políticas de cada ruta se declaran en BindRoutes
+type Policy func(principal *auth.Principal, r *http.Request) bool
+
+// AnyRole permite la ruta a los usuarios que tengan alguno de los roles
+func AnyRole(roles ...string) Policy {
+	return func(principal *auth.Principal, r *http.Request) bool {
+		return principal.HasAnyRole(roles...)
+	}
+}
+
+// Authorize envuelve el handler de una ruta protegida con su política, responde 401 si no hay usuario autenticado
+// (la ruta no pasó por CheckAuthMiddleware) y 403 si la política no lo permite
+func Authorize(policy Policy) func(h http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := auth.PrincipalFrom(r.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if !policy(principal, r) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Either elige el handler de la ruta según la política: allowed si el usuario autenticado la cumple y otherwise si no,
+// así una ruta da más permisos a algunos roles sin que el handler revise los roles, responde 401 si no hay usuario autenticado
+func Either(policy Policy, allowed http.Handler, otherwise http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFrom(r.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if policy(principal, r) {
+			allowed.ServeHTTP(w, r)
+			return
+		}
+		otherwise.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"platzi.com/go/rest-ws/database"
+)
+
+// runMigrate ejecuta el comando migrate contra DATABASE_URL:
+//
+//	migrate up        aplica las migraciones pendientes
+//	migrate down [n]  revierte las últimas n migraciones (1 por defecto)
+//	migrate status    muestra qué migraciones están aplicadas
+func runMigrate(ctx context.Context, databaseUrl string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down [n]|status")
+	}
+	if databaseUrl == "" {
+		return errors.New("database url is required")
+	}
+	repo, err := database.NewPostgresRepository(databaseUrl)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	migrator, err := repo.Migrator()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, migration := range applied {
+			fmt.Printf("applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("database is up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		for _, migration := range reverted {
+			fmt.Printf("reverted %04d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		for _, status := range statuses {
+			state, appliedAt := "pending", ""
+			if status.Applied {
+				state, appliedAt = "applied", status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if status.ChecksumMismatch {
+				state = "modified"
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", status.Version, status.Name, state, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// permisos que se le pueden dar a una API key, los tokens de sesión tienen todos los permisos
+const (
+	SCOPE_POSTS_READ  = "posts:read"
+	SCOPE_POSTS_WRITE = "posts:write"
+)
+
+// APIKey es una llave personal con la que un usuario usa el API sin hacer login, solo se guarda el hash de la llave,
+// Prefix son los primeros caracteres de la llave para que el usuario la reconozca en la lista
+type APIKey struct {
+	Id        string     `json:"id"`
+	UserId    string     `json:"-"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	KeyHash   string     `json:"-"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"` // nil si no vence
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// ValidScope indica si el scope es uno de los scopes conocidos
+func ValidScope(scope string) bool {
+	switch scope {
+	case SCOPE_POSTS_READ, SCOPE_POSTS_WRITE:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// LoginAttempt cuenta los intentos de login fallidos de una llave (una cuenta o una ip)
+type LoginAttempt struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+}
@@ -3,6 +3,10 @@ package models
 import "github.com/golang-jwt/jwt"
 
 type AppClaims struct {
-	UserId             string `json:"userId"` // el user será capaz de identicarse a través del user id que irá en un token
-	jwt.StandardClaims        // al poner StandardClaims indico que AppClaims tiene todas las propiedades que están definidas en StandardClaims
+	UserId             string   `json:"userId"` // el user será capaz de identicarse a través del user id que irá en un token
+	Roles              []string `json:"roles,omitempty"`
+	Purpose            string   `json:"purpose,omitempty"` // para qué sirve un token de un solo uso (ej: verificar el email), vacío en los access tokens
+	SessionId          string   `json:"sid,omitempty"`     // sesión (login) de la que salió el access token
+	IssuedAtMicro      int64    `json:"iat_us,omitempty"`  // iat en microsegundos, con iat en segundos un token creado justo después de cerrar todas las sesiones quedaría revocado
+	jwt.StandardClaims          // al poner StandardClaims indico que AppClaims tiene todas las propiedades que están definidas en StandardClaims
 }
@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// ExternalIdentity vincula un usuario con su cuenta en un proveedor de identidad externo (OpenID Connect),
+// Subject es el id del usuario en el proveedor, que no cambia aunque cambie su email
+type ExternalIdentity struct {
+	Provider  string
+	Subject   string
+	UserId    string
+	Email     string // email que dio el proveedor al vincular la cuenta
+	CreatedAt time.Time
+}
+
+// OIDCLoginState es un login con un proveedor externo que todavía no vuelve al callback, solo se guarda el hash del state,
+// el nonce y el code verifier (PKCE) se usan al cambiar el código por el id token
+type OIDCLoginState struct {
+	StateHash    string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+	CreatedAt    time.Time
+}
@@ -1,6 +1,35 @@
 package models
 
+// EventType es el tipo de los mensajes que el hub envía a los clientes por el websocket y por /events
+type EventType string
+
+const (
+	// se creó un post, el payload es el Post
+	EVENT_POST_CREATED EventType = "Post_Created"
+	// se editó el contenido de un post, el payload es el Post
+	EVENT_POST_UPDATED EventType = "Post_Updated"
+	// se eliminó un post, el payload es PostDeleted
+	EVENT_POST_DELETED EventType = "Post_Deleted"
+	// respuesta a un subscribe, el payload es el topic
+	EVENT_SUBSCRIBED EventType = "subscribed"
+	// respuesta a un unsubscribe, el payload es el topic
+	EVENT_UNSUBSCRIBED EventType = "unsubscribed"
+	// el mensaje que envió el cliente no es válido, el payload es la descripción del error
+	EVENT_ERROR EventType = "error"
+	// el last_event_id con el que se reconectó el cliente ya no está en el historial, se deben volver a consultar los posts en el API
+	EVENT_RESYNC_REQUIRED EventType = "Resync_Required"
+)
+
+// Id lo asigna el hub con la forma <epoch>-<número de secuencia>, el epoch cambia cada vez que arranca el hub,
+// los clientes lo usan como last_event_id al reconectarse
 type WebsocketMessage struct {
-	Type    string      `json:"type"`
+	Id      string      `json:"id,omitempty"`
+	Type    EventType   `json:"type"`
 	Payload interface{} `json:"payload"`
 }
+
+// PostDeleted es el payload de EVENT_POST_DELETED
+type PostDeleted struct {
+	Id     string `json:"id"`
+	UserId string `json:"userId"`
+}
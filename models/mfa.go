@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// TOTP es el segundo factor del usuario, el secret se guarda al iniciar la activación y solo se pide en el login
+// cuando el usuario confirma que su app genera códigos válidos (Enabled)
+type TOTP struct {
+	UserId string
+	Secret string
+	// LastUsedStep es el último paso de tiempo con el que se aceptó un código, un código ya usado no se vuelve a aceptar
+	LastUsedStep int64
+	Enabled      bool
+	CreatedAt    time.Time
+}
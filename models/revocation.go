@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// RevokedToken es un access token revocado antes de vencer (logout), Id es el jti del token,
+// se guarda hasta ExpiresAt porque después el token ya no sirve de todas formas
+type RevokedToken struct {
+	Id        string
+	UserId    string
+	ExpiresAt time.Time
+}
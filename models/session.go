@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Session es un login del usuario en un dispositivo, su id es el de la familia de refresh tokens que nace en ese login
+// y va en el claim sid de los access tokens, así al revocar la sesión se revocan sus tokens y se cierran sus websockets
+type Session struct {
+	Id         string     `json:"id"`
+	UserId     string     `json:"-"`
+	Device     string     `json:"device"` // nombre legible que sale del user agent (ej: Chrome on Windows)
+	UserAgent  string     `json:"userAgent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastSeenAt time.Time  `json:"lastSeenAt"` // último login o refresh de la sesión
+	ExpiresAt  time.Time  `json:"expiresAt"`  // vence junto con su último refresh token
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
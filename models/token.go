@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// RefreshToken es un refresh token guardado en la db, solo se guarda el hash del token que recibe el cliente,
+// cada refresh crea un token nuevo en la misma familia (FamilyId), la familia nace en el login
+type RefreshToken struct {
+	Id        string
+	UserId    string
+	FamilyId  string
+	TokenHash string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UsedAt    *time.Time // cuándo se usó para rotar, un token usado no se puede volver a usar
+	RevokedAt *time.Time
+}
+
+// PasswordResetToken es un token de un solo uso para cambiar el password sin conocerlo, se envía por correo y solo se guarda su hash
+type PasswordResetToken struct {
+	Id        string
+	UserId    string
+	TokenHash string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UsedAt    *time.Time
+}
@@ -1,7 +1,25 @@
 package models
 
+// roles de los usuarios, todos tienen ROLE_USER, los moderadores pueden eliminar cualquier post y los admins administran a los usuarios
+const (
+	ROLE_USER      = "user"
+	ROLE_MODERATOR = "moderator"
+	ROLE_ADMIN     = "admin"
+)
+
 type User struct {
-	Id       string `json:"id"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Id       string   `json:"id"`
+	Email    string   `json:"email"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+	Verified bool     `json:"verified"` // si ya confirmó su email con el enlace que se le envió al registrarse
+}
+
+// ValidRole indica si el rol es uno de los roles conocidos
+func ValidRole(role string) bool {
+	switch role {
+	case ROLE_USER, ROLE_MODERATOR, ROLE_ADMIN:
+		return true
+	}
+	return false
 }
@@ -0,0 +1,301 @@
+// Package oidctest tiene un proveedor OpenID Connect falso sobre httptest, sirve para probar el login con oidc.Provider sin un proveedor real:
+//
+//	provider, _ := oidctest.NewProvider("client-id", "client-secret")
+//	defer provider.Close()
+//	provider.SetIdentity(oidctest.Identity{Subject: "248289761001", Email: "ana@example.com", EmailVerified: true})
+//	config := oidc.ProviderConfig{Name: "fake", Issuer: provider.Issuer(), ClientID: "client-id", ClientSecret: "client-secret", RedirectURL: callback}
+//
+// el endpoint de autorización no muestra ninguna pantalla, redirige de inmediato al redirect_uri con un código para la identidad actual
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/segmentio/ksuid"
+	"platzi.com/go/rest-ws/oidc"
+)
+
+// lo que duran los id tokens y los códigos del proveedor falso
+const (
+	ID_TOKEN_TTL = 5 * time.Minute
+	CODE_TTL     = time.Minute
+)
+
+// Identity es el usuario que tiene la sesión abierta en el proveedor
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// authorization es un código entregado en el endpoint de autorización que todavía no se cambia por tokens
+type authorization struct {
+	identity      Identity
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	expiresAt     time.Time
+}
+
+// Provider es el proveedor falso, publica su configuración en /.well-known/openid-configuration y firma los id tokens con RS256
+type Provider struct {
+	server       *httptest.Server
+	clientId     string
+	clientSecret string
+	mutex        sync.Mutex
+	key          *rsa.PrivateKey
+	keyId        string
+	identity     Identity
+	codes        map[string]authorization
+	// si no es nil cambia los claims del id token antes de firmarlo, sirve para probar los id tokens inválidos
+	claimsHook func(claims jwt.MapClaims)
+}
+
+// NewProvider crea la llave de firma y empieza a escuchar en un puerto libre de localhost
+func NewProvider(clientId string, clientSecret string) (*Provider, error) {
+	provider := &Provider{
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		identity:     Identity{Subject: "1", Email: "user@example.com", EmailVerified: true, Name: "Test User"},
+		codes:        make(map[string]authorization),
+	}
+	if err := provider.RotateKey(); err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", provider.handleDiscovery)
+	mux.HandleFunc("/authorize", provider.handleAuthorize)
+	mux.HandleFunc("/token", provider.handleToken)
+	mux.HandleFunc("/jwks", provider.handleJWKS)
+	provider.server = httptest.NewServer(mux)
+	return provider, nil
+}
+
+// Issuer es la url del proveedor, es la que va en oidc.ProviderConfig
+func (p *Provider) Issuer() string {
+	return p.server.URL
+}
+
+// Close detiene el servidor
+func (p *Provider) Close() {
+	p.server.Close()
+}
+
+// SetIdentity cambia el usuario que hace login en los siguientes códigos
+func (p *Provider) SetIdentity(identity Identity) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.identity = identity
+}
+
+// SetClaimsHook cambia los claims de los siguientes id tokens (ej: otro aud o un exp vencido), nil para dejarlos como están
+func (p *Provider) SetClaimsHook(hook func(claims jwt.MapClaims)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.claimsHook = hook
+}
+
+// RotateKey crea una llave de firma nueva con otro kid, la anterior deja de estar en el JWKS
+func (p *Provider) RotateKey() error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.key = key
+	p.keyId = ksuid.New().String()
+	return nil
+}
+
+// Authorize hace lo mismo que un navegador: sigue la url de login del API hasta el redirect_uri con el código
+// y devuelve esa url del callback sin abrirla
+func (p *Provider) Authorize(loginURL string) (string, error) {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !strings.HasPrefix(req.URL.String(), p.server.URL) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	res, err := client.Get(loginURL)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	location, err := res.Location()
+	if err != nil {
+		return "", err
+	}
+	return location.String(), nil
+}
+
+func (p *Provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                p.server.URL,
+		"authorization_endpoint":                p.server.URL + "/authorize",
+		"token_endpoint":                        p.server.URL + "/token",
+		"jwks_uri":                              p.server.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+	})
+}
+
+// handleAuthorize valida la petición de autorización y redirige al redirect_uri con un código de un solo uso
+func (p *Provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI := query.Get("redirect_uri")
+	switch {
+	case query.Get("response_type") != "code":
+		http.Error(w, "unsupported response_type", http.StatusBadRequest)
+		return
+	case query.Get("client_id") != p.clientId:
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	case redirectURI == "":
+		http.Error(w, "redirect_uri is required", http.StatusBadRequest)
+		return
+	case !strings.Contains(" "+query.Get("scope")+" ", " openid "):
+		http.Error(w, "scope must include openid", http.StatusBadRequest)
+		return
+	case query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256":
+		http.Error(w, "pkce with S256 is required", http.StatusBadRequest)
+		return
+	}
+	code := ksuid.New().String()
+	p.mutex.Lock()
+	p.codes[code] = authorization{
+		identity:      p.identity,
+		redirectURI:   redirectURI,
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		expiresAt:     time.Now().Add(CODE_TTL),
+	}
+	p.mutex.Unlock()
+	callback, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	values := callback.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	callback.RawQuery = values.Encode()
+	http.Redirect(w, r, callback.String(), http.StatusFound)
+}
+
+// handleToken cambia el código por el id token, revisa el cliente, el redirect_uri y el code_verifier igual que un proveedor real
+func (p *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	clientId, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientId, _ = url.QueryUnescape(clientId)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientId, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientId != p.clientId || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.clientSecret)) != 1 {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	p.mutex.Lock()
+	code := r.PostForm.Get("code")
+	auth, found := p.codes[code]
+	delete(p.codes, code)
+	p.mutex.Unlock()
+	if !found || time.Now().After(auth.expiresAt) || auth.redirectURI != r.PostForm.Get("redirect_uri") ||
+		oidc.CodeChallenge(r.PostForm.Get("code_verifier")) != auth.codeChallenge {
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	idToken, err := p.idToken(auth)
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": ksuid.New().String(),
+		"token_type":   "Bearer",
+		"expires_in":   int(ID_TOKEN_TTL.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+func (p *Provider) idToken(auth authorization) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            p.server.URL,
+		"sub":            auth.identity.Subject,
+		"aud":            p.clientId,
+		"iat":            now.Unix(),
+		"exp":            now.Add(ID_TOKEN_TTL).Unix(),
+		"nonce":          auth.nonce,
+		"email":          auth.identity.Email,
+		"email_verified": auth.identity.EmailVerified,
+		"name":           auth.identity.Name,
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.claimsHook != nil {
+		p.claimsHook(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = p.keyId
+	return token.SignedString(p.key)
+}
+
+func (p *Provider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	public := p.key.PublicKey
+	keyId := p.keyId
+	p.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyId,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}},
+	})
+}
+
+// tokenError responde un error del token endpoint con el formato de RFC 6749
+func tokenError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
@@ -0,0 +1,482 @@
+// Package oidc hace login con proveedores de identidad externos (OpenID Connect) con el flujo authorization code y PKCE,
+// el id token que entrega el proveedor se valida con las llaves que publica en su JWKS
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	// tiempo máximo de cada petición al proveedor
+	HTTP_TIMEOUT = 10 * time.Second
+	// diferencia de reloj que se tolera con el proveedor al revisar exp e iat del id token
+	CLOCK_SKEW = time.Minute
+	// si el id token viene firmado con un kid desconocido se vuelve a leer el JWKS, como mucho una vez en este tiempo
+	JWKS_MIN_REFRESH = time.Minute
+	// tamaño máximo de las respuestas del proveedor
+	MAX_RESPONSE_BYTES = 1 << 20
+)
+
+// scopes que se piden si la configuración no trae otros, con email se puede vincular la identidad a un usuario
+var DEFAULT_SCOPES = []string{"openid", "email", "profile"}
+
+var (
+	ErrInvalidIDToken = errors.New("invalid id token")
+	// el proveedor respondió con un error o con algo que no se entiende
+	ErrProvider = errors.New("identity provider error")
+	// el proveedor rechazó el código, ya se usó, venció o el code verifier (PKCE) no coincide
+	ErrInvalidGrant = errors.New("invalid authorization code")
+)
+
+// algoritmos con los que se aceptan los id tokens, nunca none ni HS256 con la llave pública como secret
+var idTokenAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384"}
+
+// ProviderConfig es la configuración de un proveedor, Name es el nombre con el que aparece en las rutas (ej: google en /auth/google/login)
+// y RedirectURL es la url del callback que se registró en el proveedor
+type ProviderConfig struct {
+	Name         string
+	Issuer       string // url del proveedor, su configuración se lee de <Issuer>/.well-known/openid-configuration
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string // por defecto DEFAULT_SCOPES
+}
+
+// Identity es el usuario que devolvió el proveedor en el id token, Subject es su id en el proveedor y nunca cambia
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// LoginRequest son los valores de un login que empieza: State y Nonce se guardan para revisar el callback y el id token,
+// CodeVerifier se guarda para cambiar el código y CodeChallenge va al proveedor (PKCE con S256)
+type LoginRequest struct {
+	State         string
+	Nonce         string
+	CodeVerifier  string
+	CodeChallenge string
+}
+
+// NewLoginRequest genera valores aleatorios nuevos para un login
+func NewLoginRequest() (*LoginRequest, error) {
+	var values [3]string
+	for i := range values {
+		data := make([]byte, 32)
+		if _, err := rand.Read(data); err != nil {
+			return nil, err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(data)
+	}
+	return &LoginRequest{State: values[0], Nonce: values[1], CodeVerifier: values[2], CodeChallenge: CodeChallenge(values[2])}, nil
+}
+
+// CodeChallenge es el challenge S256 del code verifier (RFC 7636)
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// metadata son los campos de /.well-known/openid-configuration que se usan
+type metadata struct {
+	Issuer                   string   `json:"issuer"`
+	AuthorizationEndpoint    string   `json:"authorization_endpoint"`
+	TokenEndpoint            string   `json:"token_endpoint"`
+	JWKSURI                  string   `json:"jwks_uri"`
+	TokenEndpointAuthMethods []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// Provider es un proveedor OpenID Connect, su configuración y sus llaves se leen la primera vez que se usan y se guardan en memoria
+type Provider struct {
+	config ProviderConfig
+	client *http.Client
+	mutex  sync.Mutex
+	// nil hasta que se lee la configuración del proveedor
+	metadata      *metadata
+	keys          map[string]interface{} // llaves públicas del JWKS por kid
+	keysFetchedAt time.Time
+}
+
+// NewProvider crea el proveedor sin conectarse, así el servidor arranca aunque el proveedor no responda; con client nil se usa uno con HTTP_TIMEOUT
+func NewProvider(config ProviderConfig, client *http.Client) (*Provider, error) {
+	if config.Name == "" || config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("oidc provider name, issuer, client id and redirect url are required")
+	}
+	// el nombre va en las rutas del API
+	if strings.Trim(config.Name, "abcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		return nil, fmt.Errorf("invalid oidc provider name %q, must use lowercase letters, digits, - or _", config.Name)
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = DEFAULT_SCOPES
+	}
+	if client == nil {
+		client = &http.Client{Timeout: HTTP_TIMEOUT}
+	}
+	return &Provider{config: config, client: client}, nil
+}
+
+// Name devuelve el nombre del proveedor en las rutas
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+// AuthCodeURL devuelve la url del proveedor a la que se redirige al usuario para que haga login
+func (p *Provider) AuthCodeURL(ctx context.Context, request *LoginRequest) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {request.State},
+		"nonce":                 {request.Nonce},
+		"code_challenge":        {request.CodeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return meta.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// tokenResponse es la respuesta del token endpoint, también trae error si el proveedor rechazó el código
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange cambia el código del callback por el id token y devuelve la identidad del usuario,
+// el id token debe estar firmado por el proveedor, ser para este cliente y traer el nonce del login
+func (p *Provider) Exchange(ctx context.Context, code string, codeVerifier string, nonce string) (*Identity, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {codeVerifier},
+		"client_id":     {p.config.ClientID},
+	}
+	// client_secret_basic es el método por defecto del estándar, si el proveedor no lo soporta el secret va en el body
+	useBasic := len(meta.TokenEndpointAuthMethods) == 0 || contains(meta.TokenEndpointAuthMethods, "client_secret_basic")
+	if p.config.ClientSecret != "" && !useBasic {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" && useBasic {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	defer res.Body.Close()
+	var response tokenResponse
+	if err = json.NewDecoder(io.LimitReader(res.Body, MAX_RESPONSE_BYTES)).Decode(&response); err != nil {
+		return nil, fmt.Errorf("%w: token endpoint returned %s: %v", ErrProvider, res.Status, err)
+	}
+	if response.Error == "invalid_grant" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidGrant, response.ErrorDescription)
+	}
+	if response.Error != "" || res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: token endpoint returned %s: %s %s", ErrProvider, res.Status, response.Error, response.ErrorDescription)
+	}
+	if response.IDToken == "" {
+		return nil, fmt.Errorf("%w: token endpoint did not return an id token", ErrProvider)
+	}
+	return p.VerifyIDToken(ctx, response.IDToken, nonce)
+}
+
+// idTokenClaims son los claims del id token que se revisan, aud puede venir como string o como lista
+type idTokenClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	ExpiresAt       int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   flexBool `json:"email_verified"`
+	Name            string   `json:"name"`
+}
+
+// Valid lo llama el parser de jwt, revisa los tiempos con CLOCK_SKEW de tolerancia
+func (c *idTokenClaims) Valid() error {
+	now := time.Now()
+	if c.ExpiresAt == 0 || now.After(time.Unix(c.ExpiresAt, 0).Add(CLOCK_SKEW)) {
+		return errors.New("token is expired")
+	}
+	if c.IssuedAt != 0 && time.Unix(c.IssuedAt, 0).After(now.Add(CLOCK_SKEW)) {
+		return errors.New("token used before issued")
+	}
+	return nil
+}
+
+// VerifyIDToken valida la firma del id token con el JWKS del proveedor y que sea del proveedor, para este cliente y con el nonce del login
+func (p *Provider) VerifyIDToken(ctx context.Context, rawIDToken string, nonce string) (*Identity, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claims := &idTokenClaims{}
+	parser := &jwt.Parser{ValidMethods: idTokenAlgorithms}
+	_, err = parser.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	switch {
+	case claims.Issuer != meta.Issuer:
+		return nil, fmt.Errorf("%w: issuer %q", ErrInvalidIDToken, claims.Issuer)
+	case !contains(claims.Audience, p.config.ClientID):
+		return nil, fmt.Errorf("%w: not issued for this client", ErrInvalidIDToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID:
+		return nil, fmt.Errorf("%w: authorized party %q", ErrInvalidIDToken, claims.AuthorizedParty)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 || nonce == "":
+		return nil, fmt.Errorf("%w: nonce does not match", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+	return &Identity{
+		Provider:      p.config.Name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+	}, nil
+}
+
+// discover lee la configuración del proveedor la primera vez, si falla se vuelve a intentar en el siguiente uso
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+	var meta metadata
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, err
+	}
+	// el issuer de la configuración debe ser el configurado, así otro proveedor no se puede hacer pasar por este
+	if meta.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("%w: discovery issuer %q does not match %q", ErrProvider, meta.Issuer, p.config.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: incomplete discovery document", ErrProvider)
+	}
+	p.metadata = &meta
+	return p.metadata, nil
+}
+
+// key devuelve la llave pública del kid, si no está se vuelve a leer el JWKS porque el proveedor pudo rotar sus llaves,
+// un id token sin kid se acepta solo si el JWKS tiene una sola llave
+func (p *Provider) key(ctx context.Context, kid string) (interface{}, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if key, ok := p.lookupLocked(kid); ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < JWKS_MIN_REFRESH {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	keys, err := p.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+	if key, ok := p.lookupLocked(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (p *Provider) lookupLocked(kid string) (interface{}, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// jsonWebKey es una llave pública del JWKS del proveedor (RFC 7517), se usan las RSA y las EC
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeys lee el JWKS del proveedor, se llama con el mutex bloqueado y p.metadata ya cargado
+func (p *Provider) fetchKeys(ctx context.Context) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.metadata.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{})
+	for _, jwk := range set.Keys {
+		// las llaves de cifrado no firman id tokens, y las de tipos desconocidos se ignoran
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	decode := func(value string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(data) == 0 {
+			return nil, errors.New("invalid jwk value")
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, value interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %s", ErrProvider, url, res.Status)
+	}
+	if err = json.NewDecoder(io.LimitReader(res.Body, MAX_RESPONSE_BYTES)).Decode(value); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrProvider, url, err)
+	}
+	return nil
+}
+
+// audience es el claim aud, que puede ser un string o una lista de strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// flexBool acepta true o "true", algunos proveedores envían email_verified como string
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	var value bool
+	if err := json.Unmarshal(data, &value); err == nil {
+		*b = flexBool(value)
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	*b = flexBool(text == "true")
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"platzi.com/go/rest-ws/auth"
+	"platzi.com/go/rest-ws/oidc"
+	"platzi.com/go/rest-ws/oidc/oidctest"
+	"platzi.com/go/rest-ws/server"
+)
+
+// newOIDCAPI arranca el API con un proveedor falso por nombre, el redirect url sale de PublicURL
+func newOIDCAPI(t *testing.T, names ...string) (*testAPI, map[string]*oidctest.Provider) {
+	t.Helper()
+	providers := make(map[string]*oidctest.Provider)
+	var configs []oidc.ProviderConfig
+	for _, name := range names {
+		provider, err := oidctest.NewProvider("client-"+name, "secret-"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(provider.Close)
+		provider.SetIdentity(oidctest.Identity{Subject: "sub-" + name, Email: "ana@example.com", EmailVerified: true})
+		providers[name] = provider
+		configs = append(configs, oidc.ProviderConfig{Name: name, Issuer: provider.Issuer(), ClientID: "client-" + name, ClientSecret: "secret-" + name})
+	}
+	return newTestAPI(t, &server.Config{OIDCProviders: configs}), providers
+}
+
+// authorize hace el login en el proveedor y devuelve la url del callback sin abrirla
+func (api *testAPI) authorize(provider *oidctest.Provider, name string) *url.URL {
+	api.t.Helper()
+	callback, err := provider.Authorize(api.server.URL + "/auth/" + name + "/login")
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	parsed, err := url.Parse(callback)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	return parsed
+}
+
+// callback abre la url del callback y devuelve el status y el body
+func (api *testAPI) callback(callback *url.URL) (int, string) {
+	api.t.Helper()
+	return api.request(http.MethodGet, callback.RequestURI(), "", nil)
+}
+
+// el state de un proveedor no sirve en el callback de otro
+func TestOIDCStateFromAnotherProvider(t *testing.T) {
+	api, providers := newOIDCAPI(t, "first", "second")
+	callback := api.authorize(providers["first"], "first")
+	callback.Path = strings.Replace(callback.Path, "/first/", "/second/", 1)
+	if status, body := api.callback(callback); status != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d %s", status, body)
+	}
+}
+
+func TestOIDCNonceMismatch(t *testing.T) {
+	api, providers := newOIDCAPI(t, "fake")
+	providers["fake"].SetClaimsHook(func(claims jwt.MapClaims) { claims["nonce"] = "another-nonce" })
+	if status, body := api.callback(api.authorize(providers["fake"], "fake")); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d %s", status, body)
+	}
+}
+
+// si el code verifier guardado no es el del code challenge que recibió el proveedor, el proveedor rechaza el código
+func TestOIDCPKCEMismatch(t *testing.T) {
+	api, providers := newOIDCAPI(t, "fake")
+	callback := api.authorize(providers["fake"], "fake")
+	ctx := context.Background()
+	hash := auth.HashToken(callback.Query().Get("state"))
+	state, err := api.repo.UseOIDCLoginState(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.CodeVerifier = strings.Repeat("x", 43)
+	if err = api.repo.InsertOIDCLoginState(ctx, state); err != nil {
+		t.Fatal(err)
+	}
+	if status, body := api.callback(callback); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d %s", status, body)
+	}
+}
+
+// el email del proveedor vincula la identidad a una cuenta existente solo si los dos lo verificaron
+func TestOIDCExistingEmail(t *testing.T) {
+	tests := []struct {
+		name             string
+		accountVerified  bool
+		providerVerified bool
+		status           int
+	}{
+		{"verified by both", true, true, http.StatusOK},
+		{"not verified by the provider", true, false, http.StatusConflict},
+		{"account not verified", false, true, http.StatusConflict},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			api, providers := newOIDCAPI(t, "fake")
+			user := api.signup("ana@example.com")
+			if tc.accountVerified {
+				if err := api.repo.MarkUserVerified(context.Background(), user.Id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			providers["fake"].SetIdentity(oidctest.Identity{Subject: "248289761001", Email: "ana@example.com", EmailVerified: tc.providerVerified})
+			status, body := api.callback(api.authorize(providers["fake"], "fake"))
+			if status != tc.status {
+				t.Fatalf("expected %d, got %d %s", tc.status, status, body)
+			}
+			identity, err := api.repo.GetExternalIdentity(context.Background(), "fake", "248289761001")
+			if linked := err == nil && identity.UserId == user.Id; linked != (tc.status == http.StatusOK) {
+				t.Errorf("identity linked = %v, want %v", linked, tc.status == http.StatusOK)
+			}
+			// una cuenta sin verificar sigue sin verificar, solo el enlace del correo la verifica
+			if stored, _ := api.repo.GetUserByID(context.Background(), user.Id); stored.Verified != tc.accountVerified {
+				t.Errorf("account verified = %v, want %v", stored.Verified, tc.accountVerified)
+			}
+		})
+	}
+}
+
+func TestOIDCInvalidEmail(t *testing.T) {
+	for _, email := range []string{"Ana <ana@example.com>", "ana@example.com\r\nBcc: eve@example.com", "not an email"} {
+		api, providers := newOIDCAPI(t, "fake")
+		providers["fake"].SetIdentity(oidctest.Identity{Subject: "248289761001", Email: email, EmailVerified: true})
+		if status, body := api.callback(api.authorize(providers["fake"], "fake")); status != http.StatusConflict {
+			t.Errorf("email %q: expected 409, got %d %s", email, status, body)
+		}
+		if _, err := api.repo.GetExternalIdentity(context.Background(), "fake", "248289761001"); err == nil {
+			t.Errorf("email %q: identity linked", email)
+		}
+	}
+}
+
+// el proveedor no reemplaza el segundo factor, con TOTP activo el callback responde el token mfa_pending
+func TestOIDCWithTOTPRequiresMFA(t *testing.T) {
+	api, providers := newOIDCAPI(t, "fake")
+	user := api.signup("ana@example.com")
+	ctx := context.Background()
+	if err := api.repo.MarkUserVerified(ctx, user.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.repo.SaveTOTPSecret(ctx, user.Id, "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.repo.EnableTOTP(ctx, user.Id, 1); err != nil {
+		t.Fatal(err)
+	}
+	status, body := api.callback(api.authorize(providers["fake"], "fake"))
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", status, body)
+	}
+	var response struct {
+		MFARequired bool   `json:"mfaRequired"`
+		MFAToken    string `json:"mfaToken"`
+		Token       string `json:"token"`
+	}
+	json.Unmarshal([]byte(body), &response)
+	if !response.MFARequired || response.MFAToken == "" || response.Token != "" {
+		t.Fatalf("expected only an mfa token, got %s", body)
+	}
+	// el token mfa_pending no sirve como access token
+	if status, _ := api.request(http.MethodGet, "/api/v1/me", response.MFAToken, nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 using the mfa token as access token, got %d", status)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"platzi.com/go/rest-ws/auth"
+	"platzi.com/go/rest-ws/mail/mailtest"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/server"
+)
+
+var resetToken = regexp.MustCompile(`expires in [^:]+:\n\n(\S+)`)
+
+// waitResetToken espera el correo de recuperación de email y devuelve su token
+func waitResetToken(t *testing.T, smtp *mailtest.Server, email string) string {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, message := range smtp.Messages() {
+			if len(message.To) == 1 && message.To[0] == email && strings.Contains(message.Data, "\nSubject: Reset your password\n") {
+				if match := resetToken.FindStringSubmatch(message.Data); match != nil {
+					return match[1]
+				}
+				t.Fatalf("no reset token in %q", message.Data)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no password reset email sent to %s", email)
+	return ""
+}
+
+func TestResetPassword(t *testing.T) {
+	api, smtp := newMailAPI(t)
+	api.signup("user@example.com")
+	token := api.login("user@example.com")
+	status, body := api.request(http.MethodPost, "/api/v1/apikeys", token, map[string]interface{}{"name": "cli", "scopes": []string{models.SCOPE_POSTS_WRITE}})
+	if status != http.StatusOK && status != http.StatusCreated {
+		t.Fatalf("create api key: %d %s", status, body)
+	}
+	var key struct{ Key string }
+	json.Unmarshal([]byte(body), &key)
+
+	if status, body := api.request(http.MethodPost, "/password/forgot", "", map[string]string{"email": "user@example.com"}); status != http.StatusAccepted {
+		t.Fatalf("forgot password: %d %s", status, body)
+	}
+	reset := waitResetToken(t, smtp, "user@example.com")
+
+	// un password que no cumple las reglas no gasta el token
+	tests := []struct {
+		password string
+		status   int
+	}{
+		{"short", http.StatusBadRequest},
+		{"user@example.com is my password", http.StatusBadRequest},
+		{"a brand new password", http.StatusOK},
+		{"another new password", http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		if status, body := api.request(http.MethodPost, "/password/reset", "", map[string]string{"token": reset, "password": tc.password}); status != tc.status {
+			t.Fatalf("reset with %q: expected %d, got %d %s", tc.password, tc.status, status, body)
+		}
+	}
+
+	for name, credential := range map[string]string{"access token": token, "api key": key.Key} {
+		if status, _ := api.request(http.MethodPost, "/api/v1/posts", credential, map[string]string{"post_content": "hello"}); status != http.StatusUnauthorized {
+			t.Errorf("%s after the reset: expected 401, got %d", name, status)
+		}
+	}
+	if status, body := api.request(http.MethodPost, "/login", "", map[string]string{"email": "user@example.com", "password": "a brand new password"}); status != http.StatusOK {
+		t.Fatalf("login with the new password: %d %s", status, body)
+	}
+}
+
+// cada pedido cuenta para el límite por email, exista o no, y al pasarlo se responde 429
+func TestForgotPasswordThrottled(t *testing.T) {
+	api := newTestAPI(t, nil)
+	for i := 0; i < 4; i++ {
+		if status, body := api.request(http.MethodPost, "/password/forgot", "", map[string]string{"email": "missing@example.com"}); status != http.StatusAccepted {
+			t.Fatalf("request %d: %d %s", i+1, status, body)
+		}
+	}
+	if status, _ := api.request(http.MethodPost, "/password/forgot", "", map[string]string{"email": "missing@example.com"}); status != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", status)
+	}
+	// los pedidos de recuperación no cuentan como logins fallidos
+	api.signup("user@example.com")
+	for i := 0; i < 5; i++ {
+		api.request(http.MethodPost, "/password/forgot", "", map[string]string{"email": "user@example.com"})
+	}
+	api.login("user@example.com")
+}
+
+// al hacer login con un hash de bcrypt o de argon2id con otros parámetros se guarda un hash nuevo con los actuales
+func TestLoginRehashesPassword(t *testing.T) {
+	config := auth.HashConfig{Algorithm: auth.HASH_ARGON2ID, Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 1}
+	api := newTestAPI(t, &server.Config{PasswordHashing: config})
+	user := api.signup("user@example.com")
+	tests := map[string]auth.PasswordHasher{
+		"bcrypt":           &auth.BcryptHasher{Cost: bcrypt.MinCost},
+		"argon2id t=2":     &auth.Argon2idHasher{Time: 2, Memory: 64, Threads: 1},
+		"argon2id m=32KiB": &auth.Argon2idHasher{Time: 1, Memory: 32, Threads: 1},
+	}
+	current := &auth.Argon2idHasher{Time: 1, Memory: 64, Threads: 1}
+	for name, previous := range tests {
+		hash, err := previous.Hash(TEST_PASSWORD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = api.repo.UpdateUserPassword(context.Background(), user.Id, hash); err != nil {
+			t.Fatal(err)
+		}
+		api.login("user@example.com")
+		stored, err := api.repo.GetUserByEmail(context.Background(), "user@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Password == hash {
+			t.Fatalf("%s: the stored hash was not replaced", name)
+		}
+		if needsRehash, err := current.Verify(TEST_PASSWORD, stored.Password); err != nil || needsRehash {
+			t.Fatalf("%s: expected a hash with the current parameters, got %s (%v %v)", name, stored.Password, needsRehash, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"platzi.com/go/rest-ws/models"
+)
+
+func TestUpdatePostBroadcastsStoredPost(t *testing.T) {
+	api := newTestAPI(t, nil)
+	user := api.signup("author@example.com")
+	token := api.login("author@example.com")
+	status, body := api.request(http.MethodPost, "/api/v1/posts", token, map[string]string{"post_content": "original"})
+	if status != http.StatusOK {
+		t.Fatalf("insert post: %d %s", status, body)
+	}
+	var created struct{ Id string }
+	json.Unmarshal([]byte(body), &created)
+
+	url := "ws" + strings.TrimPrefix(api.server.URL, "http") + "/ws?topics=posts&token=" + token
+	socket, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	for api.broker.Hub().Metrics().Clients == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if status, body = api.request(http.MethodPut, "/api/v1/posts/"+created.Id, token, map[string]string{"post_content": "edited"}); status != http.StatusOK {
+		t.Fatalf("update post: %d %s", status, body)
+	}
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	var message struct {
+		Type    models.EventType
+		Payload models.Post
+	}
+	if err = socket.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Type != models.EVENT_POST_UPDATED || message.Payload.PostContent != "edited" || message.Payload.UserId != user.Id {
+		t.Fatalf("unexpected message %+v", message)
+	}
+	if message.Payload.CreatedAt.IsZero() {
+		t.Fatal("expected the stored createdAt in the Post_Updated payload")
+	}
+}
@@ -0,0 +1,14 @@
+package repository
+
+import "errors"
+
+// Errores que devuelven todas las implementaciones del repository, los handlers los convierten en el status http que corresponde,
+// las implementaciones los pueden envolver con fmt.Errorf("...: %w", ErrConflict) para dar más detalle, se comparan con errors.Is
+var (
+	// no existe el registro buscado (404)
+	ErrNotFound = errors.New("not found")
+	// el registro choca con otro que ya existe, por ejemplo un email repetido (409)
+	ErrConflict = errors.New("conflict")
+	// el registro existe pero el usuario no tiene permiso para modificarlo (403)
+	ErrForbidden = errors.New("forbidden")
+)
@@ -3,21 +3,80 @@ package repository
 
 import (
 	"context"
+	"time"
 
 	"platzi.com/go/rest-ws/models"
 )
 
+// Los errores que devuelven las implementaciones están definidos en errors.go (ErrNotFound, ErrConflict, ErrForbidden)
 // Definir interfaz Repository que tendrá un insertar usuario y tendrá un contexto como parámetro y un user de nuestros modelos, y devuelve un error si lo hay
 // También traerá un usuario by Id, se pasa el contexto y el id que sea tipo string. Retornará un usuario y un error si lo hay
 type Repository interface {
 	InsertUser(ctx context.Context, user *models.User) error
 	GetUserByID(ctx context.Context, id string) (*models.User, error)
 	GetUserByEmail(ctx context.Context, email string) (*models.User, error) // para autenticar a un usuario
+	ListUsers(ctx context.Context, page uint64) ([]*models.User, error)
+	UpdateUserRoles(ctx context.Context, id string, roles []string) error
+	MarkUserVerified(ctx context.Context, id string) error
+	UpdateUserPassword(ctx context.Context, id string, password string) error
 	InsertPost(ctx context.Context, post *models.Post) error
 	GetPostByID(ctx context.Context, id string) (*models.Post, error)
-	DeletePost(ctx context.Context, id string, userId string) error
-	UpdatePost(ctx context.Context, post *models.Post, userId string) error
+	DeletePost(ctx context.Context, id string, userId string) error         // devuelven ErrNotFound si el post no existe o ErrForbidden si no es del usuario
+	UpdatePost(ctx context.Context, post *models.Post, userId string) error // deja en post la fila guardada
 	ListPost(ctx context.Context, page uint64) ([]*models.Post, error)
+	InsertRefreshToken(ctx context.Context, token *models.RefreshToken) error
+	GetRefreshTokenByHash(ctx context.Context, hash string) (*models.RefreshToken, error)
+	UseRefreshToken(ctx context.Context, id string) error // devuelve ErrConflict si el token ya se usó o está revocado
+	RevokeRefreshTokenFamily(ctx context.Context, familyId string) error
+	RevokeUserRefreshTokens(ctx context.Context, userId string) error
+	RevokeToken(ctx context.Context, token *models.RevokedToken) error
+	ConsumeToken(ctx context.Context, token *models.RevokedToken) error // como RevokeToken pero devuelve ErrConflict si el token ya estaba guardado, para los tokens de un solo uso
+	IsTokenRevoked(ctx context.Context, id string) (bool, error)
+	RevokeUserTokens(ctx context.Context, userId string, before time.Time) error
+	GetUserTokensRevokedBefore(ctx context.Context, userId string) (time.Time, error) // devuelve cero si el usuario nunca cerró todas sus sesiones
+	InsertAPIKey(ctx context.Context, key *models.APIKey) error
+	GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error)
+	ListAPIKeys(ctx context.Context, userId string) ([]*models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string, userId string) error // devuelve ErrNotFound si la llave no existe o ErrForbidden si no es del usuario
+	RevokeUserAPIKeys(ctx context.Context, userId string) error
+	InsertPasswordResetToken(ctx context.Context, token *models.PasswordResetToken) error
+	// GetPasswordResetToken devuelve el token sin usarlo, ErrNotFound si no existe, ya se usó o venció
+	GetPasswordResetToken(ctx context.Context, hash string) (*models.PasswordResetToken, error)
+	// UsePasswordResetToken marca como usado el token si no se había usado y no ha vencido, y también los demás tokens pendientes del usuario,
+	// y en la misma operación guarda el password nuevo del usuario; devuelve ErrNotFound si el token no existe, ya se usó o venció
+	UsePasswordResetToken(ctx context.Context, hash string, password string) (*models.PasswordResetToken, error)
+	// SaveTOTPSecret guarda el secret de un TOTP todavía sin activar, reemplaza el anterior si no se activó, devuelve ErrConflict si ya está activo
+	SaveTOTPSecret(ctx context.Context, userId string, secret string) error
+	GetTOTP(ctx context.Context, userId string) (*models.TOTP, error)
+	// EnableTOTP activa el TOTP guardado con el paso del código que lo confirmó, devuelve ErrNotFound si no hay secret o ErrConflict si ya estaba activo
+	EnableTOTP(ctx context.Context, userId string, step int64) error
+	// UseTOTPStep guarda el paso del código con el que se hizo login, devuelve ErrConflict si ese código o uno posterior ya se usó
+	UseTOTPStep(ctx context.Context, userId string, step int64) error
+	// DeleteTOTP desactiva el TOTP y borra los códigos de recuperación, devuelve ErrNotFound si el usuario no tiene TOTP
+	DeleteTOTP(ctx context.Context, userId string) error
+	// ReplaceRecoveryCodes borra los códigos de recuperación del usuario y guarda los nuevos
+	ReplaceRecoveryCodes(ctx context.Context, userId string, hashes []string) error
+	// UseRecoveryCode marca el código como usado, devuelve ErrNotFound si no existe o ya se usó
+	UseRecoveryCode(ctx context.Context, userId string, hash string) error
+	// RecordLoginFailure suma un fallo de login a la llave, si el último fallo es anterior a resetBefore el contador empieza de cero,
+	// también borra las llaves sin fallos desde resetBefore
+	RecordLoginFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (*models.LoginAttempt, error)
+	GetLoginAttempt(ctx context.Context, key string) (*models.LoginAttempt, error)
+	DeleteLoginAttempt(ctx context.Context, key string) error
+	InsertSession(ctx context.Context, session *models.Session) error
+	GetSession(ctx context.Context, id string) (*models.Session, error)
+	// ListSessions devuelve las sesiones del usuario que no están revocadas ni vencidas
+	ListSessions(ctx context.Context, userId string) ([]*models.Session, error)
+	// TouchSession guarda la ip y la fecha del último refresh de la sesión y hasta cuándo dura, devuelve ErrNotFound si no existe
+	TouchSession(ctx context.Context, id string, ip string, lastSeenAt time.Time, expiresAt time.Time) error
+	RevokeSession(ctx context.Context, id string, userId string) error // devuelve ErrNotFound si la sesión no existe o ErrForbidden si no es del usuario
+	RevokeUserSessions(ctx context.Context, userId string) error
+	InsertExternalIdentity(ctx context.Context, identity *models.ExternalIdentity) error // devuelve ErrConflict si la cuenta del proveedor ya está vinculada
+	GetExternalIdentity(ctx context.Context, provider string, subject string) (*models.ExternalIdentity, error)
+	// InsertOIDCLoginState guarda un login con un proveedor externo, también borra los logins vencidos
+	InsertOIDCLoginState(ctx context.Context, state *models.OIDCLoginState) error
+	// UseOIDCLoginState borra el login y lo devuelve, devuelve ErrNotFound si no existe, ya se usó o venció
+	UseOIDCLoginState(ctx context.Context, stateHash string) (*models.OIDCLoginState, error)
 	Close() error // Se agrega close, para cerrar conexiones a la db cuando la app no esté corriendo, en este caso, también agregamos que devuelva un error si existe
 }
 
@@ -44,6 +103,22 @@ func GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
 	return implementation.GetUserByEmail(ctx, email)
 }
 
+func ListUsers(ctx context.Context, page uint64) ([]*models.User, error) {
+	return implementation.ListUsers(ctx, page)
+}
+
+func UpdateUserRoles(ctx context.Context, id string, roles []string) error {
+	return implementation.UpdateUserRoles(ctx, id, roles)
+}
+
+func MarkUserVerified(ctx context.Context, id string) error {
+	return implementation.MarkUserVerified(ctx, id)
+}
+
+func UpdateUserPassword(ctx context.Context, id string, password string) error {
+	return implementation.UpdateUserPassword(ctx, id, password)
+}
+
 func InsertPost(ctx context.Context, post *models.Post) error {
 	return implementation.InsertPost(ctx, post)
 }
@@ -64,6 +139,158 @@ func ListPost(ctx context.Context, page uint64) ([]*models.Post, error) {
 	return implementation.ListPost(ctx, page)
 }
 
+func InsertRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	return implementation.InsertRefreshToken(ctx, token)
+}
+
+func GetRefreshTokenByHash(ctx context.Context, hash string) (*models.RefreshToken, error) {
+	return implementation.GetRefreshTokenByHash(ctx, hash)
+}
+
+func UseRefreshToken(ctx context.Context, id string) error {
+	return implementation.UseRefreshToken(ctx, id)
+}
+
+func RevokeRefreshTokenFamily(ctx context.Context, familyId string) error {
+	return implementation.RevokeRefreshTokenFamily(ctx, familyId)
+}
+
+func RevokeUserRefreshTokens(ctx context.Context, userId string) error {
+	return implementation.RevokeUserRefreshTokens(ctx, userId)
+}
+
+func RevokeToken(ctx context.Context, token *models.RevokedToken) error {
+	return implementation.RevokeToken(ctx, token)
+}
+
+func ConsumeToken(ctx context.Context, token *models.RevokedToken) error {
+	return implementation.ConsumeToken(ctx, token)
+}
+
+func IsTokenRevoked(ctx context.Context, id string) (bool, error) {
+	return implementation.IsTokenRevoked(ctx, id)
+}
+
+func RevokeUserTokens(ctx context.Context, userId string, before time.Time) error {
+	return implementation.RevokeUserTokens(ctx, userId, before)
+}
+
+func GetUserTokensRevokedBefore(ctx context.Context, userId string) (time.Time, error) {
+	return implementation.GetUserTokensRevokedBefore(ctx, userId)
+}
+
+func InsertAPIKey(ctx context.Context, key *models.APIKey) error {
+	return implementation.InsertAPIKey(ctx, key)
+}
+
+func GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error) {
+	return implementation.GetAPIKeyByHash(ctx, hash)
+}
+
+func ListAPIKeys(ctx context.Context, userId string) ([]*models.APIKey, error) {
+	return implementation.ListAPIKeys(ctx, userId)
+}
+
+func RevokeAPIKey(ctx context.Context, id string, userId string) error {
+	return implementation.RevokeAPIKey(ctx, id, userId)
+}
+
+func RevokeUserAPIKeys(ctx context.Context, userId string) error {
+	return implementation.RevokeUserAPIKeys(ctx, userId)
+}
+
+func InsertPasswordResetToken(ctx context.Context, token *models.PasswordResetToken) error {
+	return implementation.InsertPasswordResetToken(ctx, token)
+}
+
+func GetPasswordResetToken(ctx context.Context, hash string) (*models.PasswordResetToken, error) {
+	return implementation.GetPasswordResetToken(ctx, hash)
+}
+
+func UsePasswordResetToken(ctx context.Context, hash string, password string) (*models.PasswordResetToken, error) {
+	return implementation.UsePasswordResetToken(ctx, hash, password)
+}
+
+func SaveTOTPSecret(ctx context.Context, userId string, secret string) error {
+	return implementation.SaveTOTPSecret(ctx, userId, secret)
+}
+
+func GetTOTP(ctx context.Context, userId string) (*models.TOTP, error) {
+	return implementation.GetTOTP(ctx, userId)
+}
+
+func EnableTOTP(ctx context.Context, userId string, step int64) error {
+	return implementation.EnableTOTP(ctx, userId, step)
+}
+
+func UseTOTPStep(ctx context.Context, userId string, step int64) error {
+	return implementation.UseTOTPStep(ctx, userId, step)
+}
+
+func DeleteTOTP(ctx context.Context, userId string) error {
+	return implementation.DeleteTOTP(ctx, userId)
+}
+
+func ReplaceRecoveryCodes(ctx context.Context, userId string, hashes []string) error {
+	return implementation.ReplaceRecoveryCodes(ctx, userId, hashes)
+}
+
+func UseRecoveryCode(ctx context.Context, userId string, hash string) error {
+	return implementation.UseRecoveryCode(ctx, userId, hash)
+}
+
+func RecordLoginFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (*models.LoginAttempt, error) {
+	return implementation.RecordLoginFailure(ctx, key, at, resetBefore)
+}
+
+func GetLoginAttempt(ctx context.Context, key string) (*models.LoginAttempt, error) {
+	return implementation.GetLoginAttempt(ctx, key)
+}
+
+func DeleteLoginAttempt(ctx context.Context, key string) error {
+	return implementation.DeleteLoginAttempt(ctx, key)
+}
+
+func InsertSession(ctx context.Context, session *models.Session) error {
+	return implementation.InsertSession(ctx, session)
+}
+
+func GetSession(ctx context.Context, id string) (*models.Session, error) {
+	return implementation.GetSession(ctx, id)
+}
+
+func ListSessions(ctx context.Context, userId string) ([]*models.Session, error) {
+	return implementation.ListSessions(ctx, userId)
+}
+
+func TouchSession(ctx context.Context, id string, ip string, lastSeenAt time.Time, expiresAt time.Time) error {
+	return implementation.TouchSession(ctx, id, ip, lastSeenAt, expiresAt)
+}
+
+func RevokeSession(ctx context.Context, id string, userId string) error {
+	return implementation.RevokeSession(ctx, id, userId)
+}
+
+func RevokeUserSessions(ctx context.Context, userId string) error {
+	return implementation.RevokeUserSessions(ctx, userId)
+}
+
+func InsertExternalIdentity(ctx context.Context, identity *models.ExternalIdentity) error {
+	return implementation.InsertExternalIdentity(ctx, identity)
+}
+
+func GetExternalIdentity(ctx context.Context, provider string, subject string) (*models.ExternalIdentity, error) {
+	return implementation.GetExternalIdentity(ctx, provider, subject)
+}
+
+func InsertOIDCLoginState(ctx context.Context, state *models.OIDCLoginState) error {
+	return implementation.InsertOIDCLoginState(ctx, state)
+}
+
+func UseOIDCLoginState(ctx context.Context, stateHash string) (*models.OIDCLoginState, error) {
+	return implementation.UseOIDCLoginState(ctx, stateHash)
+}
+
 // Se crea la funcion Close, que devolverá lo que la implementación esté haciendo:
 func Close() error {
 	return implementation.Close()
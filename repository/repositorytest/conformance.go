@@ -0,0 +1,949 @@
+// Package repositorytest tiene la suite de conformidad que deben pasar todas las implementaciones de repository.Repository,
+// así el repositorio en memoria y el de postgres se comportan igual
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/repository"
+)
+
+// Factory devuelve un repositorio vacío para cada prueba, con postgres se deben vaciar las tablas antes de devolverlo
+type Factory func(t *testing.T) repository.Repository
+
+// Run ejecuta toda la suite contra el repositorio que devuelve newRepo, se usa desde el _test.go de cada implementación:
+//
+//	func TestConformance(t *testing.T) {
+//		repositorytest.Run(t, func(t *testing.T) repository.Repository { return database.NewMemoryRepository() })
+//	}
+func Run(t *testing.T, newRepo Factory) {
+	tests := map[string]func(t *testing.T, repo repository.Repository){
+		"InsertAndGetUser":    testInsertAndGetUser,
+		"DuplicateEmail":      testDuplicateEmail,
+		"MissingUser":         testMissingUser,
+		"UserRoles":           testUserRoles,
+		"ListUsers":           testListUsers,
+		"MarkUserVerified":    testMarkUserVerified,
+		"UpdateUserPassword":  testUpdateUserPassword,
+		"InsertAndGetPost":    testInsertAndGetPost,
+		"UpdatePostOwnership": testUpdatePostOwnership,
+		"DeletePostOwnership": testDeletePostOwnership,
+		"ListPostOrder":       testListPostOrder,
+		"RefreshTokenUse":     testRefreshTokenUse,
+		"RefreshTokenFamily":  testRefreshTokenFamily,
+		"RevokeToken":         testRevokeToken,
+		"RevokeUserTokens":    testRevokeUserTokens,
+		"APIKeys":             testAPIKeys,
+		"RevokeAPIKey":        testRevokeAPIKey,
+		"PasswordResetToken":  testPasswordResetToken,
+		"TOTPEnrollment":      testTOTPEnrollment,
+		"TOTPReplay":          testTOTPReplay,
+		"RecoveryCodes":       testRecoveryCodes,
+		"LoginAttempts":       testLoginAttempts,
+		"Sessions":            testSessions,
+		"RevokeSession":       testRevokeSession,
+		"ExternalIdentities":  testExternalIdentities,
+		"OIDCLoginState":      testOIDCLoginState,
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			repo := newRepo(t)
+			defer repo.Close()
+			test(t, repo)
+		})
+	}
+}
+
+// NewUser inserta un usuario con id y email únicos
+func NewUser(t *testing.T, repo repository.Repository) *models.User {
+	t.Helper()
+	id := ksuid.New().String()
+	user := &models.User{Id: id, Email: id + "@example.com", Password: "hashed-" + id}
+	if err := repo.InsertUser(context.Background(), user); err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+	return user
+}
+
+// NewPost inserta un post del usuario con id único
+func NewPost(t *testing.T, repo repository.Repository, userId string, content string) *models.Post {
+	t.Helper()
+	post := &models.Post{Id: ksuid.New().String(), PostContent: content, UserId: userId}
+	if err := repo.InsertPost(context.Background(), post); err != nil {
+		t.Fatalf("InsertPost: %v", err)
+	}
+	return post
+}
+
+func testInsertAndGetUser(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+
+	byId, err := repo.GetUserByID(ctx, user.Id)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if byId.Id != user.Id || byId.Email != user.Email {
+		t.Errorf("GetUserByID = %+v, want %+v", byId, user)
+	}
+	// GetUserByID nunca devuelve el password
+	if byId.Password != "" {
+		t.Errorf("GetUserByID returned the password")
+	}
+
+	byEmail, err := repo.GetUserByEmail(ctx, user.Email)
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	// GetUserByEmail sí devuelve el password para poder autenticar
+	if byEmail.Id != user.Id || byEmail.Password != user.Password {
+		t.Errorf("GetUserByEmail = %+v, want %+v", byEmail, user)
+	}
+}
+
+func testDuplicateEmail(t *testing.T, repo repository.Repository) {
+	user := NewUser(t, repo)
+	duplicate := &models.User{Id: ksuid.New().String(), Email: user.Email, Password: "other"}
+	if err := repo.InsertUser(context.Background(), duplicate); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("InsertUser with a duplicate email = %v, want ErrConflict", err)
+	}
+}
+
+func testMissingUser(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	if _, err := repo.GetUserByID(ctx, ksuid.New().String()); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetUserByID of a missing user = %v, want ErrNotFound", err)
+	}
+	if _, err := repo.GetUserByEmail(ctx, "missing@example.com"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetUserByEmail of a missing user = %v, want ErrNotFound", err)
+	}
+}
+
+// sin roles el usuario queda con ROLE_USER y los roles se pueden cambiar
+func testUserRoles(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+
+	got, err := repo.GetUserByID(ctx, user.Id)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if fmt.Sprint(got.Roles) != fmt.Sprint([]string{models.ROLE_USER}) {
+		t.Errorf("default roles = %v, want [%s]", got.Roles, models.ROLE_USER)
+	}
+	roles := []string{models.ROLE_USER, models.ROLE_ADMIN}
+	if err = repo.UpdateUserRoles(ctx, user.Id, roles); err != nil {
+		t.Fatalf("UpdateUserRoles: %v", err)
+	}
+	got, err = repo.GetUserByEmail(ctx, user.Email)
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	if fmt.Sprint(got.Roles) != fmt.Sprint(roles) {
+		t.Errorf("roles = %v, want %v", got.Roles, roles)
+	}
+	if err = repo.UpdateUserRoles(ctx, ksuid.New().String(), roles); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UpdateUserRoles of a missing user = %v, want ErrNotFound", err)
+	}
+}
+
+func testMarkUserVerified(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	got, err := repo.GetUserByID(ctx, user.Id)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if got.Verified {
+		t.Errorf("new user is verified")
+	}
+	if err = repo.MarkUserVerified(ctx, user.Id); err != nil {
+		t.Fatalf("MarkUserVerified: %v", err)
+	}
+	if got, err = repo.GetUserByEmail(ctx, user.Email); err != nil || !got.Verified {
+		t.Errorf("GetUserByEmail after MarkUserVerified = %+v, %v, want verified", got, err)
+	}
+	if err = repo.MarkUserVerified(ctx, ksuid.New().String()); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("MarkUserVerified of a missing user = %v, want ErrNotFound", err)
+	}
+}
+
+func testUpdateUserPassword(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	if err := repo.UpdateUserPassword(ctx, user.Id, "new-hash"); err != nil {
+		t.Fatalf("UpdateUserPassword: %v", err)
+	}
+	got, err := repo.GetUserByEmail(ctx, user.Email)
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	if got.Password != "new-hash" {
+		t.Errorf("password after UpdateUserPassword = %q, want %q", got.Password, "new-hash")
+	}
+	if err = repo.UpdateUserPassword(ctx, ksuid.New().String(), "new-hash"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UpdateUserPassword of a missing user = %v, want ErrNotFound", err)
+	}
+}
+
+// ListUsers devuelve los usuarios en orden de creación y sin passwords
+func testListUsers(t *testing.T, repo repository.Repository) {
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, NewUser(t, repo).Id)
+		time.Sleep(2 * time.Millisecond)
+	}
+	users, err := repo.ListUsers(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	var listed []string
+	for _, user := range users {
+		if user.Password != "" {
+			t.Errorf("ListUsers returned the password of %s", user.Id)
+		}
+		listed = append(listed, user.Id)
+	}
+	if fmt.Sprint(listed) != fmt.Sprint(ids) {
+		t.Errorf("ListUsers = %v, want %v", listed, ids)
+	}
+}
+
+func testInsertAndGetPost(t *testing.T, repo repository.Repository) {
+	user := NewUser(t, repo)
+	post := NewPost(t, repo, user.Id, "hello")
+
+	got, err := repo.GetPostByID(context.Background(), post.Id)
+	if err != nil {
+		t.Fatalf("GetPostByID: %v", err)
+	}
+	if got.Id != post.Id || got.PostContent != post.PostContent || got.UserId != user.Id {
+		t.Errorf("GetPostByID = %+v, want %+v", got, post)
+	}
+	if got.CreatedAt.IsZero() {
+		t.Errorf("GetPostByID returned an empty created_at")
+	}
+	if _, err = repo.GetPostByID(context.Background(), ksuid.New().String()); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetPostByID of a missing post = %v, want ErrNotFound", err)
+	}
+}
+
+func testUpdatePostOwnership(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	owner := NewUser(t, repo)
+	other := NewUser(t, repo)
+	post := NewPost(t, repo, owner.Id, "original")
+
+	// otro usuario no puede editar el post
+	err := repo.UpdatePost(ctx, &models.Post{Id: post.Id, PostContent: "hacked"}, other.Id)
+	if !errors.Is(err, repository.ErrForbidden) {
+		t.Errorf("UpdatePost by another user = %v, want ErrForbidden", err)
+	}
+	err = repo.UpdatePost(ctx, &models.Post{Id: ksuid.New().String(), PostContent: "missing"}, owner.Id)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UpdatePost of a missing post = %v, want ErrNotFound", err)
+	}
+
+	updated := &models.Post{Id: post.Id, PostContent: "edited"}
+	if err = repo.UpdatePost(ctx, updated, owner.Id); err != nil {
+		t.Fatalf("UpdatePost: %v", err)
+	}
+	// UpdatePost devuelve la fila guardada, no solo lo que se editó
+	if updated.UserId != owner.Id || updated.CreatedAt.IsZero() {
+		t.Errorf("UpdatePost left %+v, want the stored post", updated)
+	}
+	got, err := repo.GetPostByID(ctx, post.Id)
+	if err != nil {
+		t.Fatalf("GetPostByID: %v", err)
+	}
+	if got.PostContent != "edited" {
+		t.Errorf("post content = %q, want %q", got.PostContent, "edited")
+	}
+}
+
+func testDeletePostOwnership(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	owner := NewUser(t, repo)
+	other := NewUser(t, repo)
+	post := NewPost(t, repo, owner.Id, "bye")
+
+	if err := repo.DeletePost(ctx, post.Id, other.Id); !errors.Is(err, repository.ErrForbidden) {
+		t.Errorf("DeletePost by another user = %v, want ErrForbidden", err)
+	}
+	if err := repo.DeletePost(ctx, post.Id, owner.Id); err != nil {
+		t.Fatalf("DeletePost: %v", err)
+	}
+	if err := repo.DeletePost(ctx, post.Id, owner.Id); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("DeletePost of a deleted post = %v, want ErrNotFound", err)
+	}
+	if _, err := repo.GetPostByID(ctx, post.Id); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetPostByID after delete = %v, want ErrNotFound", err)
+	}
+}
+
+// las páginas son de 5 posts y van ordenadas por fecha de creación
+func testListPostOrder(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	var ids []string
+	for i := 0; i < 7; i++ {
+		ids = append(ids, NewPost(t, repo, user.Id, fmt.Sprintf("post %d", i)).Id)
+		// para que cada post tenga un created_at distinto
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	var listed []string
+	for page := uint64(0); page < 3; page++ {
+		posts, err := repo.ListPost(ctx, page)
+		if err != nil {
+			t.Fatalf("ListPost(%d): %v", page, err)
+		}
+		if page == 0 && len(posts) != 5 {
+			t.Errorf("ListPost(0) returned %d posts, want 5", len(posts))
+		}
+		for _, post := range posts {
+			listed = append(listed, post.Id)
+		}
+	}
+	if fmt.Sprint(listed) != fmt.Sprint(ids) {
+		t.Errorf("ListPost order = %v, want %v", listed, ids)
+	}
+}
+
+// insert guarda los fixtures de la tabla con el método del repositorio, ej: insert(t, repo.InsertSession, sessions...)
+func insert[T any](t *testing.T, save func(ctx context.Context, fixture *T) error, fixtures ...*T) {
+	t.Helper()
+	for _, fixture := range fixtures {
+		if err := save(context.Background(), fixture); err != nil {
+			t.Fatalf("insert %T: %v", fixture, err)
+		}
+	}
+}
+
+// unique devuelve un valor distinto en cada llamada para los ids y hashes de los fixtures
+func unique(prefix string) string {
+	return prefix + ksuid.New().String()
+}
+
+// un refresh token solo se puede usar una vez
+func testRefreshTokenUse(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	token := &models.RefreshToken{Id: unique(""), UserId: user.Id, FamilyId: unique(""), TokenHash: unique("hash-"), ExpiresAt: time.Now().Add(time.Hour)}
+	insert(t, repo.InsertRefreshToken, token)
+
+	got, err := repo.GetRefreshTokenByHash(ctx, token.TokenHash)
+	if err != nil {
+		t.Fatalf("GetRefreshTokenByHash: %v", err)
+	}
+	if got.Id != token.Id || got.UserId != user.Id || got.FamilyId != token.FamilyId || got.UsedAt != nil || got.RevokedAt != nil {
+		t.Errorf("GetRefreshTokenByHash = %+v, want %+v", got, token)
+	}
+	if _, err = repo.GetRefreshTokenByHash(ctx, "missing"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetRefreshTokenByHash of a missing token = %v, want ErrNotFound", err)
+	}
+
+	if err = repo.UseRefreshToken(ctx, token.Id); err != nil {
+		t.Fatalf("UseRefreshToken: %v", err)
+	}
+	for _, tc := range []struct {
+		name string
+		id   string
+		want error
+	}{
+		{"a used token", token.Id, repository.ErrConflict},
+		{"a missing token", unique(""), repository.ErrNotFound},
+	} {
+		if err = repo.UseRefreshToken(ctx, tc.id); !errors.Is(err, tc.want) {
+			t.Errorf("UseRefreshToken of %s = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	got, err = repo.GetRefreshTokenByHash(ctx, token.TokenHash)
+	if err != nil {
+		t.Fatalf("GetRefreshTokenByHash: %v", err)
+	}
+	if got.UsedAt == nil {
+		t.Errorf("used refresh token has no used_at")
+	}
+}
+
+// revocar la familia revoca todos sus tokens y ninguno de otra familia
+func testRefreshTokenFamily(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	family := unique("")
+	expiresAt := time.Now().Add(time.Hour)
+	tests := []struct {
+		token   *models.RefreshToken
+		revoked bool
+	}{
+		{&models.RefreshToken{Id: unique(""), UserId: user.Id, FamilyId: family, TokenHash: unique("hash-"), ExpiresAt: expiresAt}, true},
+		{&models.RefreshToken{Id: unique(""), UserId: user.Id, FamilyId: family, TokenHash: unique("hash-"), ExpiresAt: expiresAt}, true},
+		{&models.RefreshToken{Id: unique(""), UserId: user.Id, FamilyId: unique(""), TokenHash: unique("hash-"), ExpiresAt: expiresAt}, false},
+	}
+	for _, tc := range tests {
+		insert(t, repo.InsertRefreshToken, tc.token)
+	}
+
+	if err := repo.RevokeRefreshTokenFamily(ctx, family); err != nil {
+		t.Fatalf("RevokeRefreshTokenFamily: %v", err)
+	}
+	for _, tc := range tests {
+		got, err := repo.GetRefreshTokenByHash(ctx, tc.token.TokenHash)
+		if err != nil {
+			t.Fatalf("GetRefreshTokenByHash: %v", err)
+		}
+		if (got.RevokedAt != nil) != tc.revoked {
+			t.Errorf("refresh token of family %s revoked = %v, want %v", tc.token.FamilyId, got.RevokedAt != nil, tc.revoked)
+		}
+	}
+	if err := repo.UseRefreshToken(ctx, tests[1].token.Id); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("UseRefreshToken of a revoked token = %v, want ErrConflict", err)
+	}
+}
+
+func testRevokeToken(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	jti := unique("")
+
+	revoked, err := repo.IsTokenRevoked(ctx, jti)
+	if err != nil || revoked {
+		t.Fatalf("IsTokenRevoked before revoking = %v, %v, want false", revoked, err)
+	}
+	token := &models.RevokedToken{Id: jti, UserId: user.Id, ExpiresAt: time.Now().Add(time.Hour)}
+	if err = repo.RevokeToken(ctx, token); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+	// revocar dos veces el mismo token no es un error
+	if err = repo.RevokeToken(ctx, token); err != nil {
+		t.Fatalf("RevokeToken twice: %v", err)
+	}
+	if revoked, err = repo.IsTokenRevoked(ctx, jti); err != nil || !revoked {
+		t.Errorf("IsTokenRevoked = %v, %v, want true", revoked, err)
+	}
+
+	// un token de un solo uso solo se puede consumir una vez, aunque lo hayan revocado con RevokeToken
+	single := &models.RevokedToken{Id: unique(""), UserId: user.Id, ExpiresAt: time.Now().Add(time.Hour)}
+	for _, tc := range []struct {
+		name  string
+		token *models.RevokedToken
+		want  error
+	}{
+		{"a new token", single, nil},
+		{"a consumed token", single, repository.ErrConflict},
+		{"a revoked token", token, repository.ErrConflict},
+	} {
+		if err = repo.ConsumeToken(ctx, tc.token); !errors.Is(err, tc.want) {
+			t.Errorf("ConsumeToken of %s = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	if revoked, err = repo.IsTokenRevoked(ctx, single.Id); err != nil || !revoked {
+		t.Errorf("IsTokenRevoked of a consumed token = %v, %v, want true", revoked, err)
+	}
+}
+
+func testRevokeUserTokens(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	other := NewUser(t, repo)
+
+	before, err := repo.GetUserTokensRevokedBefore(ctx, user.Id)
+	if err != nil || !before.IsZero() {
+		t.Fatalf("GetUserTokensRevokedBefore before revoking = %v, %v, want zero", before, err)
+	}
+	// la fecha se guarda con precisión de microsegundos, los tokens creados en el mismo segundo después de revocar siguen valiendo
+	revokedAt := time.Now().Truncate(time.Second).Add(123456 * time.Microsecond)
+	if err = repo.RevokeUserTokens(ctx, user.Id, revokedAt); err != nil {
+		t.Fatalf("RevokeUserTokens: %v", err)
+	}
+	// una fecha anterior no puede volver a habilitar tokens ya revocados
+	if err = repo.RevokeUserTokens(ctx, user.Id, revokedAt.Add(-time.Hour)); err != nil {
+		t.Fatalf("RevokeUserTokens: %v", err)
+	}
+	if before, err = repo.GetUserTokensRevokedBefore(ctx, user.Id); err != nil || !before.Equal(revokedAt) {
+		t.Errorf("GetUserTokensRevokedBefore = %v, %v, want %v", before, err, revokedAt)
+	}
+	if before, err = repo.GetUserTokensRevokedBefore(ctx, other.Id); err != nil || !before.IsZero() {
+		t.Errorf("GetUserTokensRevokedBefore of another user = %v, %v, want zero", before, err)
+	}
+
+	token := &models.RefreshToken{Id: unique(""), UserId: user.Id, FamilyId: unique(""), TokenHash: unique("hash-"), ExpiresAt: time.Now().Add(time.Hour)}
+	insert(t, repo.InsertRefreshToken, token)
+	if err = repo.RevokeUserRefreshTokens(ctx, user.Id); err != nil {
+		t.Fatalf("RevokeUserRefreshTokens: %v", err)
+	}
+	got, err := repo.GetRefreshTokenByHash(ctx, token.TokenHash)
+	if err != nil {
+		t.Fatalf("GetRefreshTokenByHash: %v", err)
+	}
+	if got.RevokedAt == nil {
+		t.Errorf("RevokeUserRefreshTokens did not revoke the refresh token")
+	}
+}
+
+func testAPIKeys(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	other := NewUser(t, repo)
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	keys := []*models.APIKey{
+		{Id: unique(""), UserId: user.Id, Name: "cli", Prefix: "rws_cli", KeyHash: unique("hash-"), Scopes: []string{models.SCOPE_POSTS_READ}},
+		{Id: unique(""), UserId: user.Id, Name: "ci", Prefix: "rws_ci", KeyHash: unique("hash-"),
+			Scopes: []string{models.SCOPE_POSTS_READ, models.SCOPE_POSTS_WRITE}, ExpiresAt: &expiresAt},
+		{Id: unique(""), UserId: other.Id, Name: "other", Prefix: "rws_other", KeyHash: unique("hash-"), Scopes: []string{models.SCOPE_POSTS_READ}},
+	}
+	for _, key := range keys {
+		insert(t, repo.InsertAPIKey, key)
+		// ListAPIKeys las ordena por fecha de creación
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	for _, key := range keys {
+		got, err := repo.GetAPIKeyByHash(ctx, key.KeyHash)
+		if err != nil {
+			t.Fatalf("GetAPIKeyByHash: %v", err)
+		}
+		if got.Id != key.Id || got.UserId != key.UserId || got.Name != key.Name || fmt.Sprint(got.Scopes) != fmt.Sprint(key.Scopes) {
+			t.Errorf("GetAPIKeyByHash = %+v, want %+v", got, key)
+		}
+		if (got.ExpiresAt == nil) != (key.ExpiresAt == nil) || (got.ExpiresAt != nil && !got.ExpiresAt.Equal(*key.ExpiresAt)) {
+			t.Errorf("expires at = %v, want %v", got.ExpiresAt, key.ExpiresAt)
+		}
+	}
+	if _, err := repo.GetAPIKeyByHash(ctx, "missing"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetAPIKeyByHash of a missing key = %v, want ErrNotFound", err)
+	}
+
+	listed, err := repo.ListAPIKeys(ctx, user.Id)
+	if err != nil {
+		t.Fatalf("ListAPIKeys: %v", err)
+	}
+	if len(listed) != 2 || listed[0].Id != keys[0].Id || listed[1].Id != keys[1].Id {
+		t.Errorf("ListAPIKeys returned %d keys, want %s and %s in order", len(listed), keys[0].Id, keys[1].Id)
+	}
+}
+
+func testRevokeAPIKey(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	owner := NewUser(t, repo)
+	other := NewUser(t, repo)
+	key := &models.APIKey{Id: unique(""), UserId: owner.Id, Name: "cli", Prefix: "rws_cli", KeyHash: unique("hash-"), Scopes: []string{models.SCOPE_POSTS_READ}}
+	insert(t, repo.InsertAPIKey, key)
+
+	for _, tc := range []struct {
+		name   string
+		id     string
+		userId string
+		want   error
+	}{
+		{"another user", key.Id, other.Id, repository.ErrForbidden},
+		{"the owner of a missing key", unique(""), owner.Id, repository.ErrNotFound},
+		{"the owner", key.Id, owner.Id, nil},
+	} {
+		if err := repo.RevokeAPIKey(ctx, tc.id, tc.userId); !errors.Is(err, tc.want) {
+			t.Errorf("RevokeAPIKey by %s = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	got, err := repo.GetAPIKeyByHash(ctx, key.KeyHash)
+	if err != nil {
+		t.Fatalf("GetAPIKeyByHash: %v", err)
+	}
+	if got.RevokedAt == nil {
+		t.Errorf("revoked api key has no revoked_at")
+	}
+
+	// RevokeUserAPIKeys revoca todas las llaves del usuario y ninguna de otro
+	keys := []*models.APIKey{
+		{Id: unique(""), UserId: owner.Id, Name: "ci", Prefix: "rws_ci", KeyHash: unique("hash-"), Scopes: []string{models.SCOPE_POSTS_READ}},
+		{Id: unique(""), UserId: other.Id, Name: "other", Prefix: "rws_other", KeyHash: unique("hash-"), Scopes: []string{models.SCOPE_POSTS_READ}},
+	}
+	insert(t, repo.InsertAPIKey, keys...)
+	if err = repo.RevokeUserAPIKeys(ctx, owner.Id); err != nil {
+		t.Fatalf("RevokeUserAPIKeys: %v", err)
+	}
+	for _, key := range keys {
+		got, err := repo.GetAPIKeyByHash(ctx, key.KeyHash)
+		if err != nil {
+			t.Fatalf("GetAPIKeyByHash: %v", err)
+		}
+		if (got.RevokedAt != nil) != (key.UserId == owner.Id) {
+			t.Errorf("api key of %s revoked = %v after RevokeUserAPIKeys of %s", key.UserId, got.RevokedAt != nil, owner.Id)
+		}
+	}
+}
+
+// un token se usa una sola vez y al usarlo se guarda el password nuevo, dejan de servir los demás tokens del usuario
+// pero no los de otros usuarios, y uno vencido ya no sirve
+func testPasswordResetToken(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	other := NewUser(t, repo)
+	expired := NewUser(t, repo)
+	later := time.Now().Add(time.Hour)
+	older := &models.PasswordResetToken{Id: unique(""), UserId: user.Id, TokenHash: unique("hash-"), ExpiresAt: later}
+	newer := &models.PasswordResetToken{Id: unique(""), UserId: user.Id, TokenHash: unique("hash-"), ExpiresAt: later}
+	othersToken := &models.PasswordResetToken{Id: unique(""), UserId: other.Id, TokenHash: unique("hash-"), ExpiresAt: later}
+	expiredToken := &models.PasswordResetToken{Id: unique(""), UserId: expired.Id, TokenHash: unique("hash-"), ExpiresAt: time.Now().Add(-time.Minute)}
+	insert(t, repo.InsertPasswordResetToken, older, newer, othersToken, expiredToken)
+
+	// leer el token no lo usa
+	got, err := repo.GetPasswordResetToken(ctx, newer.TokenHash)
+	if err != nil {
+		t.Fatalf("GetPasswordResetToken: %v", err)
+	}
+	if got.Id != newer.Id || got.UserId != user.Id || got.UsedAt != nil {
+		t.Errorf("GetPasswordResetToken = %+v, want %+v", got, newer)
+	}
+	used, err := repo.UsePasswordResetToken(ctx, newer.TokenHash, "new-password-hash")
+	if err != nil {
+		t.Fatalf("UsePasswordResetToken: %v", err)
+	}
+	if used.Id != newer.Id || used.UserId != user.Id || used.UsedAt == nil {
+		t.Errorf("UsePasswordResetToken = %+v, want %+v used", used, newer)
+	}
+	if stored, err := repo.GetUserByEmail(ctx, user.Email); err != nil || stored.Password != "new-password-hash" {
+		t.Errorf("password after UsePasswordResetToken = %v, %v, want new-password-hash", stored, err)
+	}
+	for _, tc := range []struct {
+		name string
+		hash string
+		want error
+	}{
+		{"a used token", newer.TokenHash, repository.ErrNotFound},
+		{"an older token of the user", older.TokenHash, repository.ErrNotFound},
+		{"another user's token", othersToken.TokenHash, nil},
+		{"an expired token", expiredToken.TokenHash, repository.ErrNotFound},
+		{"a missing token", "missing", repository.ErrNotFound},
+	} {
+		if _, err = repo.GetPasswordResetToken(ctx, tc.hash); !errors.Is(err, tc.want) {
+			t.Errorf("GetPasswordResetToken of %s = %v, want %v", tc.name, err, tc.want)
+		}
+		if _, err = repo.UsePasswordResetToken(ctx, tc.hash, "other-password-hash"); !errors.Is(err, tc.want) {
+			t.Errorf("UsePasswordResetToken of %s = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	if stored, err := repo.GetUserByEmail(ctx, user.Email); err != nil || stored.Password != "new-password-hash" {
+		t.Errorf("a rejected token changed the password to %v, %v", stored, err)
+	}
+}
+
+// el secret se puede reemplazar mientras no esté activo, después solo se puede borrar
+func testTOTPEnrollment(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	if _, err := repo.GetTOTP(ctx, user.Id); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetTOTP without totp = %v, want ErrNotFound", err)
+	}
+	if err := repo.EnableTOTP(ctx, user.Id, 1); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("EnableTOTP without secret = %v, want ErrNotFound", err)
+	}
+	if err := repo.SaveTOTPSecret(ctx, user.Id, "FIRST"); err != nil {
+		t.Fatalf("SaveTOTPSecret: %v", err)
+	}
+	if err := repo.SaveTOTPSecret(ctx, user.Id, "SECOND"); err != nil {
+		t.Fatalf("SaveTOTPSecret replacing a pending secret: %v", err)
+	}
+	totp, err := repo.GetTOTP(ctx, user.Id)
+	if err != nil {
+		t.Fatalf("GetTOTP: %v", err)
+	}
+	if totp.Secret != "SECOND" || totp.Enabled {
+		t.Errorf("GetTOTP = %+v, want pending secret SECOND", totp)
+	}
+	if err = repo.EnableTOTP(ctx, user.Id, 100); err != nil {
+		t.Fatalf("EnableTOTP: %v", err)
+	}
+	if err = repo.EnableTOTP(ctx, user.Id, 101); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("EnableTOTP of an enabled totp = %v, want ErrConflict", err)
+	}
+	if err = repo.SaveTOTPSecret(ctx, user.Id, "THIRD"); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("SaveTOTPSecret with an enabled totp = %v, want ErrConflict", err)
+	}
+	if totp, err = repo.GetTOTP(ctx, user.Id); err != nil || !totp.Enabled || totp.Secret != "SECOND" || totp.LastUsedStep != 100 {
+		t.Errorf("GetTOTP after EnableTOTP = %+v, %v", totp, err)
+	}
+	if err = repo.DeleteTOTP(ctx, user.Id); err != nil {
+		t.Fatalf("DeleteTOTP: %v", err)
+	}
+	if err = repo.DeleteTOTP(ctx, user.Id); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("DeleteTOTP without totp = %v, want ErrNotFound", err)
+	}
+}
+
+// un código no se acepta dos veces ni después de usar uno posterior
+func testTOTPReplay(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	if err := repo.SaveTOTPSecret(ctx, user.Id, "SECRET"); err != nil {
+		t.Fatalf("SaveTOTPSecret: %v", err)
+	}
+	if err := repo.UseTOTPStep(ctx, user.Id, 10); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("UseTOTPStep of a pending totp = %v, want ErrConflict", err)
+	}
+	if err := repo.EnableTOTP(ctx, user.Id, 10); err != nil {
+		t.Fatalf("EnableTOTP: %v", err)
+	}
+	for step, want := range map[int64]error{10: repository.ErrConflict, 9: repository.ErrConflict} {
+		if err := repo.UseTOTPStep(ctx, user.Id, step); !errors.Is(err, want) {
+			t.Errorf("UseTOTPStep(%d) = %v, want %v", step, err, want)
+		}
+	}
+	if err := repo.UseTOTPStep(ctx, user.Id, 11); err != nil {
+		t.Fatalf("UseTOTPStep: %v", err)
+	}
+	if err := repo.UseTOTPStep(ctx, user.Id, 11); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("UseTOTPStep of a used step = %v, want ErrConflict", err)
+	}
+}
+
+// cada código de recuperación sirve una vez, reemplazarlos invalida los anteriores y borrar el TOTP los borra
+func testRecoveryCodes(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	other := NewUser(t, repo)
+	if err := repo.SaveTOTPSecret(ctx, user.Id, "SECRET"); err != nil {
+		t.Fatalf("SaveTOTPSecret: %v", err)
+	}
+	if err := repo.ReplaceRecoveryCodes(ctx, user.Id, []string{"a", "b"}); err != nil {
+		t.Fatalf("ReplaceRecoveryCodes: %v", err)
+	}
+	if err := repo.UseRecoveryCode(ctx, user.Id, "a"); err != nil {
+		t.Fatalf("UseRecoveryCode: %v", err)
+	}
+	if err := repo.UseRecoveryCode(ctx, user.Id, "a"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UseRecoveryCode of a used code = %v, want ErrNotFound", err)
+	}
+	if err := repo.UseRecoveryCode(ctx, other.Id, "b"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UseRecoveryCode of another user's code = %v, want ErrNotFound", err)
+	}
+	if err := repo.ReplaceRecoveryCodes(ctx, user.Id, []string{"c"}); err != nil {
+		t.Fatalf("ReplaceRecoveryCodes: %v", err)
+	}
+	if err := repo.UseRecoveryCode(ctx, user.Id, "b"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UseRecoveryCode of a replaced code = %v, want ErrNotFound", err)
+	}
+	if err := repo.DeleteTOTP(ctx, user.Id); err != nil {
+		t.Fatalf("DeleteTOTP: %v", err)
+	}
+	if err := repo.UseRecoveryCode(ctx, user.Id, "c"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UseRecoveryCode after DeleteTOTP = %v, want ErrNotFound", err)
+	}
+}
+
+// los fallos se suman por llave, empiezan de cero si el último es anterior a resetBefore y se borran con DeleteLoginAttempt
+func testLoginAttempts(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	key := "account:" + ksuid.New().String()
+	other := "ip:" + ksuid.New().String()
+	if _, err := repo.GetLoginAttempt(ctx, key); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetLoginAttempt without failures = %v, want ErrNotFound", err)
+	}
+	now := time.Now().Truncate(time.Second)
+	for i := 1; i <= 3; i++ {
+		attempt, err := repo.RecordLoginFailure(ctx, key, now, now.Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+		if attempt.Failures != i {
+			t.Errorf("failures after %d RecordLoginFailure = %d", i, attempt.Failures)
+		}
+	}
+	if _, err := repo.RecordLoginFailure(ctx, other, now, now.Add(-time.Hour)); err != nil {
+		t.Fatalf("RecordLoginFailure: %v", err)
+	}
+	attempt, err := repo.GetLoginAttempt(ctx, key)
+	if err != nil {
+		t.Fatalf("GetLoginAttempt: %v", err)
+	}
+	if attempt.Key != key || attempt.Failures != 3 || !attempt.LastFailureAt.Equal(now) {
+		t.Errorf("GetLoginAttempt = %+v, want 3 failures at %v", attempt, now)
+	}
+	// el último fallo ya es viejo, el contador vuelve a empezar
+	later := now.Add(2 * time.Hour)
+	if attempt, err = repo.RecordLoginFailure(ctx, key, later, later.Add(-time.Hour)); err != nil || attempt.Failures != 1 {
+		t.Errorf("RecordLoginFailure after the window = %+v, %v, want 1 failure", attempt, err)
+	}
+	if err = repo.DeleteLoginAttempt(ctx, key); err != nil {
+		t.Fatalf("DeleteLoginAttempt: %v", err)
+	}
+	if _, err = repo.GetLoginAttempt(ctx, key); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetLoginAttempt after DeleteLoginAttempt = %v, want ErrNotFound", err)
+	}
+}
+
+// newSession es una sesión del usuario que vence en ttl, se guarda con insert
+func newSession(userId string, ttl time.Duration) *models.Session {
+	return &models.Session{Id: unique(""), UserId: userId, Device: "Firefox on Linux",
+		UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", IP: "192.0.2.1", ExpiresAt: time.Now().Add(ttl)}
+}
+
+// la lista solo tiene las sesiones activas del usuario, las revocadas y las vencidas se siguen pudiendo leer por id
+func testSessions(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	other := NewUser(t, repo)
+	first := newSession(user.Id, time.Hour)
+	second := newSession(user.Id, time.Hour)
+	expired := newSession(user.Id, -time.Minute)
+	insert(t, repo.InsertSession, first)
+	// ListSessions las ordena por fecha de creación
+	time.Sleep(2 * time.Millisecond)
+	insert(t, repo.InsertSession, second, expired, newSession(other.Id, time.Hour))
+	if err := repo.InsertSession(ctx, first); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("InsertSession with a duplicate id = %v, want ErrConflict", err)
+	}
+
+	got, err := repo.GetSession(ctx, first.Id)
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if got.UserId != user.Id || got.Device != first.Device || got.UserAgent != first.UserAgent || got.IP != first.IP || got.RevokedAt != nil {
+		t.Errorf("GetSession = %+v, want %+v", got, first)
+	}
+	if got.CreatedAt.IsZero() || got.LastSeenAt.IsZero() {
+		t.Errorf("new session has created at %v and last seen at %v", got.CreatedAt, got.LastSeenAt)
+	}
+	for _, tc := range []struct {
+		name string
+		id   string
+		want error
+	}{
+		{"an expired session", expired.Id, nil},
+		{"a missing session", unique(""), repository.ErrNotFound},
+	} {
+		if _, err = repo.GetSession(ctx, tc.id); !errors.Is(err, tc.want) {
+			t.Errorf("GetSession of %s = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	sessions, err := repo.ListSessions(ctx, user.Id)
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(sessions) != 2 || sessions[0].Id != first.Id || sessions[1].Id != second.Id {
+		t.Errorf("ListSessions returned %d sessions, want %s and %s in order", len(sessions), first.Id, second.Id)
+	}
+
+	seenAt := time.Now().Add(time.Minute).Truncate(time.Second)
+	expiresAt := seenAt.Add(2 * time.Hour)
+	if err = repo.TouchSession(ctx, first.Id, "198.51.100.7", seenAt, expiresAt); err != nil {
+		t.Fatalf("TouchSession: %v", err)
+	}
+	if got, err = repo.GetSession(ctx, first.Id); err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if got.IP != "198.51.100.7" || !got.LastSeenAt.Equal(seenAt) || !got.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("session after TouchSession = %+v, want ip 198.51.100.7 seen at %v until %v", got, seenAt, expiresAt)
+	}
+	if err = repo.TouchSession(ctx, unique(""), "198.51.100.7", seenAt, expiresAt); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("TouchSession of a missing session = %v, want ErrNotFound", err)
+	}
+}
+
+func testRevokeSession(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	owner := NewUser(t, repo)
+	other := NewUser(t, repo)
+	session := newSession(owner.Id, time.Hour)
+	remaining := newSession(owner.Id, time.Hour)
+	othersSession := newSession(other.Id, time.Hour)
+	insert(t, repo.InsertSession, session, remaining, othersSession)
+
+	for _, tc := range []struct {
+		name   string
+		id     string
+		userId string
+		want   error
+	}{
+		{"another user", session.Id, other.Id, repository.ErrForbidden},
+		{"the owner of a missing session", unique(""), owner.Id, repository.ErrNotFound},
+		{"the owner", session.Id, owner.Id, nil},
+	} {
+		if err := repo.RevokeSession(ctx, tc.id, tc.userId); !errors.Is(err, tc.want) {
+			t.Errorf("RevokeSession by %s = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	got, err := repo.GetSession(ctx, session.Id)
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if got.RevokedAt == nil {
+		t.Errorf("revoked session has no revoked_at")
+	}
+	if sessions, err := repo.ListSessions(ctx, owner.Id); err != nil || len(sessions) != 1 || sessions[0].Id != remaining.Id {
+		t.Errorf("ListSessions after RevokeSession = %v, %v, want only %s", sessions, err, remaining.Id)
+	}
+
+	if err = repo.RevokeUserSessions(ctx, owner.Id); err != nil {
+		t.Fatalf("RevokeUserSessions: %v", err)
+	}
+	if sessions, err := repo.ListSessions(ctx, owner.Id); err != nil || len(sessions) != 0 {
+		t.Errorf("ListSessions after RevokeUserSessions = %d sessions, %v, want none", len(sessions), err)
+	}
+	if sessions, err := repo.ListSessions(ctx, other.Id); err != nil || len(sessions) != 1 || sessions[0].Id != othersSession.Id {
+		t.Errorf("RevokeUserSessions revoked the sessions of another user")
+	}
+}
+
+// la misma cuenta del proveedor solo se vincula a un usuario, pero un usuario puede tener cuentas de varios proveedores
+func testExternalIdentities(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := NewUser(t, repo)
+	other := NewUser(t, repo)
+	subject := unique("")
+	identity := &models.ExternalIdentity{Provider: "google", Subject: subject, UserId: user.Id, Email: user.Email}
+	insert(t, repo.InsertExternalIdentity, identity, &models.ExternalIdentity{Provider: "okta", Subject: subject, UserId: user.Id, Email: user.Email})
+	duplicate := &models.ExternalIdentity{Provider: "google", Subject: subject, UserId: other.Id, Email: other.Email}
+	if err := repo.InsertExternalIdentity(ctx, duplicate); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("InsertExternalIdentity of a linked identity = %v, want ErrConflict", err)
+	}
+
+	got, err := repo.GetExternalIdentity(ctx, "google", subject)
+	if err != nil {
+		t.Fatalf("GetExternalIdentity: %v", err)
+	}
+	if got.Provider != "google" || got.Subject != subject || got.UserId != user.Id || got.Email != user.Email || got.CreatedAt.IsZero() {
+		t.Errorf("GetExternalIdentity = %+v, want %+v", got, identity)
+	}
+	if _, err = repo.GetExternalIdentity(ctx, "github", subject); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetExternalIdentity of another provider = %v, want ErrNotFound", err)
+	}
+}
+
+// un state se usa una sola vez y uno vencido ya no sirve
+func testOIDCLoginState(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	state := &models.OIDCLoginState{StateHash: unique("hash-"), Provider: "google", Nonce: unique("nonce-"), CodeVerifier: unique("verifier-"),
+		ExpiresAt: time.Now().Add(time.Minute)}
+	expired := &models.OIDCLoginState{StateHash: unique("hash-"), Provider: "google", Nonce: unique("nonce-"), CodeVerifier: unique("verifier-"),
+		ExpiresAt: time.Now().Add(-time.Minute)}
+	insert(t, repo.InsertOIDCLoginState, state, expired)
+
+	got, err := repo.UseOIDCLoginState(ctx, state.StateHash)
+	if err != nil {
+		t.Fatalf("UseOIDCLoginState: %v", err)
+	}
+	if got.Provider != state.Provider || got.Nonce != state.Nonce || got.CodeVerifier != state.CodeVerifier {
+		t.Errorf("UseOIDCLoginState = %+v, want %+v", got, state)
+	}
+	for _, tc := range []struct {
+		name string
+		hash string
+	}{
+		{"a used state", state.StateHash},
+		{"an expired state", expired.StateHash},
+		{"a missing state", "missing"},
+	} {
+		if _, err = repo.UseOIDCLoginState(ctx, tc.hash); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("UseOIDCLoginState of %s = %v, want ErrNotFound", tc.name, err)
+		}
+	}
+}
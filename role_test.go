@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"platzi.com/go/rest-ws/models"
+)
+
+// la ruta decide que los moderadores eliminan cualquier post, los demás usuarios solo los suyos
+func TestModeratorDeletesAnyPost(t *testing.T) {
+	api := newTestAPI(t, nil)
+	api.signup("author@example.com")
+	api.signup("other@example.com")
+	moderator := api.signup("moderator@example.com")
+	api.setRoles(moderator, models.ROLE_USER, models.ROLE_MODERATOR)
+	status, body := api.request(http.MethodPost, "/api/v1/posts", api.login("author@example.com"), map[string]string{"post_content": "hello"})
+	if status != http.StatusOK {
+		t.Fatalf("insert post: %d %s", status, body)
+	}
+	var post struct{ Id string }
+	json.Unmarshal([]byte(body), &post)
+
+	tests := []struct {
+		email  string
+		status int
+	}{
+		{"other@example.com", http.StatusForbidden},
+		{"moderator@example.com", http.StatusOK},
+		{"moderator@example.com", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		if status, body := api.request(http.MethodDelete, "/api/v1/posts/"+post.Id, api.login(tc.email), nil); status != tc.status {
+			t.Fatalf("delete by %s: expected %d, got %d %s", tc.email, tc.status, status, body)
+		}
+	}
+}
+
+func TestUpdateUserRoles(t *testing.T) {
+	api := newTestAPI(t, nil)
+	user := api.signup("user@example.com")
+	admin := api.signup("admin@example.com")
+	api.setRoles(admin, models.ROLE_USER, models.ROLE_ADMIN)
+	token := api.login("admin@example.com")
+
+	tests := []struct {
+		roles  []string
+		status int
+		want   []string
+	}{
+		{[]string{models.ROLE_MODERATOR, models.ROLE_MODERATOR, models.ROLE_USER}, http.StatusOK, []string{models.ROLE_USER, models.ROLE_MODERATOR}},
+		{[]string{"root"}, http.StatusBadRequest, nil},
+		{[]string{}, http.StatusOK, []string{models.ROLE_USER}},
+	}
+	for _, tc := range tests {
+		status, body := api.request(http.MethodPut, "/api/v1/users/"+user.Id+"/roles", token, map[string][]string{"roles": tc.roles})
+		if status != tc.status {
+			t.Fatalf("roles %v: expected %d, got %d %s", tc.roles, tc.status, status, body)
+		}
+		if tc.want == nil {
+			continue
+		}
+		var updated models.User
+		json.Unmarshal([]byte(body), &updated)
+		if fmt.Sprint(updated.Roles) != fmt.Sprint(tc.want) {
+			t.Errorf("roles %v: stored %v, want %v", tc.roles, updated.Roles, tc.want)
+		}
+	}
+}
@@ -4,22 +4,67 @@ package server
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
+	"platzi.com/go/rest-ws/auth"
 	database "platzi.com/go/rest-ws/database"
+	"platzi.com/go/rest-ws/mail"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/oidc"
 	repository "platzi.com/go/rest-ws/repository"
 	websocket "platzi.com/go/rest-ws/websocket"
 )
 
 // Definir un struct para la configuración que el servidor requiere para poder ejecutarse,
 // definir el puerto, la llave secreta y la conexión a la db:
+// WSQueueSize y WSOverflowPolicy definen el tamaño de la cola de cada cliente del websocket y qué hacer cuando se llena (ver websocket.OverflowPolicy)
+// WSHistorySize es la cantidad de mensajes que se guardan para los clientes que se reconectan con last_event_id
+// JWTKeysDir es el directorio con las llaves privadas (<kid>.pem, RSA o Ed25519) con las que se firman los tokens, JWTSigningKey el kid de la llave activa
+// y JWTKeysNotAfter hasta cuándo valida tokens cada llave retirada (por kid), sin JWTKeysDir se firma con HS256 y JWTSecret;
+// con JWTKeysDir, JWTPreviousSecret valida los tokens HS256 que ya se habían emitido hasta JWTPreviousSecretNotAfter
+// AccessTokenTTL es lo que dura el access token (jwt) y RefreshTokenTTL lo que dura cada refresh token, con cero se usan los valores por defecto
+// Mail elige cómo se envían los correos (ver mail.Config), PublicURL es la url con la que se arman los enlaces de los correos (por defecto http://localhost con el puerto)
+// y con RequireVerifiedEmail el login rechaza a los usuarios que no han verificado su email
+// LoginAttempts define dónde se cuentan los logins fallidos: "memory" (por defecto, una sola instancia) o "repository" (en la db, compartidos entre instancias)
+// y con TrustProxyHeaders la ip del cliente es la última de X-Forwarded-For, solo se debe activar detrás de un proxy que agregue la ip a ese header
+// PasswordHashing elige el algoritmo y los parámetros de los hashes de los passwords (ver auth.HashConfig) y PasswordPolicy las reglas de los passwords nuevos
+// OIDCProviders son los proveedores de identidad externos con los que se puede hacer login en /auth/{provider}/login,
+// si un proveedor no trae RedirectURL se usa PublicURL + /auth/{provider}/callback
+// TOTPIssuer es el nombre con el que aparece la cuenta en las apps de autenticación (por defecto DEFAULT_TOTP_ISSUER)
+// Backplane define cómo se comparten los mensajes del hub entre instancias: "memory" (una sola instancia, por defecto) o "postgres" (LISTEN/NOTIFY en la db)
 type Config struct {
-	Port        string
-	JWTSecret   string
-	DatabaseUrl string
+	Port                      string
+	JWTSecret                 string
+	JWTKeysDir                string
+	JWTSigningKey             string
+	JWTKeysNotAfter           map[string]time.Time
+	JWTPreviousSecret         string
+	JWTPreviousSecretNotAfter time.Time
+	DatabaseUrl               string
+	WSQueueSize               int
+	WSOverflowPolicy          string
+	WSHistorySize             int
+	Backplane                 string
+	AccessTokenTTL            time.Duration
+	RefreshTokenTTL           time.Duration
+	Mail                      mail.Config
+	PublicURL                 string
+	RequireVerifiedEmail      bool
+	TOTPIssuer                string
+	LoginAttempts             string
+	TrustProxyHeaders         bool
+	PasswordHashing           auth.HashConfig
+	PasswordPolicy            auth.PasswordPolicy
+	OIDCProviders             []oidc.ProviderConfig
 }
 
 // Interfaz para el tipo Server, se requiere un método Config() que lo que hará será retornar algo de tipo Config
@@ -27,16 +72,49 @@ type Config struct {
 type Server interface {
 	Config() *Config
 	Hub() *websocket.Hub // con websocket, pasar el HUB en el server
+	Auth() auth.Authenticator
+	Issuer() auth.Issuer
+	Revocations() auth.RevocationStore
+	Keys() *auth.KeyRing
+	Mailer() mail.Mailer
+	LoginThrottle() *auth.LoginThrottle
+	PasswordResetThrottle() *auth.LoginThrottle
+	Passwords() auth.PasswordHasher
+	OIDCProvider(name string) (*oidc.Provider, bool)
 }
 
 // Definir el broker que será quien maneje los servidores que tendrá un archivo de configuración (config) con las propiedades definidas previamente (Con port, llave y conexión a db)
 // También tendrá un router que definirá las rutas que el API tendrá, se usa la dependencia de tipo mux (*mux.Router)
+// ctx es el contexto que se pasa en NewServer, cuando se cancela el servidor se detiene de forma ordenada
 type Broker struct {
+	ctx    context.Context
 	config *Config
 	router *mux.Router
 	hub    *websocket.Hub
+	auth   auth.Authenticator
+	issuer auth.Issuer
+	keys   *auth.KeyRing
+	mailer mail.Mailer
+	// limita los intentos de login fallidos por cuenta y por ip
+	loginThrottle *auth.LoginThrottle
+	// limita los correos para recuperar el password por email y por ip
+	passwordResetThrottle *auth.LoginThrottle
+	passwords             auth.PasswordHasher
+	// proveedores de identidad externos por nombre
+	oidcProviders map[string]*oidc.Provider
+	// tokens revocados con logout, el auth ya los rechaza
+	revocations auth.RevocationStore
 }
 
+const (
+	// tiempo máximo que se espera a que terminen las peticiones en curso al detener el servidor
+	SHUTDOWN_TIMEOUT = 15 * time.Second
+	// duración por defecto de los tokens, el access token dura poco y se renueva con el refresh token en /token/refresh
+	DEFAULT_ACCESS_TOKEN_TTL  = 15 * time.Minute
+	DEFAULT_REFRESH_TOKEN_TTL = 30 * 24 * time.Hour
+	DEFAULT_TOTP_ISSUER       = "rest-ws"
+)
+
 // Se requiere que el broker satisfaga la interface, se crea un receiver function llamado Config() que retornará una configuración (*Config)
 // y lo que se hace es devolver la configuración
 func (b *Broker) Config() *Config {
@@ -48,6 +126,52 @@ func (b *Broker) Hub() *websocket.Hub {
 	return b.hub
 }
 
+// Auth devuelve el Authenticator con el que el middleware y el websocket validan los tokens
+func (b *Broker) Auth() auth.Authenticator {
+	return b.auth
+}
+
+// Issuer devuelve con qué se crean los access tokens en el login y en el refresh
+func (b *Broker) Issuer() auth.Issuer {
+	return b.issuer
+}
+
+// Keys devuelve las llaves con las que se firman los tokens, sus llaves públicas se publican en /.well-known/jwks.json
+func (b *Broker) Keys() *auth.KeyRing {
+	return b.keys
+}
+
+// Mailer devuelve con qué se envían los correos, por ejemplo el de verificación de email
+func (b *Broker) Mailer() mail.Mailer {
+	return b.mailer
+}
+
+// LoginThrottle devuelve con qué se limitan los intentos de login
+func (b *Broker) LoginThrottle() *auth.LoginThrottle {
+	return b.loginThrottle
+}
+
+// PasswordResetThrottle devuelve con qué se limitan los pedidos para recuperar el password
+func (b *Broker) PasswordResetThrottle() *auth.LoginThrottle {
+	return b.passwordResetThrottle
+}
+
+// Passwords devuelve con qué se crean y verifican los hashes de los passwords
+func (b *Broker) Passwords() auth.PasswordHasher {
+	return b.passwords
+}
+
+// OIDCProvider devuelve el proveedor de identidad externo con ese nombre, false si no está configurado
+func (b *Broker) OIDCProvider(name string) (*oidc.Provider, bool) {
+	provider, ok := b.oidcProviders[name]
+	return provider, ok
+}
+
+// Revocations devuelve dónde se guardan los tokens revocados con logout
+func (b *Broker) Revocations() auth.RevocationStore {
+	return b.revocations
+}
+
 // Definir el constructor para el struct, que recibe 2 parámetros, primero un contexto que se usará para encontrar posibles problemas en el código,
 // y el segundo parámetro será la configuración, de tipo previamente definido (*Config), luego hay que retornar el Broker y si hay un error, devolver ese error
 func NewServer(ctx context.Context, config *Config) (*Broker, error) {
@@ -56,21 +180,169 @@ func NewServer(ctx context.Context, config *Config) (*Broker, error) {
 	if config.Port == "" {
 		return nil, errors.New("port is required")
 	}
-	if config.JWTSecret == "" {
-		return nil, errors.New("jwt secret is required")
+	if config.JWTSecret == "" && config.JWTKeysDir == "" {
+		return nil, errors.New("jwt secret or jwt keys dir is required")
 	}
 	if config.DatabaseUrl == "" {
 		return nil, errors.New("database url is required")
 	}
+	if config.AccessTokenTTL <= 0 {
+		config.AccessTokenTTL = DEFAULT_ACCESS_TOKEN_TTL
+	}
+	if config.RefreshTokenTTL <= 0 {
+		config.RefreshTokenTTL = DEFAULT_REFRESH_TOKEN_TTL
+	}
+	if config.PublicURL == "" {
+		config.PublicURL = "http://localhost" + config.Port
+	}
+	config.PublicURL = strings.TrimSuffix(config.PublicURL, "/")
+	if config.TOTPIssuer == "" {
+		config.TOTPIssuer = DEFAULT_TOTP_ISSUER
+	}
+	overflowPolicy, err := websocket.ParseOverflowPolicy(config.WSOverflowPolicy)
+	if err != nil {
+		return nil, err
+	}
 	// Si no hay errores, entonces retornar el broker con su configuración y el router nuevo:
 	broker := &Broker{
-		config: config,
-		router: mux.NewRouter(), // Define una nueva instancia del broker
-		hub:    websocket.NewHub(),
+		ctx:         ctx,
+		config:      config,
+		router:      mux.NewRouter(), // Define una nueva instancia del broker
+		revocations: auth.NewCachedRevocationStore(auth.REVOCATION_CACHE_TTL),
+	}
+	// este es el único lugar donde se elige cómo se autentican las peticiones, los tokens revocados se rechazan aunque sigan vigentes
+	broker.keys, err = newKeyRing(config)
+	if err != nil {
+		return nil, err
+	}
+	tokens := auth.NewJWTAuthenticator(broker.keys, config.AccessTokenTTL)
+	broker.issuer = tokens
+	// también se aceptan las API keys personales en lugar del jwt
+	broker.auth = auth.WithAPIKeys(auth.WithRevocation(tokens, broker.revocations))
+	broker.mailer, err = mail.NewMailer(config.Mail)
+	if err != nil {
+		return nil, err
+	}
+	broker.passwords, err = auth.NewPasswordHasher(config.PasswordHashing)
+	if err != nil {
+		return nil, err
+	}
+	attempts, err := newAttemptStore(config)
+	if err != nil {
+		return nil, err
+	}
+	broker.loginThrottle = auth.NewLoginThrottle(attempts)
+	broker.passwordResetThrottle = auth.NewPasswordResetThrottle(attempts)
+	broker.oidcProviders, err = newOIDCProviders(config)
+	if err != nil {
+		return nil, err
+	}
+	backplane, err := newBackplane(config)
+	if err != nil {
+		return nil, err
+	}
+	// el hub valida los tokens de los websockets con el mismo Authenticator que el resto del API, las API keys necesitan el scope posts:read
+	broker.hub, err = websocket.NewHub(websocket.HubConfig{
+		Authenticate:   auth.RequireScope(broker.auth, models.SCOPE_POSTS_READ).AuthenticateToken,
+		QueueSize:      config.WSQueueSize,
+		OverflowPolicy: overflowPolicy,
+		Backplane:      backplane,
+		HistorySize:    config.WSHistorySize,
+	})
+	if err != nil {
+		return nil, err
 	}
 	return broker, nil
 }
 
+// newKeyRing carga las llaves de JWTKeysDir, o usa el secret con HS256 si no se configuró el directorio
+func newKeyRing(config *Config) (*auth.KeyRing, error) {
+	if config.JWTKeysDir == "" {
+		if config.JWTPreviousSecret != "" {
+			return nil, errors.New("jwt previous secret requires jwt keys dir")
+		}
+		return auth.NewHMACKeyRing(config.JWTSecret), nil
+	}
+	ring, err := auth.LoadKeyRing(config.JWTKeysDir, config.JWTSigningKey, config.JWTKeysNotAfter)
+	if err != nil {
+		return nil, err
+	}
+	if config.JWTPreviousSecret != "" {
+		if err = ring.AcceptHMAC(config.JWTPreviousSecret, config.JWTPreviousSecretNotAfter); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+// newOIDCProviders crea los proveedores de la configuración, los nombres no se pueden repetir porque van en las rutas
+func newOIDCProviders(config *Config) (map[string]*oidc.Provider, error) {
+	providers := make(map[string]*oidc.Provider)
+	for _, providerConfig := range config.OIDCProviders {
+		if _, ok := providers[providerConfig.Name]; ok {
+			return nil, fmt.Errorf("oidc provider %q is configured twice", providerConfig.Name)
+		}
+		if providerConfig.RedirectURL == "" {
+			providerConfig.RedirectURL = config.PublicURL + "/auth/" + providerConfig.Name + "/callback"
+		}
+		provider, err := oidc.NewProvider(providerConfig, nil)
+		if err != nil {
+			return nil, err
+		}
+		providers[providerConfig.Name] = provider
+	}
+	return providers, nil
+}
+
+// newRepository crea el repository según la url de la db, con DATABASE_URL=memory:// se usa el repositorio en memoria,
+// con postgres no se arranca si falta aplicar alguna migración
+func newRepository(ctx context.Context, config *Config) (repository.Repository, error) {
+	if strings.HasPrefix(config.DatabaseUrl, database.MEMORY_URL_SCHEME) {
+		return database.NewMemoryRepository(), nil
+	}
+	repo, err := database.NewPostgresRepository(config.DatabaseUrl)
+	if err != nil {
+		return nil, err
+	}
+	migrator, err := repo.Migrator()
+	if err != nil {
+		repo.Close()
+		return nil, err
+	}
+	if err = migrator.Check(ctx); err != nil {
+		repo.Close()
+		return nil, fmt.Errorf("database is not migrated, run \"migrate up\": %w", err)
+	}
+	return repo, nil
+}
+
+// newAttemptStore elige dónde se cuentan los logins fallidos
+func newAttemptStore(config *Config) (auth.AttemptStore, error) {
+	switch config.LoginAttempts {
+	case "", "memory":
+		return auth.NewMemoryAttemptStore(), nil
+	case "repository":
+		return auth.RepositoryAttemptStore{}, nil
+	default:
+		return nil, fmt.Errorf("unknown login attempts store %q", config.LoginAttempts)
+	}
+}
+
+// newBackplane crea el backplane del hub según la configuración, el de postgres usa la misma db que el repository
+func newBackplane(config *Config) (websocket.Backplane, error) {
+	switch config.Backplane {
+	case "", "memory":
+		return websocket.NewMemoryBackplane(), nil
+	case "postgres":
+		if strings.HasPrefix(config.DatabaseUrl, database.MEMORY_URL_SCHEME) {
+			return nil, errors.New("postgres backplane requires a postgres database url")
+		}
+		return database.NewPostgresBackplane(config.DatabaseUrl)
+	default:
+		return nil, fmt.Errorf("unknown backplane %q", config.Backplane)
+	}
+}
+
 // Agregar un método al broker que le permita ejecutarse, en ese caso se llama Start() que recibe una función como parámetro (binder),
 // La función binder recibe como parámetro un servidor de tipo Server y un routeador:
 func (b *Broker) Start(binder func(s Server, r *mux.Router)) {
@@ -81,7 +353,7 @@ func (b *Broker) Start(binder func(s Server, r *mux.Router)) {
 	// agregar un handler para manejar las conexiones:
 	handler := cors.Default().Handler(b.router)
 	// crear repository con la configuracion de la db:
-	repo, err := database.NewPostgresRepository(b.config.DatabaseUrl)
+	repo, err := newRepository(b.ctx, b.config)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -89,14 +361,42 @@ func (b *Broker) Start(binder func(s Server, r *mux.Router)) {
 	go b.hub.Run()
 	// se envía el repo en el repository
 	repository.SetRepository(repo)
-	// Imprimir mensaje con el puerto en el que se ejecuta:
-	log.Println("starting server on port", b.config.Port)
-	// Ejecutar el servidor:
-	// if err := http.ListenAndServe(b.config.Port, b.router); err != nil {
+	// el servidor se detiene cuando se cancela el contexto de NewServer o cuando llega SIGINT o SIGTERM (por ejemplo de docker)
+	ctx, stop := signal.NotifyContext(b.ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	// cambiar el segundo parámetro que era definido en el router (b.router), por el handler que da la función de Default().Handler
-	if err := http.ListenAndServe(b.config.Port, handler); err != nil {
+	httpServer := &http.Server{
+		Addr:    b.config.Port,
+		Handler: handler,
+	}
+	// los websockets no cuentan como peticiones en curso, por eso al empezar el Shutdown se cierran los clientes del hub con "going away"
+	httpServer.RegisterOnShutdown(b.hub.Shutdown)
+
+	errs := make(chan error, 1)
+	go func() {
+		// Imprimir mensaje con el puerto en el que se ejecuta:
+		log.Println("starting server on port", b.config.Port)
+		// Ejecutar el servidor:
+		errs <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
 		log.Println("error starting server:", err)
-	} else {
-		log.Fatalf("server stopped")
+	case <-ctx.Done():
+		log.Println("shutting down server")
+		// se esperan las peticiones en curso hasta SHUTDOWN_TIMEOUT
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Println("error shutting down server:", err)
+		}
+	}
+	// por si el servidor no llegó a arrancar, se detiene el hub de todas formas
+	b.hub.Shutdown()
+	// cerrar las conexiones de la db:
+	if err := repository.Close(); err != nil {
+		log.Println("error closing repository:", err)
 	}
+	log.Println("server stopped")
 }
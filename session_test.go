@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"platzi.com/go/rest-ws/handlers"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/server"
+)
+
+// detrás de un proxy la ip de la sesión es la última de X-Forwarded-For normalizada, las anteriores las puede inventar el cliente,
+// y si el header no trae una ip se usa la de la conexión
+func TestSessionIPFromProxyHeader(t *testing.T) {
+	api := newTestAPI(t, &server.Config{TrustProxyHeaders: true})
+	api.signup("user@example.com")
+	tests := []struct {
+		forwarded string
+		want      string
+	}{
+		{"2001:0db8:0000::1", "2001:db8::1"},
+		{"203.0.113.7, 2001:0db8:0000::1", "2001:db8::1"},
+		{"2001:db8::1, " + strings.Repeat("x", 1000), "127.0.0.1"},
+	}
+	for _, tc := range tests {
+		data, _ := json.Marshal(map[string]string{"email": "user@example.com", "password": TEST_PASSWORD})
+		req, _ := http.NewRequest(http.MethodPost, api.server.URL+"/login", bytes.NewReader(data))
+		req.Header.Set("X-Forwarded-For", tc.forwarded)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var login struct{ Token string }
+		json.NewDecoder(res.Body).Decode(&login)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("login: %d", res.StatusCode)
+		}
+
+		status, body := api.request(http.MethodGet, "/api/v1/sessions", login.Token, nil)
+		if status != http.StatusOK {
+			t.Fatalf("list sessions: %d %s", status, body)
+		}
+		var sessions []models.Session
+		json.Unmarshal([]byte(body), &sessions)
+		if len(sessions) == 0 || sessions[len(sessions)-1].IP != tc.want {
+			t.Errorf("X-Forwarded-For %.20q: sessions %s, want the last one with ip %s", tc.forwarded, body, tc.want)
+		}
+	}
+}
+
+// el user agent se guarda cortado sin partir caracteres de varios bytes y sin bytes que no sean UTF-8, Postgres los rechazaría
+func TestSessionUserAgentIsValidUTF8(t *testing.T) {
+	api := newTestAPI(t, nil)
+	user := api.signup("user@example.com")
+	for _, userAgent := range []string{
+		strings.Repeat("a", handlers.SESSION_USER_AGENT_MAX-1) + "é",
+		strings.Repeat("ñ", handlers.SESSION_USER_AGENT_MAX),
+		"Mozilla/5.0 \xff\xfe",
+	} {
+		data, _ := json.Marshal(map[string]string{"email": "user@example.com", "password": TEST_PASSWORD})
+		req, _ := http.NewRequest(http.MethodPost, api.server.URL+"/login", bytes.NewReader(data))
+		req.Header.Set("User-Agent", userAgent)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("login: %d", res.StatusCode)
+		}
+	}
+	sessions, err := api.repo.ListSessions(context.Background(), user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, session := range sessions {
+		if !utf8.ValidString(session.UserAgent) || len(session.UserAgent) > handlers.SESSION_USER_AGENT_MAX {
+			t.Errorf("stored user agent of %d bytes %.20q is not valid", len(session.UserAgent), session.UserAgent)
+		}
+	}
+}
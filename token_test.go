@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/segmentio/ksuid"
+	"platzi.com/go/rest-ws/auth"
+	"platzi.com/go/rest-ws/models"
+	"platzi.com/go/rest-ws/server"
+)
+
+// cerrar todas las sesiones revoca los tokens anteriores pero no el del login que viene justo después, aunque sea en el mismo segundo
+func TestLoginRightAfterLogoutAll(t *testing.T) {
+	api := newTestAPI(t, nil)
+	api.signup("user@example.com")
+	old := api.login("user@example.com")
+	if status, body := api.request(http.MethodPost, "/api/v1/logout/all", old, nil); status != http.StatusOK {
+		t.Fatalf("logout all: %d %s", status, body)
+	}
+	token := api.login("user@example.com")
+	if status, _ := api.request(http.MethodGet, "/api/v1/me", old, nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a token issued before the logout, got %d", status)
+	}
+	if status, body := api.request(http.MethodGet, "/api/v1/me", token, nil); status != http.StatusOK {
+		t.Fatalf("expected 200 for the new login, got %d %s", status, body)
+	}
+}
+
+// al cambiar los roles el usuario debe volver a hacer login, el nuevo token tiene los roles nuevos
+func TestLoginRightAfterRoleChange(t *testing.T) {
+	api := newTestAPI(t, nil)
+	user := api.signup("user@example.com")
+	admin := api.signup("admin@example.com")
+	api.setRoles(admin, models.ROLE_USER, models.ROLE_ADMIN)
+	old := api.login("user@example.com")
+
+	path := "/api/v1/users/" + user.Id + "/roles"
+	if status, body := api.request(http.MethodPut, path, api.login("admin@example.com"), map[string][]string{"roles": {models.ROLE_ADMIN}}); status != http.StatusOK {
+		t.Fatalf("update roles: %d %s", status, body)
+	}
+	token := api.login("user@example.com")
+	if status, _ := api.request(http.MethodGet, "/api/v1/ws/metrics", old, nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a token issued before the role change, got %d", status)
+	}
+	if status, body := api.request(http.MethodGet, "/api/v1/ws/metrics", token, nil); status != http.StatusOK {
+		t.Fatalf("expected 200 with the new role, got %d %s", status, body)
+	}
+}
+
+// tokens hace la petición que entrega tokens y devuelve el access token y el refresh token
+func (api *testAPI) tokens(path string, body interface{}) (string, string) {
+	api.t.Helper()
+	status, response := api.request(http.MethodPost, path, "", body)
+	if status != http.StatusOK {
+		api.t.Fatalf("%s: %d %s", path, status, response)
+	}
+	var tokens struct{ Token, RefreshToken string }
+	json.Unmarshal([]byte(response), &tokens)
+	return tokens.Token, tokens.RefreshToken
+}
+
+// presentar un refresh token ya usado revoca toda su familia, también el token que salió de la rotación,
+// y no toca las sesiones de otros logins del usuario
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	api := newTestAPI(t, nil)
+	api.signup("user@example.com")
+	credentials := map[string]string{"email": "user@example.com", "password": TEST_PASSWORD}
+	access, refresh := api.tokens("/login", credentials)
+	other, _ := api.tokens("/login", credentials)
+
+	rotatedAccess, rotated := api.tokens("/token/refresh", map[string]string{"refreshToken": refresh})
+	if rotated == refresh {
+		t.Fatal("expected a new refresh token")
+	}
+	if status, _ := api.request(http.MethodPost, "/token/refresh", "", map[string]string{"refreshToken": refresh}); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for the reused refresh token, got %d", status)
+	}
+	if status, _ := api.request(http.MethodPost, "/token/refresh", "", map[string]string{"refreshToken": rotated}); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for the rotated refresh token of the revoked family, got %d", status)
+	}
+	for name, token := range map[string]string{"access token": access, "rotated access token": rotatedAccess} {
+		if status, _ := api.request(http.MethodGet, "/api/v1/me", token, nil); status != http.StatusUnauthorized {
+			t.Errorf("%s of the revoked family: expected 401, got %d", name, status)
+		}
+	}
+	if status, body := api.request(http.MethodGet, "/api/v1/me", other, nil); status != http.StatusOK {
+		t.Fatalf("expected the other session to keep working, got %d %s", status, body)
+	}
+}
+
+// al pasar de JWT_SECRET a JWT_KEYS_DIR los tokens HS256 ya emitidos valen hasta JWTPreviousSecretNotAfter, y una llave retirada hasta su fecha
+func TestKeyRingRotationWindow(t *testing.T) {
+	dir := t.TempDir()
+	for _, kid := range []string{"2022-09", "2022-10"} {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(filepath.Join(dir, kid+".pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name     string
+		notAfter time.Time
+		status   int
+	}{
+		{"inside the window", time.Now().Add(time.Hour), http.StatusOK},
+		{"after the window", time.Now().Add(-time.Hour), http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			api := newTestAPI(t, &server.Config{
+				JWTKeysDir:                dir,
+				JWTKeysNotAfter:           map[string]time.Time{"2022-09": tc.notAfter},
+				JWTPreviousSecret:         "previous-secret",
+				JWTPreviousSecretNotAfter: tc.notAfter,
+			})
+			user := api.signup("user@example.com")
+			previous, err := auth.LoadKeyRing(dir, "2022-09", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, ring := range map[string]*auth.KeyRing{"hs256": auth.NewHMACKeyRing("previous-secret"), "retired key": previous} {
+				token, err := ring.Sign(models.AppClaims{UserId: user.Id, StandardClaims: jwt.StandardClaims{
+					Id: ksuid.New().String(), IssuedAt: time.Now().Unix(), ExpiresAt: time.Now().Add(time.Hour).Unix(),
+				}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status, _ := api.request(http.MethodGet, "/api/v1/me", token, nil); status != tc.status {
+					t.Errorf("%s token: expected %d, got %d", name, tc.status, status)
+				}
+			}
+			if status, _ := api.request(http.MethodGet, "/api/v1/me", api.login("user@example.com"), nil); status != http.StatusOK {
+				t.Errorf("token of the active key: expected 200, got %d", status)
+			}
+		})
+	}
+}
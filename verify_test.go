@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"platzi.com/go/rest-ws/mail"
+	"platzi.com/go/rest-ws/mail/mailtest"
+	"platzi.com/go/rest-ws/server"
+)
+
+var verifyLink = regexp.MustCompile(`/verify\?token=(\S+)`)
+
+// newMailAPI arranca el API enviando los correos al servidor SMTP falso
+func newMailAPI(t *testing.T) (*testAPI, *mailtest.Server) {
+	t.Helper()
+	smtp, err := mailtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { smtp.Close() })
+	api := newTestAPI(t, &server.Config{Mail: mail.Config{Mailer: "smtp", From: "app@example.com", SMTPAddr: smtp.Addr}})
+	return api, smtp
+}
+
+// verificationToken devuelve el token del enlace del último correo enviado a email
+func verificationToken(t *testing.T, smtp *mailtest.Server, email string) string {
+	t.Helper()
+	messages := smtp.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if len(messages[i].To) != 1 || messages[i].To[0] != email {
+			continue
+		}
+		if !strings.Contains(messages[i].Data, "\nSubject: Verify your email\n") {
+			t.Fatalf("unexpected subject in %q", messages[i].Data)
+		}
+		match := verifyLink.FindStringSubmatch(messages[i].Data)
+		if match == nil {
+			t.Fatalf("no verification link in %q", messages[i].Data)
+		}
+		token, err := url.QueryUnescape(match[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	t.Fatalf("no message sent to %s", email)
+	return ""
+}
+
+func TestSignupSendsVerificationEmail(t *testing.T) {
+	api, smtp := newMailAPI(t)
+	user := api.signup("new@example.com")
+	if user.Verified {
+		t.Fatal("user verified before opening the link")
+	}
+	token := verificationToken(t, smtp, "new@example.com")
+	if smtp.Messages()[0].From != "app@example.com" {
+		t.Errorf("unexpected sender %s", smtp.Messages()[0].From)
+	}
+
+	path := "/verify?token=" + url.QueryEscape(token)
+	if status, body := api.request(http.MethodGet, path, "", nil); status != http.StatusOK {
+		t.Fatalf("verify: %d %s", status, body)
+	}
+	if status, _ := api.request(http.MethodGet, path, "", nil); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 reusing the link, got %d", status)
+	}
+	if verified, _ := api.repo.GetUserByEmail(context.Background(), "new@example.com"); !verified.Verified {
+		t.Fatal("user not verified after opening the link")
+	}
+}
+
+// si el mismo enlace se abre varias veces a la vez solo una petición lo usa
+func TestVerifyLinkIsSingleUse(t *testing.T) {
+	api, smtp := newMailAPI(t)
+	api.signup("new@example.com")
+	path := "/verify?token=" + url.QueryEscape(verificationToken(t, smtp, "new@example.com"))
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 8)
+	for i := 0; i < cap(statuses); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, _ := api.request(http.MethodGet, path, "", nil)
+			statuses <- status
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	verified := 0
+	for status := range statuses {
+		if status == http.StatusOK {
+			verified++
+		}
+	}
+	if verified != 1 {
+		t.Fatalf("expected the link to verify once, verified %d times", verified)
+	}
+}
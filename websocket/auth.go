@@ -0,0 +1,71 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"platzi.com/go/rest-ws/auth"
+)
+
+const (
+	// nombre del subprotocolo que el navegador envía junto al token en Sec-WebSocket-Protocol, ej: new WebSocket(url, ["access_token", token])
+	TOKEN_SUBPROTOCOL = "access_token"
+	// tiempo que se espera el primer frame de tipo "auth" cuando el token no viene en la petición http
+	AUTH_FRAME_TIMEOUT = 10 * time.Second
+)
+
+// Authenticator recibe el token enviado por el cliente y devuelve el usuario autenticado si es válido, o un error si no lo es,
+// el servidor pasa el AuthenticateToken del mismo auth.Authenticator que usa el middleware
+type Authenticator func(ctx context.Context, tokenString string) (*auth.Principal, error)
+
+// ClientMessage son los mensajes que el cliente envía por el socket:
+// {"type": "auth", "token": "..."}, {"type": "subscribe", "topic": "posts"} o {"type": "unsubscribe", "topic": "posts"}
+type ClientMessage struct {
+	Type  string `json:"type"`
+	Token string `json:"token,omitempty"`
+	Topic string `json:"topic,omitempty"`
+}
+
+// tokenFromRequest busca el token en la petición http antes de hacer el upgrade, en orden: query (?token=), header Authorization y Sec-WebSocket-Protocol
+// devuelve el token y, si vino en Sec-WebSocket-Protocol, el subprotocolo que se debe responder al navegador
+func tokenFromRequest(r *http.Request) (token string, subprotocol string) {
+	if token = strings.TrimSpace(r.URL.Query().Get("token")); token != "" {
+		return token, ""
+	}
+	if token = strings.TrimSpace(r.Header.Get("Authorization")); token != "" {
+		return strings.TrimSpace(strings.TrimPrefix(token, "Bearer ")), ""
+	}
+	// los navegadores no permiten headers personalizados en websockets, por eso el token se puede mandar como subprotocolo: ["access_token", "<jwt>"]
+	protocols := websocket.Subprotocols(r)
+	for i, p := range protocols {
+		if p == TOKEN_SUBPROTOCOL && i+1 < len(protocols) {
+			return protocols[i+1], TOKEN_SUBPROTOCOL
+		}
+	}
+	return "", ""
+}
+
+// tokenFromFirstFrame espera el primer mensaje del socket, que debe ser de tipo "auth", y devuelve el token que trae
+func tokenFromFirstFrame(socket *websocket.Conn) (string, error) {
+	socket.SetReadDeadline(time.Now().Add(AUTH_FRAME_TIMEOUT))
+	// al terminar se quita el deadline para no afectar a las siguientes lecturas
+	defer socket.SetReadDeadline(time.Time{})
+
+	_, data, err := socket.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	var message ClientMessage
+	if err = json.Unmarshal(data, &message); err != nil {
+		return "", err
+	}
+	if message.Type != "auth" || message.Token == "" {
+		return "", errors.New("first message must be of type auth")
+	}
+	return message.Token, nil
+}
@@ -0,0 +1,53 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+)
+
+// Backplane es el canal por el que pasan todos los mensajes del hub, permite que con varias instancias del servidor
+// (por ejemplo detrás de un load balancer) un mensaje publicado en una instancia llegue a los sockets conectados a las demás,
+// cada instancia publica en el backplane y recibe de él lo que publicaron todas (incluida ella misma)
+type Backplane interface {
+	Publish(ctx context.Context, payload []byte) error
+	// Subscribe registra la función que recibirá cada payload publicado en cualquier instancia
+	Subscribe(handler func(payload []byte)) error
+	Close() error
+}
+
+// MemoryBackplane es la implementación en memoria, sirve cuando hay una sola instancia y en los tests,
+// varios hubs que compartan el mismo MemoryBackplane se comportan como si fueran varias instancias
+type MemoryBackplane struct {
+	mutex    sync.Mutex
+	handlers []func(payload []byte)
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{}
+}
+
+// Publish entrega el payload a todos los suscriptores en el mismo goroutine, el hub nunca bloquea al entregar a sus clientes
+func (b *MemoryBackplane) Publish(ctx context.Context, payload []byte) error {
+	b.mutex.Lock()
+	handlers := make([]func(payload []byte), len(b.handlers))
+	copy(handlers, b.handlers)
+	b.mutex.Unlock()
+	for _, handler := range handlers {
+		handler(payload)
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(handler func(payload []byte)) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func (b *MemoryBackplane) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers = nil
+	return nil
+}
@@ -1,44 +1,163 @@
 package websocket
 
-import "github.com/gorilla/websocket"
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	// tiempo máximo para escribir un mensaje en el socket
+	WRITE_WAIT = 10 * time.Second
+	// tiempo máximo que se espera el pong del cliente, si no llega se considera que la conexión está muerta
+	PONG_WAIT = 60 * time.Second
+	// cada cuanto se envía un ping al cliente, debe ser menor que PONG_WAIT
+	PING_PERIOD = (PONG_WAIT * 9) / 10
+	// tamaño máximo de los mensajes que el cliente puede enviar
+	MAX_MESSAGE_SIZE = 4096
+)
 
 // definir un struct para el client que manejará las conexiones de diferentes clientes
 type Client struct {
-	// recibe un hub, un id para identificar al cliente, un socket de tipo conexion del websocket, y un canal de go llamaado outbound que servirá para enviar mensajes como si fueran byte
-	hub      *Hub
-	id       string
-	socket   *websocket.Conn
-	outbound chan []byte
+	// recibe un hub, un id para identificar la conexión, el id del usuario autenticado, un socket de tipo conexion del websocket, y un canal de go llamaado outbound que servirá para enviar mensajes como si fueran byte
+	hub        *Hub
+	id         string
+	userId     string
+	sessionId  string          // sesión del token con el que se autenticó, vacío con una API key
+	expiresAt  time.Time       // momento en el que vence el token con el que se autenticó el cliente (cero si no vence)
+	socket     *websocket.Conn // nil en los clientes SSE, que reciben los mensajes en HandleEvents
+	remoteAddr string
+	outbound   chan []byte // cola con buffer, ver send() para lo que pasa cuando se llena
+	expiry     *time.Timer
+	mutex      sync.Mutex // protege closed y expiry, para no enviar nunca a un canal cerrado
+	closed     bool
+	topics     map[string]bool // topics a los que está suscrito el cliente, se protege con el mutex del hub
+	// último id que recibió el cliente antes de reconectarse, nil si es una conexión nueva
+	resumeFrom *eventId
 }
 
-// crear new client que recibe un hub y un socket y devuelve un client
-func NewClient(hub *Hub, socket *websocket.Conn) *Client {
-	return &Client{
+// crear new client que recibe un hub, un socket y el id del usuario autenticado, y devuelve un client
+func NewClient(hub *Hub, socket *websocket.Conn, userId string) *Client {
+	client := &Client{
 		hub:      hub,
+		id:       ksuid.New().String(), // id único de la conexión, un mismo usuario puede tener varias conexiones abiertas
+		userId:   userId,
 		socket:   socket,
-		outbound: make(chan []byte), // canal nuevo
+		outbound: make(chan []byte, hub.config.QueueSize), // canal nuevo con el tamaño de cola configurado en el hub
+		topics:   make(map[string]bool),
 	}
+	if socket != nil {
+		client.remoteAddr = socket.RemoteAddr().String()
+	}
+	return client
 }
 
-// para enviar los mensajes que yo quiera creo una función llamad Write que pertenece al cliente, lo queremos en este caso para transmitir posts en tiempo real:
+// UserId devuelve el id del usuario con el que se autenticó el cliente
+func (c *Client) UserId() string {
+	return c.userId
+}
+
+// para enviar los mensajes que yo quiera creo una función llamad Write que pertenece al cliente, lo queremos en este caso para transmitir posts en tiempo real,
+// también envía un ping periódico para que el cliente responda con un pong y saber que la conexión sigue viva:
 func (c *Client) Write() {
+	ticker := time.NewTicker(PING_PERIOD)
+	defer func() {
+		ticker.Stop()
+		// al cerrar el socket, el Read del cliente falla y se encarga de desregistrarlo del hub
+		c.socket.Close()
+	}()
 	for {
 		// va a escuchar la multiplexacion de los diferentes chanels
 		select {
 		// caso de un mensaje que vendrá de un canal outbound
 		case message, ok := <-c.outbound:
+			c.socket.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
 			if !ok {
 				// si falla, cerrar la conexión de ese mensaje fallido, escribir un mensaje diciendo que la conexion se ha cerrado, envía un arreglo de bytes vacío, porque no requiero enviar data en este caso
 				c.socket.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 			// En caso de que se recibió el mensaje, escribirlo para transmitirlo
-			c.socket.WriteMessage(websocket.TextMessage, message)
+			if err := c.socket.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		// caso en el que toca enviar un ping:
+		case <-ticker.C:
+			if err := c.socket.WriteControl(websocket.PingMessage, nil, time.Now().Add(WRITE_WAIT)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Read lee los mensajes que envía el cliente (subscribe/unsubscribe), es el único lugar que detecta que la conexión se cerró (close frame, error de red o falta de pong),
+// y cuando eso pasa desregistra al cliente del hub
+func (c *Client) Read() {
+	defer c.hub.unregisterClient(c)
+	c.socket.SetReadLimit(MAX_MESSAGE_SIZE)
+	c.socket.SetReadDeadline(time.Now().Add(PONG_WAIT))
+	// cada pong recibido extiende el deadline de lectura
+	c.socket.SetPongHandler(func(string) error {
+		return c.socket.SetReadDeadline(time.Now().Add(PONG_WAIT))
+	})
+	for {
+		_, data, err := c.socket.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("websocket read error:", err)
+			}
+			return
 		}
+		c.handleClientMessage(data)
 	}
 }
 
-func (c Client) Close() {
-	c.socket.Close()
+// watchExpiry programa el cierre del socket cuando venza el token del cliente,
+// el timer se guarda con el mutex bloqueado porque closeLocked lo lee desde otros goroutines
+func (c *Client) watchExpiry() {
+	if c.expiresAt.IsZero() {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return
+	}
+	c.expiry = time.AfterFunc(time.Until(c.expiresAt), func() {
+		c.closeWithReason(websocket.ClosePolicyViolation, "token expired")
+	})
+}
+
+// closeWithReason avisa al cliente el motivo del cierre antes de cerrar su cola,
+// los clientes SSE no tienen socket, al cerrar su cola HandleEvents termina la respuesta
+func (c *Client) closeWithReason(code int, reason string) {
+	if c.socket != nil {
+		// WriteControl se puede llamar de forma concurrente con Write, por eso se usa para enviar el close frame con el motivo
+		c.socket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(WRITE_WAIT))
+	}
+	// al cerrar la cola, Write cierra el socket, y Read desregistra al cliente
+	c.Close()
+}
+
+// Close cierra el canal de salida, lo que hace que Write envíe el close frame y cierre el socket,
+// se puede llamar más de una vez sin hacer panic
+func (c *Client) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closeLocked()
+}
+
+// closeLocked debe llamarse con el mutex del cliente bloqueado
+func (c *Client) closeLocked() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
 	close(c.outbound)
 }
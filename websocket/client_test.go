@@ -0,0 +1,108 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"platzi.com/go/rest-ws/auth"
+)
+
+// testAuthenticate acepta cualquier token y usa el mismo token como id del usuario,
+// los tokens que empiezan con "expiring" vencen a los 200ms
+func testAuthenticate(ctx context.Context, tokenString string) (*auth.Principal, error) {
+	if tokenString == "invalid" {
+		return nil, errors.New("invalid token")
+	}
+	principal := &auth.Principal{UserId: tokenString}
+	if strings.HasPrefix(tokenString, "expiring") {
+		principal.ExpiresAt = time.Now().Add(200 * time.Millisecond)
+	}
+	return principal, nil
+}
+
+// newTestHub arranca un hub con su servidor de prueba en /ws y /events, se detienen al terminar el test
+func newTestHub(t *testing.T, config HubConfig) (*Hub, *httptest.Server) {
+	t.Helper()
+	if config.Authenticate == nil {
+		config.Authenticate = testAuthenticate
+	}
+	hub, err := NewHub(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hub.Run()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", hub.HandleWebSocket)
+	mux.HandleFunc("/events", hub.HandleEvents)
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		hub.Shutdown()
+		server.Close()
+	})
+	return hub, server
+}
+
+// dial abre un websocket con la query indicada y espera a que el hub registre al cliente
+func dial(t *testing.T, hub *Hub, server *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	clients := hub.Metrics().Clients
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?" + query
+	socket, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { socket.Close() })
+	waitFor(t, func() bool { return hub.Metrics().Clients > clients })
+	return socket
+}
+
+// waitFor espera hasta un segundo a que se cumpla la condición
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHandleWebSocketRejectsInvalidToken(t *testing.T) {
+	_, server := newTestHub(t, HubConfig{})
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?token=invalid"
+	_, res, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+	if res == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %v", res)
+	}
+}
+
+func TestClientClosedWhenTokenExpires(t *testing.T) {
+	hub, server := newTestHub(t, HubConfig{})
+	socket := dial(t, hub, server, "token=expiring")
+	socket.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := socket.ReadMessage()
+	var closeError *websocket.CloseError
+	if !errors.As(err, &closeError) || closeError.Code != websocket.ClosePolicyViolation || closeError.Text != "token expired" {
+		t.Fatalf("expected a token expired close frame, got %v", err)
+	}
+	waitFor(t, func() bool { return hub.Metrics().Clients == 0 })
+}
+
+func TestClientCloseIsIdempotent(t *testing.T) {
+	hub, server := newTestHub(t, HubConfig{})
+	dial(t, hub, server, "token=expiring-1")
+	hub.DisconnectUser("expiring-1")
+	waitFor(t, func() bool { return hub.Metrics().Clients == 0 })
+	// el timer de vencimiento se detuvo al cerrar la cola, si se dispara igual Close no debe hacer panic
+	time.Sleep(300 * time.Millisecond)
+}
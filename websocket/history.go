@@ -0,0 +1,172 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/ksuid"
+	"platzi.com/go/rest-ws/models"
+)
+
+// cantidad de mensajes por defecto que se guardan para los clientes que se reconectan
+const DEFAULT_HISTORY_SIZE = 1024
+
+// ResyncPayload es el payload del mensaje EVENT_RESYNC_REQUIRED, indica desde qué id sí se tienen mensajes
+type ResyncPayload struct {
+	LastEventId   string `json:"lastEventId"`
+	OldestEventId string `json:"oldestEventId"`
+}
+
+// eventId es el id de un mensaje: el epoch del hub que lo numeró y su número de secuencia en ese hub,
+// los números de secuencia de otro hub (otra instancia o antes de un reinicio) no se pueden comparar
+type eventId struct {
+	epoch string
+	seq   uint64
+}
+
+func (id eventId) String() string {
+	return id.epoch + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+// parseEventId convierte el id que manda el cliente, el epoch es un ksuid así que no tiene guiones
+func parseEventId(value string) (eventId, error) {
+	epoch, seq, found := strings.Cut(value, "-")
+	if !found || epoch == "" {
+		return eventId{}, errors.New("invalid last_event_id")
+	}
+	number, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return eventId{}, errors.New("invalid last_event_id")
+	}
+	return eventId{epoch: epoch, seq: number}, nil
+}
+
+// historyEntry es un mensaje ya numerado, data es lo que se envió a los clientes
+type historyEntry struct {
+	id    uint64
+	event hubEvent
+	data  []byte
+}
+
+// history es un ring buffer con los últimos mensajes del hub, cada mensaje recibe un número que siempre crece dentro del epoch,
+// el mutex también se mantiene mientras se entrega el mensaje, así un cliente que se reconecta no pierde ni duplica mensajes
+type history struct {
+	mutex   sync.Mutex
+	epoch   string // identifica a este hub, cambia en cada arranque
+	entries []historyEntry
+	start   int // posición del mensaje más viejo dentro de entries
+	size    int
+	lastId  uint64
+}
+
+func newHistory(size int) *history {
+	return &history{epoch: ksuid.New().String(), entries: make([]historyEntry, size)}
+}
+
+// eventId devuelve el id completo del número de secuencia
+func (h *history) eventId(seq uint64) eventId {
+	return eventId{epoch: h.epoch, seq: seq}
+}
+
+// append numera el evento y lo guarda, si el buffer está lleno se pierde el más viejo, debe llamarse con el mutex bloqueado
+func (h *history) append(event hubEvent) historyEntry {
+	h.lastId++
+	data, _ := json.Marshal(models.WebsocketMessage{
+		Id:      h.eventId(h.lastId).String(),
+		Type:    event.Type,
+		Payload: event.Payload,
+	})
+	entry := historyEntry{id: h.lastId, event: event, data: data}
+	if len(h.entries) == 0 {
+		return entry
+	}
+	if h.size < len(h.entries) {
+		h.entries[(h.start+h.size)%len(h.entries)] = entry
+		h.size++
+	} else {
+		h.entries[h.start] = entry
+		h.start = (h.start + 1) % len(h.entries)
+	}
+	return entry
+}
+
+// since devuelve los mensajes posteriores a last, si el historial ya no los cubre devuelve ok en false, debe llamarse con el mutex bloqueado
+func (h *history) since(last eventId) (entries []historyEntry, ok bool) {
+	// un id de otro epoch es de otra instancia o de antes de un reinicio, no se puede saber qué se perdió
+	if last.epoch != h.epoch {
+		return nil, false
+	}
+	lastId := last.seq
+	if lastId == h.lastId {
+		return nil, true
+	}
+	if lastId > h.lastId || lastId+1 < h.oldestId() {
+		return nil, false
+	}
+	for i := 0; i < h.size; i++ {
+		entry := h.entries[(h.start+i)%len(h.entries)]
+		if entry.id > lastId {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, true
+}
+
+// oldestId devuelve el id del mensaje más viejo que se tiene, o el siguiente id si el historial está vacío
+func (h *history) oldestId() uint64 {
+	if h.size == 0 {
+		return h.lastId + 1
+	}
+	return h.entries[h.start].id
+}
+
+// replay envía al cliente los mensajes que se perdió mientras estuvo desconectado y que le corresponden según sus topics,
+// si no están todos en el historial o no caben en su cola se le pide que haga resync, así no se pierde ninguno por la política
+// de overflow ni se desconecta al cliente apenas se reconecta; debe llamarse con el mutex del historial bloqueado
+func (hub *Hub) replay(client *Client, last eventId) {
+	entries, ok := hub.history.since(last)
+	var missed [][]byte
+	for _, entry := range entries {
+		if client.wants(entry.event) {
+			missed = append(missed, entry.data)
+		}
+	}
+	// el Write del cliente no saca mensajes de la cola mientras se reenvían, tienen que caber todos
+	if !ok || len(missed) > cap(client.outbound)-len(client.outbound) {
+		client.reply(models.WebsocketMessage{
+			Type:    models.EVENT_RESYNC_REQUIRED,
+			Payload: ResyncPayload{LastEventId: last.String(), OldestEventId: hub.history.eventId(hub.history.oldestId()).String()},
+		})
+		return
+	}
+	for _, data := range missed {
+		client.send(data)
+	}
+}
+
+// wants indica si el evento va dirigido al cliente, es la misma regla que usa recipients() pero para un solo cliente
+func (c *Client) wants(event hubEvent) bool {
+	if event.Disconnect || event.Ignore == c.id {
+		return false
+	}
+	switch {
+	case event.UserId != "":
+		return event.UserId == c.userId
+	case event.SessionId != "":
+		return event.SessionId == c.sessionId
+	case len(event.Topics) > 0:
+		c.hub.mutex.Lock()
+		defer c.hub.mutex.Unlock()
+		for _, topic := range event.Topics {
+			if c.topics[topic] {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
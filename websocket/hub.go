@@ -1,12 +1,17 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"platzi.com/go/rest-ws/auth"
+	"platzi.com/go/rest-ws/models"
 )
 
 // el upgrader es necesario para que la conexion http pueda utilizar un websocket
@@ -17,40 +22,129 @@ var upgrader = websocket.Upgrader{
 
 // el hub tendrá un slide de clientes, un canal especifico para todos los que se deseen registrar y para todos los clientes que se esten registrando de nuestro hub
 // también tendremos un mutex para evitar condiciones de carrera en el programa
+// config tiene la función que valida el token de los clientes antes de aceptar su conexión y cómo se manejan las colas de los clientes
+// topics es el índice de los clientes suscritos a cada topic, para no tener que enviar todos los mensajes a todos los clientes
+// history guarda los últimos mensajes para reenviarlos a los clientes que se reconectan
 type Hub struct {
 	clients    []*Client
+	topics     map[string]map[*Client]bool
 	register   chan *Client
 	unregister chan *Client
 	mutex      *sync.Mutex
+	history    *history
+	quit       chan struct{} // se cierra en Shutdown para detener Run
+	quitOnce   sync.Once
+	config     HubConfig
+	counters   hubCounters
 }
 
-// crear constructor para el hub que devolverá el Hub, :
-func NewHub() *Hub {
-	return &Hub{
+// HubConfig es la configuración con la que se crea el hub
+type HubConfig struct {
+	Authenticate   Authenticator  // valida el token con el que se conectan los clientes
+	QueueSize      int            // tamaño de la cola de salida de cada cliente
+	OverflowPolicy OverflowPolicy // qué hacer cuando la cola de un cliente se llena
+	Backplane      Backplane      // por donde pasan los mensajes para llegar a todas las instancias, si es nil se usa uno en memoria
+	HistorySize    int            // cantidad de mensajes que se guardan para los clientes que se reconectan con last_event_id
+}
+
+// crear constructor para el hub que devolverá el Hub, recibe la configuración, si no trae tamaño de cola, política o backplane se usan los valores por defecto:
+func NewHub(config HubConfig) (*Hub, error) {
+	if config.QueueSize <= 0 {
+		config.QueueSize = DEFAULT_QUEUE_SIZE
+	}
+	if config.OverflowPolicy == "" {
+		config.OverflowPolicy = DROP_OLDEST
+	}
+	if config.Backplane == nil {
+		config.Backplane = NewMemoryBackplane()
+	}
+	if config.HistorySize <= 0 {
+		config.HistorySize = DEFAULT_HISTORY_SIZE
+	}
+	hub := &Hub{
+		config: config,
 		// el hub tendrá un nuevo slide para clients de longitud 0, y para register y unregister crear el canal y para el mutex se usa lo de la librería de &sync.Mutex{}
 		clients:    make([]*Client, 0),
+		topics:     make(map[string]map[*Client]bool),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		mutex:      &sync.Mutex{},
+		history:    newHistory(config.HistorySize),
+		quit:       make(chan struct{}),
 	}
+	// el hub entrega a sus clientes todo lo que llega por el backplane, sin importar en qué instancia se publicó
+	if err := config.Backplane.Subscribe(hub.receive); err != nil {
+		return nil, err
+	}
+	return hub, nil
 }
 
 // Definir la ruta que será usada para los diferentes websockets
+// el cliente se debe autenticar con un token, que puede venir en la query (?token=), en el header Authorization, en Sec-WebSocket-Protocol o en un primer frame de tipo "auth"
+// si se reconecta con ?last_event_id=N recibe los mensajes que se perdió de los topics pasados en ?topics=
 func (hub *Hub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	lastEventId, resume, err := parseLastEventId(r.URL.Query().Get("last_event_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tokenString, subprotocol := tokenFromRequest(r)
+	// si el token viene en la petición, se valida antes del upgrade para poder responder un 401
+	var principal *auth.Principal
+	if tokenString != "" {
+		principal, err = hub.config.Authenticate(r.Context(), tokenString)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	// si el token vino como subprotocolo, el navegador exige que el servidor responda con ese subprotocolo
+	var header http.Header
+	if subprotocol != "" {
+		header = http.Header{"Sec-Websocket-Protocol": []string{subprotocol}}
+	}
 	// usar un upgrade para la conexion que permita usar los websockets
-	socket, err := upgrader.Upgrade(w, r, nil) // en este caso no se requere un response header, se pone como nil
+	socket, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Println(err)
 		// si hay un error, no se habrá podido abrir la conexion
 		http.Error(w, "Error upgrading connection", http.StatusInternalServerError)
 		return
 	}
-	// crear nuevo client pasando el hub y el socket
-	client := NewClient(hub, socket)
-	// al hub se le va a registrar el cliente:
-	hub.register <- client
+	// si no vino el token en la petición, el primer mensaje del cliente debe ser el de autenticación
+	if principal == nil {
+		principal, err = hub.authenticateFirstFrame(r.Context(), socket)
+		if err != nil {
+			log.Println("websocket auth failed:", err)
+			socket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unauthorized"), time.Now().Add(time.Second))
+			socket.Close()
+			return
+		}
+	}
+	// crear nuevo client pasando el hub, el socket y el usuario autenticado
+	client := NewClient(hub, socket, principal.UserId)
+	client.sessionId = principal.SessionId
+	client.expiresAt = principal.ExpiresAt
+	client.prepare(r.URL.Query().Get("topics"), lastEventId, resume)
+	// al hub se le va a registrar el cliente, si el hub ya se detuvo se cierra la conexión:
+	if !hub.registerClient(client) {
+		socket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(WRITE_WAIT))
+		socket.Close()
+		return
+	}
 
 	go client.Write() // go routina que se encarga de estar escribiendo
+	go client.Read()  // go routina que se encarga de leer y detectar cuando el cliente se desconecta
+	client.watchExpiry()
+}
+
+// authenticateFirstFrame lee el primer frame del socket y valida el token que trae
+func (hub *Hub) authenticateFirstFrame(ctx context.Context, socket *websocket.Conn) (*auth.Principal, error) {
+	tokenString, err := tokenFromFirstFrame(socket)
+	if err != nil {
+		return nil, err
+	}
+	return hub.config.Authenticate(ctx, tokenString)
 }
 
 // crear receiver function para el hub que le permitirá ejecutarse
@@ -63,36 +157,119 @@ func (hub *Hub) Run() {
 		// caso de cliente que se está desregistrando:
 		case client := <-hub.unregister:
 			hub.onDisconnect(client)
+		// caso en el que se detuvo el hub con Shutdown:
+		case <-hub.quit:
+			return
 		}
 	}
 }
 
+// registerClient envía el cliente a Run para que lo registre, devuelve false si el hub ya se detuvo
+func (hub *Hub) registerClient(client *Client) bool {
+	select {
+	case hub.register <- client:
+		return true
+	case <-hub.quit:
+		return false
+	}
+}
+
+// unregisterClient envía el cliente a Run para que lo desregistre, si el hub ya se detuvo no hace nada para no bloquear al que lo llama
+func (hub *Hub) unregisterClient(client *Client) {
+	select {
+	case hub.unregister <- client:
+	case <-hub.quit:
+	}
+}
+
+// Shutdown detiene Run, envía a todos los clientes un close frame de tipo "going away" y cierra el backplane,
+// se puede llamar más de una vez
+func (hub *Hub) Shutdown() {
+	hub.quitOnce.Do(func() {
+		close(hub.quit)
+		hub.mutex.Lock()
+		clients := make([]*Client, len(hub.clients))
+		copy(clients, hub.clients)
+		hub.clients = hub.clients[:0]
+		hub.topics = make(map[string]map[*Client]bool)
+		hub.mutex.Unlock()
+		log.Println("closing", len(clients), "hub clients")
+		for _, client := range clients {
+			client.closeWithReason(websocket.CloseGoingAway, "server shutting down")
+		}
+		if err := hub.config.Backplane.Close(); err != nil {
+			log.Println("backplane close:", err)
+		}
+	})
+}
+
 // onConnect pasar el parametro tipo client
 func (hub *Hub) onConnect(client *Client) {
-	// imprime que un cliente se está conectando, y la dirección que usa para coinectarse, con client.socket.RemoteAddr()
-	log.Println("Client connected", client.socket.RemoteAddr())
+	// imprime que un cliente se está conectando, el usuario y la dirección que usa para coinectarse, con client.remoteAddr
+	log.Println("Client connected", client.userId, client.remoteAddr)
+
+	// si el hub se detuvo mientras el cliente se registraba, se cierra su conexión
+	select {
+	case <-hub.quit:
+		client.closeWithReason(websocket.CloseGoingAway, "server shutting down")
+		return
+	default:
+	}
+
+	// mientras se registra y se le reenvían los mensajes perdidos no se entregan mensajes nuevos, así no se pierden ni se duplican
+	hub.history.mutex.Lock()
+	defer hub.history.mutex.Unlock()
 
 	// se bloquea el programa para evitar condiciones de carrera, porque se hará una modificación a los clientes que están conectados:
 	hub.mutex.Lock()
-	// al final se debe desbloquear el programa:
-	defer hub.mutex.Unlock()
-	// signar un id al client (que será la conexión que está usando para conectarse):
-	client.id = client.socket.RemoteAddr().String()
-	// agregar el nuevo cliente al hub de clientes que ya se tiene en existencia
+	// agregar el nuevo cliente al hub de clientes que ya se tiene en existencia, y a los topics con los que se conectó
 	hub.clients = append(hub.clients, client)
+	for topic := range client.topics {
+		if hub.topics[topic] == nil {
+			hub.topics[topic] = make(map[*Client]bool)
+		}
+		hub.topics[topic][client] = true
+	}
+	// al final se debe desbloquear el programa:
+	hub.mutex.Unlock()
+
+	if client.resumeFrom != nil {
+		hub.replay(client, *client.resumeFrom)
+	}
 }
 
-// la funcipon inDisconnect recibe también un client como parámetro
-func (hub *Hub) onDisconnect(client *Client) {
-	log.Println("Client disconnected", client.socket.RemoteAddr())
+// prepare suscribe al cliente a los topics con los que se conectó (?topics=posts,user:{id}) e indica desde qué mensaje se reconecta,
+// los topics se agregan al índice del hub cuando se registra
+func (c *Client) prepare(topics string, lastEventId eventId, resume bool) {
+	for _, topic := range strings.Split(topics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			if err := validateTopic(topic); err != nil {
+				log.Println("subscribe failed:", topic, err)
+				continue
+			}
+			c.topics[topic] = true
+		}
+	}
+	if resume {
+		c.resumeFrom = &lastEventId
+	}
+}
 
-	// Se cierra la conexión de ese cliente
-	client.Close()
+// parseLastEventId convierte el last_event_id que manda el cliente, resume es false si no lo mandó
+func parseLastEventId(value string) (id eventId, resume bool, err error) {
+	if value == "" {
+		return eventId{}, false, nil
+	}
+	if id, err = parseEventId(value); err != nil {
+		return eventId{}, false, err
+	}
+	return id, true, nil
+}
+
+// la funcipon inDisconnect recibe también un client como parámetro, se ejecuta cada vez que un cliente se desconecta
+func (hub *Hub) onDisconnect(client *Client) {
 	// hay que remover el cliente del NewHub, por lo tanto primero se bloquea:
 	hub.mutex.Lock()
-	// al finalizar desbloquearlo:
-	defer hub.mutex.Unlock()
-
 	// iterar a través de los clientes para buscar el que se ha desconectado
 	i := -1
 	for j, c := range hub.clients {
@@ -101,23 +278,147 @@ func (hub *Hub) onDisconnect(client *Client) {
 			break
 		}
 	}
-	// remover del hub el client encontrado:
-	copy(hub.clients[i:], hub.clients[i+1:])
-	hub.clients[len(hub.clients)-1] = nil
-	hub.clients = hub.clients[:len(hub.clients)-1]
+	// remover del hub el client encontrado, y de todos los topics a los que estaba suscrito:
+	if i != -1 {
+		for topic := range client.topics {
+			hub.removeFromTopic(client, topic)
+		}
+		copy(hub.clients[i:], hub.clients[i+1:])
+		hub.clients[len(hub.clients)-1] = nil
+		hub.clients = hub.clients[:len(hub.clients)-1]
+	}
+	hub.mutex.Unlock()
+
+	// si no se encuentra es porque ya se había desconectado antes
+	if i == -1 {
+		return
+	}
+	log.Println("Client disconnected", client.userId, client.remoteAddr)
+	// Se cierra la conexión de ese cliente
+	client.Close()
+}
+
+// hubEvent es lo que viaja por el backplane, indica el mensaje y a qué clientes va dirigido:
+// a los de un usuario (UserId), a los de una sesión (SessionId), a los suscritos a algún topic (Topics) o a todos si no trae ninguno
+// el id del mensaje no viaja, lo asigna cada hub al recibirlo
+type hubEvent struct {
+	Topics     []string         `json:"topics,omitempty"`
+	UserId     string           `json:"userId,omitempty"`
+	SessionId  string           `json:"sessionId,omitempty"`
+	Ignore     string           `json:"ignore,omitempty"`     // id de la conexión que no debe recibir el mensaje
+	Disconnect bool             `json:"disconnect,omitempty"` // en lugar de enviar el mensaje, se cierran las conexiones
+	Type       models.EventType `json:"type,omitempty"`
+	Payload    json.RawMessage  `json:"payload,omitempty"`
+}
 
+// newHubEvent separa el tipo y el payload del mensaje
+func newHubEvent(message models.WebsocketMessage) hubEvent {
+	payload, _ := json.Marshal(message.Payload)
+	return hubEvent{Type: message.Type, Payload: payload}
 }
 
-// función Broadcast que recibe como parámetro un mensaje que será una interface, es decir podemos transmitir cualquier tipo de data,
+// función Broadcast envía a todos los clientes conectados sin importar sus topics, para publicar solo a los interesados se usa Publish,
+// recibe como parámetro un mensaje cuyo payload será una interface, es decir podemos transmitir cualquier tipo de data,
 // y un cliente que puede enviar un mensaje a otro y el no quere recibir al mismo tiempo ese mensaje, por eso se pone usa el parámetro de ignore
-func (hub *Hub) Broadcast(message interface{}, ignore *Client) {
-	// serializar la data usando json.Marshal:
-	data, _ := json.Marshal(message)
-	// enviar a través del hub de client,
-	for _, client := range hub.clients {
-		// se hace la evaluación de que el cliente sea diferente, si es el caso se usa el outbpund para enviar la data que se desea:
-		if client != ignore {
-			client.outbound <- data
+func (hub *Hub) Broadcast(message models.WebsocketMessage, ignore *Client) {
+	event := newHubEvent(message)
+	if ignore != nil {
+		event.Ignore = ignore.id
+	}
+	hub.emit(event)
+}
+
+// SendToUser envía un mensaje solamente a las conexiones abiertas por el usuario indicado
+func (hub *Hub) SendToUser(userId string, message models.WebsocketMessage) {
+	event := newHubEvent(message)
+	event.UserId = userId
+	hub.emit(event)
+}
+
+// DisconnectUser cierra todas las conexiones abiertas por el usuario indicado, en todas las instancias
+func (hub *Hub) DisconnectUser(userId string) {
+	hub.emit(hubEvent{UserId: userId, Disconnect: true})
+}
+
+// DisconnectSession cierra las conexiones que se autenticaron con un token de la sesión indicada, en todas las instancias
+func (hub *Hub) DisconnectSession(sessionId string) {
+	hub.emit(hubEvent{SessionId: sessionId, Disconnect: true})
+}
+
+// emit publica el evento en el backplane, los errores solo se registran para no afectar a quien publica
+func (hub *Hub) emit(event hubEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Println("hub event:", err)
+		return
+	}
+	if err = hub.config.Backplane.Publish(context.Background(), payload); err != nil {
+		log.Println("backplane publish:", err)
+	}
+}
+
+// receive entrega a los clientes locales un evento que llegó por el backplane
+func (hub *Hub) receive(payload []byte) {
+	var event hubEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		log.Println("backplane event:", err)
+		return
+	}
+	if event.Disconnect {
+		for _, client := range hub.recipients(event) {
+			// al cerrar la cola, Write envía el close frame y cierra el socket, y Read desregistra al cliente
+			client.Close()
+		}
+		return
+	}
+	// se numera y se guarda el mensaje en el historial, y se entrega con el mutex bloqueado para que los ids lleguen en orden
+	hub.history.mutex.Lock()
+	defer hub.history.mutex.Unlock()
+	entry := hub.history.append(event)
+	for _, client := range hub.recipients(event) {
+		// send nunca espera a un cliente lento
+		client.send(entry.data)
+	}
+}
+
+// recipients devuelve una copia de los clientes locales a los que va dirigido el evento, para no mantener el mutex bloqueado mientras se les escribe,
+// cada cliente aparece una sola vez aunque esté en varios de los topics
+func (hub *Hub) recipients(event hubEvent) []*Client {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	var clients []*Client
+	add := func(client *Client) {
+		if client.id != event.Ignore {
+			clients = append(clients, client)
+		}
+	}
+	switch {
+	case event.UserId != "":
+		for _, client := range hub.clients {
+			if client.userId == event.UserId {
+				add(client)
+			}
+		}
+	case event.SessionId != "":
+		for _, client := range hub.clients {
+			if client.sessionId == event.SessionId {
+				add(client)
+			}
+		}
+	case len(event.Topics) > 0:
+		seen := make(map[*Client]bool)
+		for _, topic := range event.Topics {
+			for client := range hub.topics[topic] {
+				if !seen[client] {
+					seen[client] = true
+					add(client)
+				}
+			}
+		}
+	default:
+		for _, client := range hub.clients {
+			add(client)
 		}
 	}
+	return clients
 }
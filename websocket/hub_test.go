@@ -0,0 +1,271 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"platzi.com/go/rest-ws/models"
+)
+
+// receivedMessage es un WebsocketMessage con el payload sin decodificar
+type receivedMessage struct {
+	Id      string           `json:"id"`
+	Type    models.EventType `json:"type"`
+	Payload json.RawMessage  `json:"payload"`
+}
+
+func readMessage(t *testing.T, socket *websocket.Conn) receivedMessage {
+	t.Helper()
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	var message receivedMessage
+	if err := socket.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func publish(hub *Hub, payload string, topics ...string) {
+	hub.Publish(models.WebsocketMessage{Type: models.EVENT_POST_CREATED, Payload: payload}, topics...)
+}
+
+func TestSubscribeAndUnsubscribe(t *testing.T) {
+	hub, server := newTestHub(t, HubConfig{})
+	socket := dial(t, hub, server, "token=u1&topics=posts")
+
+	socket.WriteJSON(ClientMessage{Type: "subscribe", Topic: "post:1"})
+	if message := readMessage(t, socket); message.Type != models.EVENT_SUBSCRIBED || string(message.Payload) != `"post:1"` {
+		t.Fatalf("unexpected reply %+v", message)
+	}
+	// el cliente está en los dos topics pero recibe el mensaje una sola vez
+	publish(hub, "first", "posts", "post:1")
+	if message := readMessage(t, socket); string(message.Payload) != `"first"` {
+		t.Fatalf("unexpected message %+v", message)
+	}
+	publish(hub, "other", "post:2")
+
+	socket.WriteJSON(ClientMessage{Type: "unsubscribe", Topic: "post:1"})
+	if message := readMessage(t, socket); message.Type != models.EVENT_UNSUBSCRIBED {
+		t.Fatalf("unexpected reply %+v", message)
+	}
+	publish(hub, "after unsubscribe", "post:1")
+	publish(hub, "second", "posts")
+	if message := readMessage(t, socket); string(message.Payload) != `"second"` {
+		t.Fatalf("expected only the posts message, got %+v", message)
+	}
+
+	socket.WriteJSON(ClientMessage{Type: "subscribe", Topic: "unknown"})
+	if message := readMessage(t, socket); message.Type != models.EVENT_ERROR {
+		t.Fatalf("expected an error for an invalid topic, got %+v", message)
+	}
+}
+
+func TestUnsubscribeRemovesEmptyTopics(t *testing.T) {
+	hub, server := newTestHub(t, HubConfig{})
+	socket := dial(t, hub, server, "token=u1&topics=post:1")
+	socket.WriteJSON(ClientMessage{Type: "unsubscribe", Topic: "post:1"})
+	readMessage(t, socket)
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if _, ok := hub.topics["post:1"]; ok {
+		t.Fatal("expected the topic without clients to be removed")
+	}
+}
+
+func TestSendToUser(t *testing.T) {
+	hub, server := newTestHub(t, HubConfig{})
+	first := dial(t, hub, server, "token=u1")
+	second := dial(t, hub, server, "token=u2")
+	hub.SendToUser("u2", models.WebsocketMessage{Type: models.EVENT_POST_CREATED, Payload: "private"})
+	hub.Broadcast(models.WebsocketMessage{Type: models.EVENT_POST_CREATED, Payload: "everyone"}, nil)
+	if message := readMessage(t, first); string(message.Payload) != `"everyone"` {
+		t.Fatalf("u1 received %+v", message)
+	}
+	if message := readMessage(t, second); string(message.Payload) != `"private"` {
+		t.Fatalf("u2 received %+v", message)
+	}
+}
+
+// newQueuedClient registra un cliente sin socket que nadie lee, su cola se llena con QueueSize mensajes
+func newQueuedClient(t *testing.T, policy OverflowPolicy) (*Hub, *Client) {
+	t.Helper()
+	hub, _ := newTestHub(t, HubConfig{QueueSize: 2, OverflowPolicy: policy})
+	client := NewClient(hub, nil, "u1")
+	client.prepare(TOPIC_POSTS, eventId{}, false)
+	if !hub.registerClient(client) {
+		t.Fatal("hub stopped")
+	}
+	waitFor(t, func() bool { return hub.Metrics().Clients == 1 })
+	for _, payload := range []string{"1", "2", "3"} {
+		publish(hub, payload, TOPIC_POSTS)
+	}
+	return hub, client
+}
+
+func queuedPayloads(client *Client) []string {
+	var payloads []string
+	for {
+		select {
+		case data, ok := <-client.outbound:
+			if !ok {
+				return payloads
+			}
+			var message receivedMessage
+			json.Unmarshal(data, &message)
+			payloads = append(payloads, string(message.Payload))
+		default:
+			return payloads
+		}
+	}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	hub, client := newQueuedClient(t, DROP_OLDEST)
+	if payloads := queuedPayloads(client); len(payloads) != 2 || payloads[0] != `"2"` || payloads[1] != `"3"` {
+		t.Fatalf("expected the two newest messages, got %v", payloads)
+	}
+	if metrics := hub.Metrics(); metrics.Dropped != 1 || metrics.Evicted != 0 || metrics.Clients != 1 {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	hub, client := newQueuedClient(t, DROP_NEWEST)
+	if payloads := queuedPayloads(client); len(payloads) != 2 || payloads[0] != `"1"` || payloads[1] != `"2"` {
+		t.Fatalf("expected the two oldest messages, got %v", payloads)
+	}
+	if metrics := hub.Metrics(); metrics.Dropped != 1 || metrics.Evicted != 0 {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	hub, client := newQueuedClient(t, DISCONNECT)
+	client.mutex.Lock()
+	closed := client.closed
+	client.mutex.Unlock()
+	if !closed {
+		t.Fatal("expected the slow client to be disconnected")
+	}
+	if metrics := hub.Metrics(); metrics.Evicted != 1 || metrics.Dropped != 0 {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+	// lo que ya estaba en la cola se entrega antes de cerrar
+	if payloads := queuedPayloads(client); len(payloads) != 2 {
+		t.Fatalf("expected the queued messages, got %v", payloads)
+	}
+}
+
+func TestResumeFromLastEventId(t *testing.T) {
+	hub, server := newTestHub(t, HubConfig{HistorySize: 3})
+	socket := dial(t, hub, server, "token=u1&topics=posts")
+	var ids []string
+	for _, payload := range []string{"1", "2", "3", "4"} {
+		publish(hub, payload, TOPIC_POSTS)
+		ids = append(ids, readMessage(t, socket).Id)
+	}
+	publish(hub, "other topic", "post:1")
+	socket.Close()
+	waitFor(t, func() bool { return hub.Metrics().Clients == 0 })
+
+	resumed := dial(t, hub, server, "token=u1&topics=posts&last_event_id="+ids[1])
+	for _, expected := range []string{`"3"`, `"4"`} {
+		if message := readMessage(t, resumed); string(message.Payload) != expected {
+			t.Fatalf("expected %s, got %+v", expected, message)
+		}
+	}
+	// después del replay llegan los mensajes nuevos
+	publish(hub, "5", TOPIC_POSTS)
+	if message := readMessage(t, resumed); string(message.Payload) != `"5"` {
+		t.Fatalf("expected the new message, got %+v", message)
+	}
+
+	// el primer mensaje ya salió del historial
+	gap := dial(t, hub, server, "token=u1&topics=posts&last_event_id="+ids[0])
+	if message := readMessage(t, gap); message.Type != models.EVENT_RESYNC_REQUIRED {
+		t.Fatalf("expected %s, got %+v", models.EVENT_RESYNC_REQUIRED, message)
+	}
+}
+
+// si se perdió más mensajes de los que caben en su cola no se le reenvían, se le pide resync con cualquier política de overflow
+func TestResumeWithMoreMissedThanQueue(t *testing.T) {
+	for _, policy := range []OverflowPolicy{DROP_OLDEST, DROP_NEWEST, DISCONNECT} {
+		hub, server := newTestHub(t, HubConfig{QueueSize: 2, HistorySize: 8, OverflowPolicy: policy})
+		socket := dial(t, hub, server, "token=u1&topics=posts")
+		publish(hub, "1", TOPIC_POSTS)
+		lastId := readMessage(t, socket).Id
+		socket.Close()
+		waitFor(t, func() bool { return hub.Metrics().Clients == 0 })
+		for _, payload := range []string{"2", "3", "4"} {
+			publish(hub, payload, TOPIC_POSTS)
+		}
+
+		resumed := dial(t, hub, server, "token=u1&topics=posts&last_event_id="+lastId)
+		if message := readMessage(t, resumed); message.Type != models.EVENT_RESYNC_REQUIRED {
+			t.Fatalf("%s: expected %s, got %+v", policy, models.EVENT_RESYNC_REQUIRED, message)
+		}
+		// el cliente sigue conectado y recibe los mensajes nuevos
+		publish(hub, "5", TOPIC_POSTS)
+		if message := readMessage(t, resumed); string(message.Payload) != `"5"` {
+			t.Fatalf("%s: expected the new message, got %+v", policy, message)
+		}
+		if metrics := hub.Metrics(); metrics.Dropped != 0 || metrics.Evicted != 0 {
+			t.Fatalf("%s: unexpected metrics %+v", policy, metrics)
+		}
+	}
+}
+
+func TestShutdownClosesClients(t *testing.T) {
+	hub, server := newTestHub(t, HubConfig{})
+	socket := dial(t, hub, server, "token=u1")
+	hub.Shutdown()
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := socket.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected a going away close frame, got %v", err)
+	}
+	if hub.registerClient(NewClient(hub, nil, "u2")) {
+		t.Fatal("expected the stopped hub to reject new clients")
+	}
+}
+
+// con varias instancias cada hub numera con su propio epoch, un id de otra instancia (o de antes de un reinicio)
+// pide resync aunque su número sea menor que el del hub al que se reconecta
+func TestResumeFromAnotherInstance(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	first, firstServer := newTestHub(t, HubConfig{Backplane: backplane})
+	second, secondServer := newTestHub(t, HubConfig{Backplane: backplane})
+	socket := dial(t, first, firstServer, "token=u1&topics=posts")
+	publish(first, "1", TOPIC_POSTS)
+	lastId := readMessage(t, socket).Id
+	for _, payload := range []string{"2", "3", "4"} {
+		publish(first, payload, TOPIC_POSTS)
+	}
+
+	resumed := dial(t, second, secondServer, "token=u1&topics=posts&last_event_id="+lastId)
+	message := readMessage(t, resumed)
+	if message.Type != models.EVENT_RESYNC_REQUIRED {
+		t.Fatalf("expected %s, got %+v", models.EVENT_RESYNC_REQUIRED, message)
+	}
+	var payload ResyncPayload
+	json.Unmarshal(message.Payload, &payload)
+	if payload.LastEventId != lastId {
+		t.Fatalf("unexpected resync payload %+v", payload)
+	}
+}
+
+func TestInvalidLastEventId(t *testing.T) {
+	_, server := newTestHub(t, HubConfig{})
+	for _, value := range []string{"12", "-3", "epoch-x"} {
+		res, err := http.Get(server.URL + "/events?token=u1&last_event_id=" + value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", value, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package websocket
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// OverflowPolicy define qué hacer cuando la cola de salida de un cliente está llena (el cliente no está leyendo lo suficientemente rápido)
+type OverflowPolicy string
+
+const (
+	// se descarta el mensaje más viejo de la cola para hacer espacio al nuevo
+	DROP_OLDEST OverflowPolicy = "drop_oldest"
+	// se descarta el mensaje nuevo y la cola se queda como está
+	DROP_NEWEST OverflowPolicy = "drop_newest"
+	// se desconecta al cliente lento
+	DISCONNECT OverflowPolicy = "disconnect"
+
+	// tamaño por defecto de la cola de salida de cada cliente
+	DEFAULT_QUEUE_SIZE = 256
+)
+
+// ParseOverflowPolicy convierte el valor de configuración en una OverflowPolicy, si viene vacío se usa DROP_OLDEST
+func ParseOverflowPolicy(value string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(value); policy {
+	case "":
+		return DROP_OLDEST, nil
+	case DROP_OLDEST, DROP_NEWEST, DISCONNECT:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q", value)
+	}
+}
+
+// HubMetrics son los contadores del hub que se exponen para monitorear a los clientes lentos
+type HubMetrics struct {
+	Clients   int    `json:"clients"`
+	Delivered uint64 `json:"delivered"` // mensajes encolados a algún cliente
+	Dropped   uint64 `json:"dropped"`   // mensajes descartados porque la cola del cliente estaba llena
+	Evicted   uint64 `json:"evicted"`   // clientes desconectados por ser lentos
+}
+
+// hubCounters se actualizan de forma atómica desde los diferentes goroutines que envían mensajes
+type hubCounters struct {
+	delivered uint64
+	dropped   uint64
+	evicted   uint64
+}
+
+// Metrics devuelve una copia de los contadores actuales del hub
+func (hub *Hub) Metrics() HubMetrics {
+	hub.mutex.Lock()
+	clients := len(hub.clients)
+	hub.mutex.Unlock()
+	return HubMetrics{
+		Clients:   clients,
+		Delivered: atomic.LoadUint64(&hub.counters.delivered),
+		Dropped:   atomic.LoadUint64(&hub.counters.dropped),
+		Evicted:   atomic.LoadUint64(&hub.counters.evicted),
+	}
+}
+
+// send encola el mensaje para el cliente sin bloquear nunca a quien lo envía, si la cola está llena se aplica la política de overflow del hub,
+// devuelve false si el mensaje no se encoló
+func (c *Client) send(data []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.outbound <- data:
+		atomic.AddUint64(&c.hub.counters.delivered, 1)
+		return true
+	default:
+	}
+	// la cola está llena:
+	switch c.hub.config.OverflowPolicy {
+	case DROP_NEWEST:
+		atomic.AddUint64(&c.hub.counters.dropped, 1)
+		return false
+	case DISCONNECT:
+		atomic.AddUint64(&c.hub.counters.evicted, 1)
+		// al cerrar la cola, Write envía el close frame y cierra el socket, y Read desregistra al cliente
+		c.closeLocked()
+		return false
+	default: // DROP_OLDEST
+		select {
+		case <-c.outbound:
+			atomic.AddUint64(&c.hub.counters.dropped, 1)
+		default:
+		}
+		select {
+		case c.outbound <- data:
+			atomic.AddUint64(&c.hub.counters.delivered, 1)
+			return true
+		default:
+			atomic.AddUint64(&c.hub.counters.dropped, 1)
+			return false
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// cada cuanto se envía un comentario vacío a los clientes SSE para que los proxies no cierren la conexión por inactividad
+const SSE_HEARTBEAT = 30 * time.Second
+
+// HandleEvents es la alternativa a /ws con Server-Sent Events, para los clientes que están detrás de proxies que no permiten el upgrade a websocket,
+// recibe los mismos mensajes que el websocket, con la misma autenticación (?token= o header Authorization), los mismos topics (?topics=)
+// y se puede reanudar con el header Last-Event-ID (que el EventSource del navegador envía solo al reconectarse) o con ?last_event_id=
+func (hub *Hub) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	lastEventIdValue := r.Header.Get("Last-Event-ID")
+	if lastEventIdValue == "" {
+		lastEventIdValue = r.URL.Query().Get("last_event_id")
+	}
+	lastEventId, resume, err := parseLastEventId(lastEventIdValue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tokenString, _ := tokenFromRequest(r)
+	if tokenString == "" {
+		http.Error(w, "token is required", http.StatusUnauthorized)
+		return
+	}
+	principal, err := hub.config.Authenticate(r.Context(), tokenString)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// el cliente SSE no tiene socket, los mensajes de su cola se escriben en esta misma respuesta
+	client := NewClient(hub, nil, principal.UserId)
+	client.remoteAddr = r.RemoteAddr
+	client.sessionId = principal.SessionId
+	client.expiresAt = principal.ExpiresAt
+	client.prepare(r.URL.Query().Get("topics"), lastEventId, resume)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // para que nginx no guarde los eventos en buffer
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if !hub.registerClient(client) {
+		return
+	}
+	// cuando termina la respuesta (el cliente se fue o se cerró su cola) se desregistra del hub
+	defer hub.unregisterClient(client)
+	client.watchExpiry()
+
+	heartbeat := time.NewTicker(SSE_HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case message, ok := <-client.outbound:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, message); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent escribe el mensaje en formato SSE, el id del mensaje se usa como id del evento para que el navegador lo mande como Last-Event-ID
+func writeEvent(w http.ResponseWriter, message []byte) error {
+	var envelope struct {
+		Id string `json:"id"`
+	}
+	json.Unmarshal(message, &envelope)
+	if envelope.Id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", envelope.Id); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "data: %s\n\n", message)
+	return err
+}
@@ -0,0 +1,74 @@
+package websocket
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleEvents(t *testing.T) {
+	hub, server := newTestHub(t, HubConfig{})
+	res, err := http.Get(server.URL + "/events?token=u1&topics=posts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	waitFor(t, func() bool { return hub.Metrics().Clients == 1 })
+	publish(hub, "hello", TOPIC_POSTS)
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	var id, data string
+	for id == "" || data == "" {
+		select {
+		case line := <-lines:
+			if strings.HasPrefix(line, "id: ") {
+				id = line
+			}
+			if strings.HasPrefix(line, "data: ") {
+				data = line
+			}
+		case <-time.After(time.Second):
+			t.Fatal("event not received")
+		}
+	}
+	if !strings.Contains(data, `"payload":"hello"`) {
+		t.Fatalf("unexpected event %s", data)
+	}
+
+	// al desconectar al usuario termina la respuesta
+	hub.DisconnectUser("u1")
+	for {
+		select {
+		case _, ok := <-lines:
+			if !ok {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("response not closed")
+		}
+	}
+}
+
+func TestHandleEventsRequiresToken(t *testing.T) {
+	_, server := newTestHub(t, HubConfig{})
+	res, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,116 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"platzi.com/go/rest-ws/models"
+)
+
+const (
+	// topic con todos los posts que se crean
+	TOPIC_POSTS = "posts"
+	// prefijo del topic de los posts de un usuario, ej: user:2FivNlAbeNimVRML4UUU5gS99Q2
+	TOPIC_USER_PREFIX = "user:"
+	// prefijo del topic de un post en particular, ej: post:2Fivq80aJ0z7OM8RdpJ9TdHznpi
+	TOPIC_POST_PREFIX = "post:"
+)
+
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// UserTopic devuelve el topic con los eventos de los posts de un usuario
+func UserTopic(userId string) string {
+	return TOPIC_USER_PREFIX + userId
+}
+
+// PostTopic devuelve el topic con los eventos de un post en particular
+func PostTopic(postId string) string {
+	return TOPIC_POST_PREFIX + postId
+}
+
+// validateTopic revisa que el topic sea uno de los soportados: posts, user:{id} o post:{id}
+func validateTopic(topic string) error {
+	if topic == TOPIC_POSTS {
+		return nil
+	}
+	for _, prefix := range []string{TOPIC_USER_PREFIX, TOPIC_POST_PREFIX} {
+		if strings.HasPrefix(topic, prefix) && len(topic) > len(prefix) {
+			return nil
+		}
+	}
+	return ErrInvalidTopic
+}
+
+// subscribe agrega al cliente al índice de topics del hub
+func (hub *Hub) subscribe(client *Client, topic string) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	}
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if hub.topics[topic] == nil {
+		hub.topics[topic] = make(map[*Client]bool)
+	}
+	hub.topics[topic][client] = true
+	client.topics[topic] = true
+	return nil
+}
+
+// unsubscribe quita al cliente del topic, si el topic se queda sin clientes se elimina del índice
+func (hub *Hub) unsubscribe(client *Client, topic string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.removeFromTopic(client, topic)
+}
+
+// removeFromTopic debe llamarse con el mutex del hub bloqueado
+func (hub *Hub) removeFromTopic(client *Client, topic string) {
+	delete(client.topics, topic)
+	subscribers, ok := hub.topics[topic]
+	if !ok {
+		return
+	}
+	delete(subscribers, client)
+	if len(subscribers) == 0 {
+		delete(hub.topics, topic)
+	}
+}
+
+// Publish envía el mensaje a los clientes suscritos a cualquiera de los topics, cada cliente lo recibe una sola vez aunque esté en varios topics
+func (hub *Hub) Publish(message models.WebsocketMessage, topics ...string) {
+	if len(topics) == 0 {
+		return
+	}
+	event := newHubEvent(message)
+	event.Topics = topics
+	hub.emit(event)
+}
+
+// handleClientMessage procesa los mensajes que el cliente envía por el socket: subscribe y unsubscribe
+func (c *Client) handleClientMessage(data []byte) {
+	var message ClientMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		c.reply(models.WebsocketMessage{Type: models.EVENT_ERROR, Payload: "invalid message"})
+		return
+	}
+	switch message.Type {
+	case "subscribe":
+		if err := c.hub.subscribe(c, message.Topic); err != nil {
+			c.reply(models.WebsocketMessage{Type: models.EVENT_ERROR, Payload: err.Error()})
+			return
+		}
+		c.reply(models.WebsocketMessage{Type: models.EVENT_SUBSCRIBED, Payload: message.Topic})
+	case "unsubscribe":
+		c.hub.unsubscribe(c, message.Topic)
+		c.reply(models.WebsocketMessage{Type: models.EVENT_UNSUBSCRIBED, Payload: message.Topic})
+	default:
+		c.reply(models.WebsocketMessage{Type: models.EVENT_ERROR, Payload: "unknown message type"})
+	}
+}
+
+// reply envía una respuesta solamente a este cliente
+func (c *Client) reply(message models.WebsocketMessage) {
+	data, _ := json.Marshal(message)
+	c.send(data)
+}